@@ -0,0 +1,408 @@
+package mongotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// anonymizeDBPrefix names the temporary databases data is staged in before it is anonymized
+const anonymizeDBPrefix = "mongotest_anonymize_"
+
+// anonymizeMaxDateShift is the furthest a date is moved by the anonymizer, in either direction
+const anonymizeMaxDateShift = 180 * 24 * time.Hour
+
+// AnonymizeRule selects a field to be anonymized
+type AnonymizeRule struct {
+	// Collection limits the rule to a single collection. By default, the rule applies to every collection.
+	Collection string
+	// Field is the dotted path to anonymize (e.g. "address.street"). Arrays are traversed, and
+	// every value within an embedded document or array is anonymized.
+	Field string
+	// Fake is the kind of fake value strings are replaced with (e.g. FakeEmail - see FakeKinds).
+	// By default, strings are replaced with random letters and digits of the same length.
+	Fake string
+}
+
+// Anonymizer scrubs PII from data as it is imported or restored. Values are replaced with fake
+// values of the same BSON type, derived from the original value and the salt - so the same input
+// always produces the same output, across fields and collections. An ObjectID referenced from
+// another collection is anonymized to the same ObjectID in both places, so references still
+// resolve. Dates are shifted by up to 180 days, numbers keep their number of digits, and binary
+// values keep their length and subtype. Booleans and nulls are left alone.
+type Anonymizer struct {
+	// Salt is mixed into every fake value, so they can't be reversed by hashing guesses. Use the
+	// same salt to anonymize related data sets consistently.
+	Salt string
+	// Rules select the fields to anonymize
+	Rules []AnonymizeRule
+}
+
+// AnonymizeReport describes what an Anonymizer changed
+type AnonymizeReport struct {
+	// Documents is the number of documents with at least one anonymized value
+	Documents int64
+	// Fields maps "<db>.<collection>.<field>" to the number of values anonymized in that field
+	Fields map[string]int64
+}
+
+// String lists the anonymized fields, sorted, one per line
+func (ar *AnonymizeReport) String() string {
+	fields := make([]string, 0, len(ar.Fields))
+	for field := range ar.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "anonymized %d documents", ar.Documents)
+	for _, field := range fields {
+		fmt.Fprintf(&sb, "\n  %s: %d values", field, ar.Fields[field])
+	}
+	return sb.String()
+}
+
+func newAnonymizeReport() *AnonymizeReport {
+	return &AnonymizeReport{Fields: map[string]int64{}}
+}
+
+// Validate checks that every rule is complete
+func (a *Anonymizer) Validate() error {
+	for i, rule := range a.Rules {
+		if len(rule.Field) == 0 {
+			return fmt.Errorf("anonymize rule %d: a field is required", i+1)
+		}
+		if _, ok := fakeGenerators[rule.Fake]; len(rule.Fake) != 0 && !ok {
+			return fmt.Errorf("anonymize rule %d: unknown fake value kind '%s' (expected one of %s)",
+				i+1, rule.Fake, strings.Join(FakeKinds(), ", "))
+		}
+	}
+	return nil
+}
+
+// anonymize rewrites the configured fields in doc from dbName.collName, recording them in report
+func (a *Anonymizer) anonymize(dbName, collName string, doc bson.D, report *AnonymizeReport) (bson.D, error) {
+	touched := false
+	for _, rule := range a.Rules {
+		if len(rule.Collection) != 0 && rule.Collection != collName {
+			continue
+		}
+		var count int64
+		var err error
+		doc, err = transformPath(doc, strings.Split(rule.Field, "."), func(value interface{}) (interface{}, bool, error) {
+			newValue, err := a.anonymizeValue(rule, value, &count)
+			return newValue, true, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not anonymize '%s': %w", rule.Field, err)
+		}
+		if count != 0 {
+			report.Fields[dbName+"."+collName+"."+rule.Field] += count
+			touched = true
+		}
+	}
+	if touched {
+		report.Documents++
+	}
+	return doc, nil
+}
+
+// anonymizeValue returns a fake value of the same type as value, incrementing count for every
+// value replaced
+func (a *Anonymizer) anonymizeValue(rule AnonymizeRule, value interface{}, count *int64) (interface{}, error) {
+	switch typed := value.(type) {
+	case bson.D:
+		out := make(bson.D, 0, len(typed))
+		for _, elem := range typed {
+			newValue, err := a.anonymizeValue(rule, elem.Value, count)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{Key: elem.Key, Value: newValue})
+		}
+		return out, nil
+	case bson.A:
+		out := make(bson.A, 0, len(typed))
+		for _, item := range typed {
+			newValue, err := a.anonymizeValue(rule, item, count)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, newValue)
+		}
+		return out, nil
+	case nil, bool, primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return value, nil
+	}
+
+	seed, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	if err != nil {
+		return nil, err
+	}
+	src := newFakeSource(append([]byte(a.Salt+"\x00"), seed...))
+	*count++
+	switch typed := value.(type) {
+	case string:
+		if len(rule.Fake) != 0 {
+			return fakeGenerators[rule.Fake](src), nil
+		}
+		return fakeAlphanumeric(src, typed), nil
+	case primitive.ObjectID:
+		var oid primitive.ObjectID
+		copy(oid[:], src.bytes(len(oid)))
+		// Keep the timestamp, so documents still sort by creation time
+		copy(oid[:4], typed[:4])
+		return oid, nil
+	case int32:
+		return int32(fakeNumber(src, int64(typed), math.MaxInt32)), nil
+	case int64:
+		return fakeNumber(src, typed, math.MaxInt64), nil
+	case float64:
+		magnitude := math.Pow(10, math.Ceil(math.Log10(math.Abs(typed)+1)))
+		fake := float64(src.intn(1000000)) / 1000000 * magnitude
+		return math.Copysign(fake, typed), nil
+	case primitive.Decimal128:
+		fake, err := primitive.ParseDecimal128(fmt.Sprintf("%d.%02d", src.intn(100000), src.intn(100)))
+		return fake, err
+	case primitive.DateTime:
+		shift := time.Duration(src.intn(int(2*anonymizeMaxDateShift/time.Second))) * time.Second
+		return primitive.NewDateTimeFromTime(typed.Time().Add(shift - anonymizeMaxDateShift)), nil
+	case primitive.Binary:
+		return primitive.Binary{Subtype: typed.Subtype, Data: append([]byte{}, src.bytes(len(typed.Data))...)}, nil
+	case primitive.Timestamp, primitive.Regex, primitive.JavaScript, primitive.CodeWithScope,
+		primitive.Symbol, primitive.DBPointer:
+		// Not data worth anonymizing
+		*count--
+		return value, nil
+	}
+	return nil, fmt.Errorf("cannot anonymize values of type %T", value)
+}
+
+// fakeAlphanumeric replaces every letter and digit in s, keeping its length, case and punctuation
+func fakeAlphanumeric(src *fakeSource, s string) string {
+	const (
+		lower  = "abcdefghijklmnopqrstuvwxyz"
+		upper  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+		digits = "0123456789"
+	)
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			runes[i] = rune(lower[src.intn(len(lower))])
+		case r >= 'A' && r <= 'Z':
+			runes[i] = rune(upper[src.intn(len(upper))])
+		case r >= '0' && r <= '9':
+			runes[i] = rune(digits[src.intn(len(digits))])
+		}
+	}
+	return string(runes)
+}
+
+// fakeNumber returns a number with the same sign and number of digits as n
+func fakeNumber(src *fakeSource, n int64, max int64) int64 {
+	if n == 0 {
+		return 0
+	}
+	abs := n
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs < 0 {
+		// -math.MinInt64 overflows
+		abs = max
+	}
+	low, high := int64(1), int64(10)
+	for high <= abs && high <= max/10 {
+		low, high = high, high*10
+	}
+	if abs >= high {
+		// n is within a digit of max - the range can't be widened any further
+		high = max
+	}
+	fake := low + int64(src.intn(int(high-low)))
+	if n < 0 {
+		return -fake
+	}
+	return fake
+}
+
+// Anonymize rewrites the fields selected by a in every imported document. The data is first
+// imported into a temporary collection, then anonymized into the target collection, so PII is
+// never written to the target. The result includes a report of every field changed.
+func (di *DatabaseImporter) Anonymize(a *Anonymizer) *DatabaseImporter {
+	di.anonymizer = a
+	return di
+}
+
+// importAnonymized imports fpath into a temporary collection, then writes it into the target
+// collection through di.anonymizer
+func (di *DatabaseImporter) importAnonymized(fpath string) (ImportResult, error) {
+	if err := di.anonymizer.Validate(); err != nil {
+		return ImportResult{}, di.testConn.newError(PhaseImport, err)
+	}
+	prefix, err := tempDBPrefix(anonymizeDBPrefix)
+	if err != nil {
+		return ImportResult{}, di.testConn.newError(PhaseImport, err)
+	}
+	staging := *di
+	staging.dbName = prefix + di.dbName
+	staging.drop = true
+	staging.mode = ""
+	staging.upsertFields = nil
+	staging.anonymizer = nil
+	ctx := context.Background()
+	stagingDB := di.testConn.MongoDriverClient().Database(staging.dbName)
+	defer stagingDB.Drop(ctx)
+	result, err := staging.importFile(fpath)
+	if err != nil {
+		return result, err
+	}
+
+	report := newAnonymizeReport()
+	result.Anonymized = report
+	imported, failed, err := di.writeAnonymized(ctx, stagingDB.Collection(di.collectionName), report)
+	result.Imported = imported
+	result.Failed += failed
+	if err != nil {
+		di.testConn.logger.Error("Could not write anonymized documents", Fields{"err": err})
+		return result, di.testConn.newError(PhaseImport, err)
+	}
+	di.testConn.logger.Debug("Anonymized imported documents", Fields{
+		"database":   di.dbName,
+		"collection": di.collectionName,
+		"report":     report.String(),
+	})
+	return result, nil
+}
+
+// writeAnonymized anonymizes every document in staging into the target collection, honouring
+// the importer's Drop, Mode, UpsertFields and StopOnError settings
+func (di *DatabaseImporter) writeAnonymized(ctx context.Context, staging *mongo.Collection, report *AnonymizeReport) (imported, failed uint64, err error) {
+	target := di.testConn.MongoDriverClient().Database(di.dbName).Collection(di.collectionName)
+	if di.drop {
+		if err = target.Drop(ctx); err != nil {
+			return 0, 0, err
+		}
+	}
+	upsertFields := di.upsertFields
+	if len(upsertFields) == 0 {
+		upsertFields = []string{"_id"}
+	}
+	cursor, err := staging.Find(ctx, bson.D{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	bulkOpts := options.BulkWrite().SetOrdered(di.stopOnError)
+	models := make([]mongo.WriteModel, 0, fixtureInsertBatchSize)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := target.BulkWrite(ctx, models, bulkOpts)
+		if res != nil {
+			imported += uint64(res.InsertedCount + res.UpsertedCount + res.ModifiedCount)
+		}
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && !di.stopOnError {
+			failed += uint64(len(bulkErr.WriteErrors))
+			err = nil
+		}
+		models = models[:0]
+		return err
+	}
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			return imported, failed, err
+		}
+		if doc, err = di.anonymizer.anonymize(di.dbName, di.collectionName, doc, report); err != nil {
+			return imported, failed, err
+		}
+		models = append(models, anonymizedWriteModel(di.mode, doc, upsertFields))
+		if len(models) == fixtureInsertBatchSize {
+			if err = flush(); err != nil {
+				return imported, failed, err
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return imported, failed, err
+	}
+	return imported, failed, flush()
+}
+
+// anonymizedWriteModel writes doc the same way mongoimport would in the given mode
+func anonymizedWriteModel(mode ImportMode, doc bson.D, upsertFields []string) mongo.WriteModel {
+	if len(mode) == 0 || mode == ImportModeInsert {
+		return mongo.NewInsertOneModel().SetDocument(doc)
+	}
+	filter := bson.D{}
+	values := doc.Map()
+	for _, field := range upsertFields {
+		filter = append(filter, bson.E{Key: field, Value: values[field]})
+	}
+	if mode == ImportModeMerge {
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.D{{Key: "$set", Value: doc}}).SetUpsert(true)
+	}
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true)
+}
+
+// RestoreAnonymized restores the snapshot like Restore, but anonymizes it on the way in using a.
+// The snapshot is first restored into temporary databases, then anonymized into the original
+// databases, so PII is never written to them. The returned report lists every field changed.
+func (tc *TestConnection) RestoreAnonymized(ctx context.Context, snapshot *Snapshot, a *Anonymizer) (*AnonymizeReport, error) {
+	if err := a.Validate(); err != nil {
+		return nil, tc.newError(PhaseRestore, err)
+	}
+	// Each restore stages into its own databases, so concurrent restores and staging databases
+	// left behind by earlier runs are never picked up
+	prefix, err := tempDBPrefix(anonymizeDBPrefix)
+	if err != nil {
+		return nil, tc.newError(PhaseRestore, err)
+	}
+	if err = tc.restore(ctx, snapshot, "$db$.$coll$", prefix+"$db$.$coll$"); err != nil {
+		return nil, err
+	}
+	client := tc.MongoDriverClient()
+	stagingNames, err := client.ListDatabaseNames(ctx, bson.D{{Key: "name", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)}}})
+	if err != nil {
+		return nil, tc.newError(PhaseRestore, err)
+	}
+	defer func() {
+		for _, stagingName := range stagingNames {
+			client.Database(stagingName).Drop(context.Background())
+		}
+	}()
+	report := newAnonymizeReport()
+	for _, stagingName := range stagingNames {
+		dbName := strings.TrimPrefix(stagingName, prefix)
+		if strings.HasPrefix(dbName, transformedDBPrefix) {
+			// Transformed snapshots are dumped from a temporary database too - strip its prefix
+			// along with its token
+			dbName = strings.TrimPrefix(dbName, transformedDBPrefix)
+			dbName = dbName[strings.Index(dbName, "_")+1:]
+		}
+		err = tc.copyCollections(ctx, stagingName, dbName, "", func(string) bson.D {
+			return bson.D{}
+		}, func(collName string, doc bson.D) (bson.D, error) {
+			return a.anonymize(dbName, collName, doc, report)
+		}, nil)
+		if err != nil {
+			return report, tc.newError(PhaseRestore, fmt.Errorf("could not anonymize '%s': %w", dbName, err))
+		}
+	}
+	tc.logger.Debug("Restored anonymized snapshot", Fields{"report": report.String()})
+	return report, nil
+}
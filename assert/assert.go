@@ -0,0 +1,453 @@
+// Package assert provides testify-style assertions about the contents of a mongo database
+// started by mongotest. Each assertion reports a failure through t and returns whether it
+// passed. When a document lookup fails, the message includes the documents which came closest
+// to matching the filter, so the cause is usually visible without re-running the test:
+//
+//	conn := mongotest.NewTestConnectionT(t)
+//	...
+//	assert.DocumentExists(t, conn, "shop", "orders", bson.M{"status": "paid", "total": 42})
+//
+// Assertions can also be bound to a test and connection:
+//
+//	dbAssert := assert.New(t, conn)
+//	dbAssert.DocumentCount("shop", "orders", bson.M{"status": "paid"}, 3)
+package assert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tophergopher/mongotest"
+	"github.com/tophergopher/mongotest/internal/bsonvalue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// nearestDocumentCount is the number of near misses included in failure messages
+const nearestDocumentCount = 3
+
+// nearestScanLimit caps the documents scored per filter clause when looking for near misses
+const nearestScanLimit = 1000
+
+// eventuallyTick is how often Eventually re-runs its query
+const eventuallyTick = 100 * time.Millisecond
+
+// TestingT is the subset of testing.TB used by the assertions
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+type tHelper interface {
+	Helper()
+}
+
+// DocumentExists asserts that at least one document in dbName.collName matches filter
+func DocumentExists(t TestingT, conn *mongotest.TestConnection, dbName, collName string, filter interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	coll := collection(conn, dbName, collName)
+	err := coll.FindOne(ctx, filter).Err()
+	if err == nil {
+		return true
+	} else if err != mongo.ErrNoDocuments {
+		return fail(t, fmt.Sprintf("Could not query %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	return fail(t, fmt.Sprintf("No document in %s.%s matches %s%s",
+		dbName, collName, formatValue(filter), nearestDocuments(ctx, coll, filter)), msgAndArgs...)
+}
+
+// DocumentCount asserts that exactly n documents in dbName.collName match filter
+func DocumentCount(t TestingT, conn *mongotest.TestConnection, dbName, collName string, filter interface{}, n int64, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	coll := collection(conn, dbName, collName)
+	count, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not count documents in %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	if count == n {
+		return true
+	}
+	message := fmt.Sprintf("Expected %d documents in %s.%s to match %s, but %d did",
+		n, dbName, collName, formatValue(filter), count)
+	if count < n {
+		message += nearestDocuments(ctx, coll, filter)
+	}
+	return fail(t, message, msgAndArgs...)
+}
+
+// FieldEquals asserts that the document in dbName.collName matching filter has expected at the
+// dotted path field. Numbers are compared by value, as mongo compares them (e.g. int32(1) equals
+// 1.0) - every other type must match exactly.
+func FieldEquals(t TestingT, conn *mongotest.TestConnection, dbName, collName string, filter interface{}, field string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	coll := collection(conn, dbName, collName)
+	doc, err := coll.FindOne(ctx, filter).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return fail(t, fmt.Sprintf("No document in %s.%s matches %s%s",
+			dbName, collName, formatValue(filter), nearestDocuments(ctx, coll, filter)), msgAndArgs...)
+	} else if err != nil {
+		return fail(t, fmt.Sprintf("Could not query %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	actual, err := doc.LookupErr(strings.Split(field, ".")...)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Field '%s' is missing from %s", field, formatValue(doc)), msgAndArgs...)
+	}
+	expectedValue, err := toRawValue(expected)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not encode the expected value %v: %v", expected, err), msgAndArgs...)
+	}
+	if bsonvalue.Equal(expectedValue, actual, false) {
+		return true
+	}
+	return fail(t, fmt.Sprintf("Field '%s' is not equal:\nexpected: %s\nactual  : %s\nin document: %s",
+		field, formatRawValue(expectedValue), formatRawValue(actual), formatValue(doc)), msgAndArgs...)
+}
+
+// IndexExists asserts that dbName.collName has an index on keys (e.g. bson.D{{"email", 1}}),
+// and that the index is unique if unique is set
+func IndexExists(t TestingT, conn *mongotest.TestConnection, dbName, collName string, keys bson.D, unique bool, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	cursor, err := collection(conn, dbName, collName).Indexes().List(ctx)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not list the indexes on %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	var indexes []bson.Raw
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return fail(t, fmt.Sprintf("Could not list the indexes on %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	want, err := bson.Marshal(keys)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not encode the index keys %v: %v", keys, err), msgAndArgs...)
+	}
+	wantValue := bson.RawValue{Type: bsontype.EmbeddedDocument, Value: want}
+	found := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		found = append(found, formatValue(index))
+		key, err := index.LookupErr("key")
+		if err != nil || !bsonvalue.Equal(wantValue, key, false) {
+			continue
+		}
+		isUnique, _ := index.Lookup("unique").BooleanOK()
+		if unique && !isUnique {
+			return fail(t, fmt.Sprintf("The index on %s in %s.%s is not unique: %s",
+				formatValue(keys), dbName, collName, formatValue(index)), msgAndArgs...)
+		}
+		return true
+	}
+	return fail(t, fmt.Sprintf("No index on %s exists in %s.%s. Indexes:\n  %s",
+		formatValue(keys), dbName, collName, strings.Join(found, "\n  ")), msgAndArgs...)
+}
+
+// CollectionEmpty asserts that dbName.collName holds no documents
+func CollectionEmpty(t TestingT, conn *mongotest.TestConnection, dbName, collName string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	coll := collection(conn, dbName, collName)
+	count, err := coll.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not count documents in %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	if count == 0 {
+		return true
+	}
+	return fail(t, fmt.Sprintf("Expected %s.%s to be empty, but it holds %d documents%s",
+		dbName, collName, count, sampleDocuments(ctx, coll)), msgAndArgs...)
+}
+
+// ValidatorMatches asserts that the validator on dbName.collName equals expected (e.g.
+// bson.D{{"$jsonSchema", ...}}). Documents are compared in order, as mongo stores them.
+func ValidatorMatches(t TestingT, conn *mongotest.TestConnection, dbName, collName string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database(dbName)
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collName}})
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not read the options of %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	if len(specs) == 0 {
+		return fail(t, fmt.Sprintf("Collection %s.%s does not exist", dbName, collName), msgAndArgs...)
+	}
+	expectedValue, err := toRawValue(expected)
+	if err != nil {
+		return fail(t, fmt.Sprintf("Could not encode the expected validator %v: %v", expected, err), msgAndArgs...)
+	}
+	actual, err := specs[0].Options.LookupErr("validator")
+	if err != nil {
+		return fail(t, fmt.Sprintf("Collection %s.%s has no validator - expected %s",
+			dbName, collName, formatRawValue(expectedValue)), msgAndArgs...)
+	}
+	if bsonvalue.Equal(expectedValue, actual, false) {
+		return true
+	}
+	return fail(t, fmt.Sprintf("The validator on %s.%s is not equal:\nexpected: %s\nactual  : %s",
+		dbName, collName, formatRawValue(expectedValue), formatRawValue(actual)), msgAndArgs...)
+}
+
+// Eventually asserts that a document matching filter appears in dbName.collName within timeout.
+// This is useful when documents are written asynchronously (e.g. by a worker or change stream).
+func Eventually(t TestingT, conn *mongotest.TestConnection, dbName, collName string, filter interface{}, timeout time.Duration, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	ctx := context.Background()
+	coll := collection(conn, dbName, collName)
+	deadline := time.Now().Add(timeout)
+	var err error
+	for {
+		err = coll.FindOne(ctx, filter).Err()
+		if err == nil {
+			return true
+		}
+		if err != mongo.ErrNoDocuments || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(eventuallyTick)
+	}
+	if err != mongo.ErrNoDocuments {
+		return fail(t, fmt.Sprintf("Could not query %s.%s: %v", dbName, collName, err), msgAndArgs...)
+	}
+	return fail(t, fmt.Sprintf("No document in %s.%s matched %s within %s%s",
+		dbName, collName, formatValue(filter), timeout, nearestDocuments(ctx, coll, filter)), msgAndArgs...)
+}
+
+func collection(conn *mongotest.TestConnection, dbName, collName string) *mongo.Collection {
+	return conn.MongoDriverClient().Database(dbName).Collection(collName)
+}
+
+// fail reports message, followed by the caller's message (if any), through t
+func fail(t TestingT, message string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(tHelper); ok {
+		h.Helper()
+	}
+	if extra := messageFromMsgAndArgs(msgAndArgs...); len(extra) != 0 {
+		message += "\nMessages: " + extra
+	}
+	t.Errorf("%s", message)
+	return false
+}
+
+// messageFromMsgAndArgs formats the optional message passed to an assertion, as testify does
+func messageFromMsgAndArgs(msgAndArgs ...interface{}) string {
+	if len(msgAndArgs) == 0 {
+		return ""
+	}
+	if len(msgAndArgs) == 1 {
+		if msg, ok := msgAndArgs[0].(string); ok {
+			return msg
+		}
+		return fmt.Sprintf("%+v", msgAndArgs[0])
+	}
+	if format, ok := msgAndArgs[0].(string); ok {
+		return fmt.Sprintf(format, msgAndArgs[1:]...)
+	}
+	return fmt.Sprint(msgAndArgs...)
+}
+
+// nearestDocuments describes the documents matching the most top-level clauses of filter,
+// along with the clauses each of them fails
+func nearestDocuments(ctx context.Context, coll *mongo.Collection, filter interface{}) string {
+	clauses, err := filterClauses(filter)
+	if err != nil || len(clauses) == 0 {
+		return sampleDocuments(ctx, coll)
+	}
+	type candidate struct {
+		doc     bson.Raw
+		matched map[int]bool
+	}
+	candidates := map[string]*candidate{}
+	for i, clause := range clauses {
+		cursor, err := coll.Find(ctx, bson.D{clause}, options.Find().SetLimit(nearestScanLimit))
+		if err != nil {
+			// e.g. a clause which is only valid alongside the others
+			continue
+		}
+		for cursor.Next(ctx) {
+			doc := append(bson.Raw{}, cursor.Current...)
+			key := doc.Lookup("_id").String()
+			if candidates[key] == nil {
+				candidates[key] = &candidate{doc: doc, matched: map[int]bool{}}
+			}
+			candidates[key].matched[i] = true
+		}
+		cursor.Close(ctx)
+	}
+	if len(candidates) == 0 {
+		return "\nNo document matches any part of the filter." + sampleDocuments(ctx, coll)
+	}
+	nearest := make([]*candidate, 0, len(candidates))
+	for _, c := range candidates {
+		nearest = append(nearest, c)
+	}
+	sort.Slice(nearest, func(i, j int) bool {
+		if len(nearest[i].matched) != len(nearest[j].matched) {
+			return len(nearest[i].matched) > len(nearest[j].matched)
+		}
+		return bytes.Compare(nearest[i].doc, nearest[j].doc) < 0
+	})
+	if len(nearest) > nearestDocumentCount {
+		nearest = nearest[:nearestDocumentCount]
+	}
+	var sb strings.Builder
+	sb.WriteString("\nNearest documents:")
+	for _, c := range nearest {
+		var failed []string
+		for i, clause := range clauses {
+			if !c.matched[i] {
+				failed = append(failed, formatValue(bson.D{clause}))
+			}
+		}
+		fmt.Fprintf(&sb, "\n  %s\n    does not match: %s", formatValue(c.doc), strings.Join(failed, ", "))
+	}
+	return sb.String()
+}
+
+// sampleDocuments describes the first few documents in coll
+func sampleDocuments(ctx context.Context, coll *mongo.Collection) string {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetLimit(nearestDocumentCount))
+	if err != nil {
+		return ""
+	}
+	defer cursor.Close(ctx)
+	var sb strings.Builder
+	for cursor.Next(ctx) {
+		if sb.Len() == 0 {
+			sb.WriteString("\nFirst documents in the collection:")
+		}
+		fmt.Fprintf(&sb, "\n  %s", formatValue(cursor.Current))
+	}
+	if sb.Len() == 0 {
+		return "\nThe collection is empty."
+	}
+	return sb.String()
+}
+
+// filterClauses splits filter into its top-level clauses
+func filterClauses(filter interface{}) (bson.D, error) {
+	raw, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var clauses bson.D
+	err = bson.Unmarshal(raw, &clauses)
+	return clauses, err
+}
+
+// toRawValue encodes value as BSON
+func toRawValue(value interface{}) (bson.RawValue, error) {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return bson.RawValue{}, err
+	}
+	return bson.Raw(raw).LookupErr("v")
+}
+
+// formatValue writes value as Relaxed Extended JSON for failure messages
+func formatValue(value interface{}) string {
+	switch typed := value.(type) {
+	case bson.Raw:
+		return formatRawValue(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: typed})
+	case bson.RawValue:
+		return formatRawValue(typed)
+	}
+	rawValue, err := toRawValue(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return formatRawValue(rawValue)
+}
+
+func formatRawValue(value bson.RawValue) string {
+	out, err := bsonvalue.ExtJSON(value, false)
+	if err != nil {
+		return value.String()
+	}
+	return out
+}
+
+// Assertions binds the assertions to a test and connection
+type Assertions struct {
+	t    TestingT
+	conn *mongotest.TestConnection
+}
+
+// New returns Assertions which report failures through t and query conn
+func New(t TestingT, conn *mongotest.TestConnection) *Assertions {
+	return &Assertions{t: t, conn: conn}
+}
+
+// DocumentExists asserts that at least one document in dbName.collName matches filter
+func (a *Assertions) DocumentExists(dbName, collName string, filter interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return DocumentExists(a.t, a.conn, dbName, collName, filter, msgAndArgs...)
+}
+
+// DocumentCount asserts that exactly n documents in dbName.collName match filter
+func (a *Assertions) DocumentCount(dbName, collName string, filter interface{}, n int64, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return DocumentCount(a.t, a.conn, dbName, collName, filter, n, msgAndArgs...)
+}
+
+// FieldEquals asserts that the document in dbName.collName matching filter has expected at field
+func (a *Assertions) FieldEquals(dbName, collName string, filter interface{}, field string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return FieldEquals(a.t, a.conn, dbName, collName, filter, field, expected, msgAndArgs...)
+}
+
+// IndexExists asserts that dbName.collName has an index on keys, which is unique if unique is set
+func (a *Assertions) IndexExists(dbName, collName string, keys bson.D, unique bool, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return IndexExists(a.t, a.conn, dbName, collName, keys, unique, msgAndArgs...)
+}
+
+// CollectionEmpty asserts that dbName.collName holds no documents
+func (a *Assertions) CollectionEmpty(dbName, collName string, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return CollectionEmpty(a.t, a.conn, dbName, collName, msgAndArgs...)
+}
+
+// ValidatorMatches asserts that the validator on dbName.collName equals expected
+func (a *Assertions) ValidatorMatches(dbName, collName string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return ValidatorMatches(a.t, a.conn, dbName, collName, expected, msgAndArgs...)
+}
+
+// Eventually asserts that a document matching filter appears in dbName.collName within timeout
+func (a *Assertions) Eventually(dbName, collName string, filter interface{}, timeout time.Duration, msgAndArgs ...interface{}) bool {
+	if h, ok := a.t.(tHelper); ok {
+		h.Helper()
+	}
+	return Eventually(a.t, a.conn, dbName, collName, filter, timeout, msgAndArgs...)
+}
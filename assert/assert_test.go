@@ -0,0 +1,83 @@
+package assert
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	testifyassert "github.com/stretchr/testify/assert"
+	"github.com/tophergopher/mongotest"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordingT captures the failures reported by assertions which are expected to fail
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestFormatting(t *testing.T) {
+	is := testifyassert.New(t)
+	clauses, err := filterClauses(bson.M{"status": "paid"})
+	is.NoError(err)
+	is.Equal(bson.D{{Key: "status", Value: "paid"}}, clauses)
+	is.Equal(`{"n":{"$gt":1}}`, formatValue(bson.D{{Key: "n", Value: bson.D{{Key: "$gt", Value: 1}}}}))
+
+	is.Equal("", messageFromMsgAndArgs())
+	format := "order %d"
+	is.Equal("order 7", messageFromMsgAndArgs(format, 7))
+	recorder := &recordingT{}
+	is.False(fail(recorder, "Failed", format, 7))
+	is.Equal([]string{"Failed\nMessages: order 7"}, recorder.errors)
+}
+
+func TestAssertions(t *testing.T) {
+	is := testifyassert.New(t)
+	conn := mongotest.NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("shop")
+	validator := bson.D{{Key: "$jsonSchema", Value: bson.D{{Key: "required", Value: bson.A{"status"}}}}}
+	is.NoError(db.CreateCollection(ctx, "orders", options.CreateCollection().SetValidator(validator)))
+	_, err := db.Collection("orders").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "status", Value: "paid"}, {Key: "total", Value: 42}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "status", Value: "open"}, {Key: "total", Value: 10}},
+	})
+	is.NoError(err)
+	_, err = db.Collection("orders").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	is.NoError(err)
+
+	dbAssert := New(t, conn)
+	dbAssert.DocumentExists("shop", "orders", bson.M{"status": "paid"})
+	dbAssert.DocumentCount("shop", "orders", bson.M{}, 2)
+	dbAssert.FieldEquals("shop", "orders", bson.M{"_id": 1}, "total", int64(42))
+	dbAssert.IndexExists("shop", "orders", bson.D{{Key: "status", Value: 1}}, true)
+	dbAssert.CollectionEmpty("shop", "refunds")
+	dbAssert.ValidatorMatches("shop", "orders", validator)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = db.Collection("orders").InsertOne(ctx, bson.D{{Key: "_id", Value: 3}, {Key: "status", Value: "late"}})
+	}()
+	dbAssert.Eventually("shop", "orders", bson.M{"status": "late"}, 5*time.Second)
+
+	recorder := &recordingT{}
+	is.False(DocumentExists(recorder, conn, "shop", "orders", bson.D{{Key: "status", Value: "paid"}, {Key: "total", Value: 43}}))
+	if is.Len(recorder.errors, 1) {
+		is.Contains(recorder.errors[0], "Nearest documents:")
+		is.Contains(recorder.errors[0], `{"_id":1,"status":"paid","total":42}`)
+		is.Contains(recorder.errors[0], `does not match: {"total":43}`)
+	}
+	is.False(FieldEquals(recorder, conn, "shop", "orders", bson.M{"_id": 2}, "status", "paid"))
+	is.False(IndexExists(recorder, conn, "shop", "orders", bson.D{{Key: "total", Value: 1}}, false))
+	is.False(CollectionEmpty(recorder, conn, "shop", "orders"))
+	is.False(Eventually(recorder, conn, "shop", "orders", bson.M{"status": "never"}, 300*time.Millisecond))
+	is.Len(recorder.errors, 5)
+}
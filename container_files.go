@@ -0,0 +1,254 @@
+package mongotest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// CopyToContainer copies the file or directory found at hostPath on the host to containerPath
+// inside the mongo container. Directories are copied recursively and file permissions are
+// preserved. Any missing parent directories of containerPath are created inside the container.
+// containerPath must be an absolute path.
+func (tc *TestConnection) CopyToContainer(hostPath, containerPath string) error {
+	archiveName, err := containerArchiveName(containerPath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err = tarHostPath(tw, hostPath, archiveName); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("could not close tar archive in preparation for copying to container: %w", err)
+	}
+	return tc.copyArchiveToContainer(&buf)
+}
+
+// CopyReaderToContainer copies everything that can be read from r into a file at containerPath
+// inside the mongo container, with the provided permissions. Any missing parent directories
+// of containerPath are created inside the container. containerPath must be an absolute path.
+func (tc *TestConnection) CopyReaderToContainer(r io.Reader, containerPath string, mode os.FileMode) error {
+	archiveName, err := containerArchiveName(containerPath)
+	if err != nil {
+		return err
+	}
+	// The size needs to be known up-front for the tar header, so the reader is buffered
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read contents to copy to container: %w", err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archiveName,
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(contents)),
+	}
+	if err = tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("could not write tar header to archive when copying file to container: %w", err)
+	}
+	if _, err = tw.Write(contents); err != nil {
+		return fmt.Errorf("could not copy contents into a tar archive in preparation for copying to container: %w", err)
+	}
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("could not close tar archive in preparation for copying to container: %w", err)
+	}
+	return tc.copyArchiveToContainer(&buf)
+}
+
+// CopyFromContainer returns a reader over the contents of the file found at containerPath
+// inside the mongo container. The caller is expected to close the returned reader.
+// ErrContainerPathIsDirectory is returned if containerPath is a directory - use
+// CopyDirFromContainer for directories instead.
+func (tc *TestConnection) CopyFromContainer(containerPath string) (io.ReadCloser, error) {
+	rc, stat, err := tc.dockerClient.CopyFromContainer(context.Background(), tc.mongoContainerID, containerPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not copy '%s' from container %s: %w", containerPath, tc.mongoContainerID, err)
+	}
+	if stat.Mode.IsDir() {
+		_ = rc.Close()
+		return nil, ErrContainerPathIsDirectory
+	}
+	tr := tar.NewReader(rc)
+	if _, err = tr.Next(); err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("could not read tar archive copied from container: %w", err)
+	}
+	return &tarEntryReader{Reader: tr, closer: rc}, nil
+}
+
+// CopyDirFromContainer copies the contents of the directory found at containerPath inside the
+// mongo container into hostDir on the host. hostDir is created if it does not already exist.
+// File permissions are preserved. ErrContainerPathIsNotDirectory is returned if containerPath is
+// not a directory - use CopyFromContainer for single files instead.
+func (tc *TestConnection) CopyDirFromContainer(containerPath, hostDir string) error {
+	rc, stat, err := tc.dockerClient.CopyFromContainer(context.Background(), tc.mongoContainerID, containerPath)
+	if err != nil {
+		return fmt.Errorf("could not copy '%s' from container %s: %w", containerPath, tc.mongoContainerID, err)
+	}
+	defer rc.Close()
+	if !stat.Mode.IsDir() {
+		return ErrContainerPathIsNotDirectory
+	}
+	// Docker roots the archive at the base name of the requested path - strip it so the
+	// contents land directly in hostDir
+	return untarToHostDir(tar.NewReader(rc), path.Base(containerPath), hostDir)
+}
+
+// createContainerDir creates a directory (and any missing parents) inside the container, owned
+// by the provided user and group. It can be called before the container is started.
+func (tc *TestConnection) createContainerDir(containerPath string, uid, gid int, mode os.FileMode) error {
+	archiveName, err := containerArchiveName(containerPath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     archiveName + "/",
+		Mode:     int64(mode.Perm()),
+		Uid:      uid,
+		Gid:      gid,
+	}
+	if err = tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("could not write tar header to archive when creating container directory: %w", err)
+	}
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("could not close tar archive in preparation for copying to container: %w", err)
+	}
+	return tc.copyArchiveToContainer(&buf)
+}
+
+// copyArchiveToContainer extracts the tar archive read from r at the root of the container
+func (tc *TestConnection) copyArchiveToContainer(r io.Reader) error {
+	if err := tc.dockerClient.CopyToContainer(context.Background(), tc.mongoContainerID,
+		"/", r, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("could not copy file from host to container: %w", err)
+	}
+	return nil
+}
+
+// tarEntryReader reads a single entry from a tar archive and closes the underlying stream
+type tarEntryReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (ter *tarEntryReader) Close() error {
+	return ter.closer.Close()
+}
+
+// containerArchiveName converts an absolute container path into the name it should have in a
+// tar archive extracted at the container root
+func containerArchiveName(containerPath string) (string, error) {
+	if !path.IsAbs(containerPath) {
+		return "", fmt.Errorf("container path '%s' must be absolute", containerPath)
+	}
+	name := strings.TrimPrefix(path.Clean(containerPath), "/")
+	if len(name) == 0 {
+		return "", fmt.Errorf("container path '%s' must not be the root directory", containerPath)
+	}
+	return name, nil
+}
+
+// tarHostPath writes the file or directory at hostPath into tw under archiveName
+func tarHostPath(tw *tar.Writer, hostPath, archiveName string) error {
+	return filepath.Walk(hostPath, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("could not walk '%s' when copying to container: %w", fpath, err)
+		}
+		relPath, err := filepath.Rel(hostPath, fpath)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("could not build tar header for '%s': %w", fpath, err)
+		}
+		header.Name = path.Join(archiveName, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("could not write tar header to archive when copying file to container: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err = io.Copy(tw, f); err != nil {
+			return fmt.Errorf("could not copy '%s' into a tar archive in preparation for copying to container: %w", fpath, err)
+		}
+		return nil
+	})
+}
+
+// untarToHostDir extracts every entry below stripPrefix in tr into hostDir
+func untarToHostDir(tr *tar.Reader, stripPrefix, hostDir string) error {
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return err
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read tar archive copied from container: %w", err)
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if name == stripPrefix {
+			// The root entry - its contents go straight into hostDir
+			continue
+		}
+		relPath := strings.TrimPrefix(strings.TrimPrefix(name, stripPrefix+"/"), "/")
+		if len(relPath) == 0 {
+			continue
+		}
+		target := filepath.Join(hostDir, filepath.FromSlash(relPath))
+		// Guard against archive entries escaping the destination directory
+		if !strings.HasPrefix(target, filepath.Clean(hostDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry '%s' would be written outside of '%s'", header.Name, hostDir)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return err
+			} else if closeErr != nil {
+				return closeErr
+			}
+		default:
+			// Symlinks, devices and the like aren't needed for fixtures or logs
+			continue
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package mongotest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// defaultFailureLogLines is the number of mongod log lines dumped when a test using
+// NewTestConnectionT fails
+const defaultFailureLogLines = 50
+
+// readinessLogLines is the number of mongod log lines attached to readiness errors
+const readinessLogLines = 20
+
+// LogEntry is a single line of output from the mongod container.
+// Starting with mongo 4.4, mongod logs structured JSON, in which case all fields are populated.
+// For older versions (or any line which isn't JSON), only Raw and Message are populated.
+type LogEntry struct {
+	Timestamp  time.Time
+	Severity   string
+	Component  string
+	ID         int64
+	Context    string
+	Message    string
+	Attributes map[string]interface{}
+	// Raw is the line exactly as mongod wrote it
+	Raw string
+}
+
+// String returns the line exactly as mongod wrote it
+func (le LogEntry) String() string {
+	return le.Raw
+}
+
+// structuredLogLine mirrors the structured log format used by mongod 4.4+
+// https://www.mongodb.com/docs/manual/reference/log-messages/#structured-logging
+type structuredLogLine struct {
+	T struct {
+		Date string `json:"$date"`
+	} `json:"t"`
+	S    string                 `json:"s"`
+	C    string                 `json:"c"`
+	ID   int64                  `json:"id"`
+	Ctx  string                 `json:"ctx"`
+	Msg  string                 `json:"msg"`
+	Attr map[string]interface{} `json:"attr"`
+}
+
+// Logs returns every line logged by the mongo container since the provided time.
+// Pass a zero time.Time to get every line since the container started.
+func (tc *TestConnection) Logs(ctx context.Context, since time.Time) ([]LogEntry, error) {
+	opts := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	}
+	if !since.IsZero() {
+		opts.Since = since.Format(time.RFC3339Nano)
+	}
+	return tc.containerLogs(ctx, opts)
+}
+
+// tailLogs returns the last n lines logged by the mongo container
+func (tc *TestConnection) tailLogs(ctx context.Context, n int) ([]LogEntry, error) {
+	return tc.containerLogs(ctx, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(n),
+	})
+}
+
+func (tc *TestConnection) containerLogs(ctx context.Context, opts types.ContainerLogsOptions) ([]LogEntry, error) {
+	if len(tc.mongoContainerID) == 0 {
+		return nil, fmt.Errorf("could not read container logs: no mongo container is running")
+	}
+	rc, err := tc.dockerClient.ContainerLogs(ctx, tc.mongoContainerID, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not read logs for container %s: %w", tc.mongoContainerID, err)
+	}
+	defer rc.Close()
+	// The container is created with a TTY, so the log stream is raw rather than multiplexed
+	entries := []LogEntry{}
+	scanner := bufio.NewScanner(rc)
+	// Structured lines can be long (e.g. slow query logs)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		entries = append(entries, parseLogLine(line))
+	}
+	if err = scanner.Err(); err != nil {
+		return entries, fmt.Errorf("could not read logs for container %s: %w", tc.mongoContainerID, err)
+	}
+	return entries, nil
+}
+
+// parseLogLine parses a structured mongod log line, falling back to a plain text entry
+func parseLogLine(line string) LogEntry {
+	entry := LogEntry{
+		Raw:     line,
+		Message: line,
+	}
+	if !strings.HasPrefix(line, "{") {
+		return entry
+	}
+	var structured structuredLogLine
+	if err := json.Unmarshal([]byte(line), &structured); err != nil {
+		return entry
+	}
+	if ts, err := time.Parse(time.RFC3339, structured.T.Date); err == nil {
+		entry.Timestamp = ts
+	}
+	entry.Severity = structured.S
+	entry.Component = structured.C
+	entry.ID = structured.ID
+	entry.Context = structured.Ctx
+	entry.Message = structured.Msg
+	entry.Attributes = structured.Attr
+	return entry
+}
+
+// recentLogLines returns the last few lines logged by mongod, so they can be attached to an error.
+// If no logs could be fetched, nil is returned.
+func (tc *TestConnection) recentLogLines() []string {
+	if len(tc.mongoContainerID) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries, err := tc.tailLogs(ctx, readinessLogLines)
+	if err != nil {
+		return nil
+	}
+	return logEntryLines(entries)
+}
+
+// logEntryLines returns the raw lines of the provided entries
+func logEntryLines(entries []LogEntry) []string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		lines = append(lines, entry.Raw)
+	}
+	return lines
+}
+
+// NewTestConnectionT spawns a mongo container for the duration of the test tb.
+// The test is failed immediately if the container can't be started. Logging goes to the
+// test log unless WithLogger is provided. When the test finishes, the container is killed - if
+// the test failed, the last mongod log lines are written to the test log first
+// (see WithFailureLogLines).
+func NewTestConnectionT(tb testing.TB, opts ...Option) *TestConnection {
+	tb.Helper()
+	opts = append([]Option{WithLogger(NewTestingLogger(tb))}, opts...)
+	spinupDockerContainer := true
+	tc, err := NewTestConnection(spinupDockerContainer, opts...)
+	if err != nil {
+		tb.Fatalf("Could not start the mongo test container: %v", err)
+	}
+	tb.Cleanup(func() {
+		if tb.Failed() {
+			tc.dumpLogsToTest(tb)
+		}
+		_ = tc.KillMongoContainer()
+	})
+	return tc
+}
+
+// dumpLogsToTest writes the last lines logged by mongod to the test log
+func (tc *TestConnection) dumpLogsToTest(tb testing.TB) {
+	tb.Helper()
+	numLines := tc.failureLogLines
+	if numLines == 0 {
+		numLines = defaultFailureLogLines
+	}
+	if numLines < 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entries, err := tc.tailLogs(ctx, numLines)
+	if err != nil {
+		tb.Logf("Could not fetch mongod logs for failed test: %v", err)
+		return
+	}
+	lines := logEntryLines(entries)
+	tb.Logf("Last %d mongod log lines from container %s:\n%s", len(lines), tc.mongoContainerID, strings.Join(lines, "\n"))
+}
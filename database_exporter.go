@@ -1,15 +1,23 @@
 package mongotest
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
-	"github.com/mongodb/mongo-tools/common/log"
 	"github.com/mongodb/mongo-tools/common/util"
 	"github.com/mongodb/mongo-tools/mongoexport"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Existing entrypoint - NewTestConnection(spinupDockerContainer bool) (*TestConnection, error)
@@ -39,18 +47,28 @@ import (
 type DatabaseExporter struct {
 	baseOpts     mongoexport.Options
 	compressToGZ bool
+	flatten      bool
+	transform    *Transform
 	filepath     string
 	// exporter     *mongoexport.MongoExport
 	testConn *TestConnection
+	// err holds any error encountered while building the exporter. It is returned
+	// once the export is run.
+	err error
 }
 
 // DatabaseExporter returns an object which can be used to export a DB
+// Any error encountered while setting up the exporter is returned once the export is run
+// (e.g. by ToJSONFile).
 // TODO: Move to easymongo? Some of these seem very close to Query{}
 func (testConn *TestConnection) DatabaseExporter(dbName, collectionName string) *DatabaseExporter {
 	rawArgs := []string{"-d", dbName, "-c", collectionName, testConn.mongoURI}
 	opts, err := mongoexport.ParseOptions(rawArgs, "mongotest", "master")
 	if err != nil {
-		panic(fmt.Sprintf("ParseOptions failed: %v", err))
+		return &DatabaseExporter{
+			testConn: testConn,
+			err:      testConn.newError(PhaseExport, fmt.Errorf("could not parse mongoexport options: %w", err)),
+		}
 	}
 
 	return &DatabaseExporter{
@@ -61,99 +79,593 @@ func (testConn *TestConnection) DatabaseExporter(dbName, collectionName string)
 }
 
 func (de *DatabaseExporter) Skip(i int) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.Skip = int64(i)
 	return de
 }
 func (de *DatabaseExporter) Limit(i int) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.Limit = int64(i)
 	return de
 }
 func (de *DatabaseExporter) Query(q string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.Query = q
 	return de
 }
 func (de *DatabaseExporter) Sort(s string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.Sort = s
 	return de
 }
+
+// Filepath sets the file written by ToFile, ToJSONFile and CSVFile. It is created if it does
+// not exist and truncated if it does.
 func (de *DatabaseExporter) Filepath(f string) *DatabaseExporter {
 	de.filepath = f
 	return de
 }
 func (de *DatabaseExporter) Database(d string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.DB = d
 	return de
 }
 func (de *DatabaseExporter) Collection(c string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
 	de.baseOpts.Collection = c
 	return de
 }
 
-// TODO: UsingStringBuilder
-func (de *DatabaseExporter) UsingStringBuilder() {
-	// Some sort of byte buffer method here - initialize an io.Writer?
-	panic(ErrNotImplemented)
+// JSON exports one Extended JSON document per line. This is the default.
+func (de *DatabaseExporter) JSON() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.Type = "json"
+	de.baseOpts.JSONArray = false
+	return de
+}
+
+// JSONArray exports a single JSON array of Extended JSON documents
+func (de *DatabaseExporter) JSONArray() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.Type = "json"
+	de.baseOpts.JSONArray = true
+	return de
+}
+
+// CSV exports CSV with a header line
+func (de *DatabaseExporter) CSV() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.Type = "csv"
+	return de
+}
+
+// Fields sets the fields written to CSV output, in column order. Dotted paths select fields in
+// embedded documents (e.g. "address.city") and array elements (e.g. "tags.0").
+func (de *DatabaseExporter) Fields(fields ...string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.Fields = strings.Join(fields, ",")
+	return de
+}
+
+// FieldFile reads the fields written to CSV output from a file with one field per line
+func (de *DatabaseExporter) FieldFile(fpath string) *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.FieldFile = fpath
+	return de
+}
+
+// FlattenNested writes embedded documents and arrays in CSV output as one column per nested
+// value, using dotted paths (e.g. "address.city" and "tags.0"). The columns are found by
+// scanning the documents being exported. Without Fields, every field is exported - _id first,
+// then sorted by path (array indexes numerically). With Fields, any field holding a nested value
+// is expanded into its columns. Use DatabaseImporter.UseArrayIndexFields to read the CSV back in.
+func (de *DatabaseExporter) FlattenNested() *DatabaseExporter {
+	de.flatten = true
+	return de
+}
+
+// Pretty indents JSON output
+func (de *DatabaseExporter) Pretty() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.Pretty = true
+	return de
 }
 
-// TODO: Bytes
+// CanonicalJSON exports Canonical Extended JSON, which preserves every BSON type
+func (de *DatabaseExporter) CanonicalJSON() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.JSONFormat = mongoexport.Canonical
+	return de
+}
+
+// RelaxedJSON exports Relaxed Extended JSON, which is easier to read (e.g. numbers are plain JSON numbers)
+func (de *DatabaseExporter) RelaxedJSON() *DatabaseExporter {
+	if de.err != nil {
+		return de
+	}
+	de.baseOpts.JSONFormat = mongoexport.Relaxed
+	return de
+}
+
+// ToWriter exports the documents to w in the configured format and returns the number of
+// documents exported
+func (de *DatabaseExporter) ToWriter(w io.Writer) (numDocs int64, err error) {
+	if de.err != nil {
+		return 0, de.err
+	}
+	return de.export(de.baseOpts, w)
+}
+
+// UsingStringBuilder exports the documents into sb and returns the number of documents exported
+func (de *DatabaseExporter) UsingStringBuilder(sb *strings.Builder) (numDocs int64, err error) {
+	return de.ToWriter(sb)
+}
+
+// Bytes exports the documents and returns the output
 func (de *DatabaseExporter) Bytes() ([]byte, error) {
-	return nil, ErrNotImplemented
+	var buf bytes.Buffer
+	if _, err := de.ToWriter(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-// TODO: String
+// String exports the documents and returns the output
 func (de *DatabaseExporter) String() (string, error) {
-	return "", ErrNotImplemented
+	var sb strings.Builder
+	if _, err := de.UsingStringBuilder(&sb); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Iterate streams the exported documents, decoding each one as it is read. JSON and JSON array
+// exports yield the documents themselves, while CSV exports yield each row keyed by the header.
+// The caller is expected to close the iterator.
+func (de *DatabaseExporter) Iterate() (*ExportIterator, error) {
+	if de.err != nil {
+		return nil, de.err
+	}
+	// Documents are decoded one line at a time, so the output is always line-delimited
+	opts := de.baseOpts
+	outputOpts := *opts.OutputFormatOptions
+	opts.OutputFormatOptions = &outputOpts
+	opts.Pretty = false
+	opts.JSONArray = false
+	opts.NoHeaderLine = false
+
+	pr, pw := io.Pipe()
+	it := &ExportIterator{
+		pr:   pr,
+		done: make(chan struct{}),
+	}
+	if opts.Type == "csv" {
+		it.csvReader = csv.NewReader(pr)
+	} else {
+		it.scanner = bufio.NewScanner(pr)
+		it.scanner.Buffer(make([]byte, 0, 64*1024), maxExportLineSize)
+	}
+	go func() {
+		defer close(it.done)
+		_, err := de.export(opts, pw)
+		pw.CloseWithError(err)
+	}()
+	return it, nil
 }
 
-// write performs the write to the file and returns the file
-// The caller is expected to close this file.
-func (de *DatabaseExporter) write() (*os.File, error) {
-	exporter, err := mongoexport.New(de.baseOpts)
+// maxExportLineSize is the largest line Iterate will decode - comfortably above the 16MB BSON
+// document limit once it has been converted to Extended JSON
+const maxExportLineSize = 64 * 1024 * 1024
+
+// ExportIterator streams documents from a running export. It is used like a mongo.Cursor:
+//
+//	it, err := conn.DatabaseExporter("db", "coll").Iterate()
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		doc := it.Document()
+//	}
+//	err = it.Err()
+type ExportIterator struct {
+	pr        *io.PipeReader
+	done      chan struct{}
+	scanner   *bufio.Scanner
+	csvReader *csv.Reader
+	header    []string
+	doc       bson.D
+	err       error
+}
+
+// Next decodes the next document, returning false once the export is exhausted or fails
+func (it *ExportIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.csvReader != nil {
+		return it.nextCSV()
+	}
+	for it.scanner.Scan() {
+		line := bytes.TrimSpace(it.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			it.err = fmt.Errorf("could not decode exported document: %w", err)
+			return false
+		}
+		it.doc = doc
+		return true
+	}
+	it.err = it.scanner.Err()
+	return false
+}
+
+// nextCSV decodes the next CSV row, reading the header first if needed
+func (it *ExportIterator) nextCSV() bool {
+	if it.header == nil {
+		header, err := it.csvReader.Read()
+		if err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			return false
+		}
+		it.header = header
+	}
+	row, err := it.csvReader.Read()
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		return false
+	}
+	doc := make(bson.D, 0, len(row))
+	for i, value := range row {
+		if i < len(it.header) {
+			doc = append(doc, bson.E{Key: it.header[i], Value: value})
+		}
+	}
+	it.doc = doc
+	return true
+}
+
+// Document returns the document decoded by the last call to Next
+func (it *ExportIterator) Document() bson.D {
+	return it.doc
+}
+
+// Err returns the error which stopped iteration, if any
+func (it *ExportIterator) Err() error {
+	return it.err
+}
+
+// Close stops the export (if it is still running) and waits for it to finish
+func (it *ExportIterator) Close() error {
+	err := it.pr.Close()
+	<-it.done
+	return err
+}
+
+// export runs mongoexport using opts, writing the output to w
+func (de *DatabaseExporter) export(opts mongoexport.Options, w io.Writer) (numDocs int64, err error) {
+	if de.transform != nil {
+		return de.exportTransformed(opts, w)
+	}
+	if de.flatten && opts.Type == "csv" {
+		if opts, err = de.flattenedFields(opts); err != nil {
+			return 0, err
+		}
+	}
+	exporter, err := mongoexport.New(opts)
 	if err != nil {
-		log.Logvf(log.Always, "%v", err)
+		fields := Fields{"err": err}
 		if se, ok := err.(util.SetupError); ok && se.Message != "" {
-			log.Logv(log.Always, se.Message)
+			fields["setupMessage"] = se.Message
 		}
-		return nil, err
+		de.testConn.logger.Error("Could not initialize mongoexport", fields)
+		return 0, de.testConn.newError(PhaseExport, err)
 	}
 	defer exporter.Close()
 
-	var writer io.Writer
+	numDocs, err = exporter.Export(w)
+	if err != nil {
+		de.testConn.logger.Error("Could not export documents", Fields{"err": err})
+		return numDocs, de.testConn.newError(PhaseExport, err)
+	}
+	de.testConn.logger.Debug("Exported documents", Fields{
+		"numDocs":    numDocs,
+		"database":   opts.DB,
+		"collection": opts.Collection,
+	})
+	return numDocs, nil
+}
+
+// flattenedFields returns a copy of opts with Fields expanded into a column per nested value
+func (de *DatabaseExporter) flattenedFields(opts mongoexport.Options) (mongoexport.Options, error) {
+	ctx := context.Background()
+	filter, err := de.exportQuery(opts)
+	if err != nil {
+		return opts, err
+	}
+	coll := de.testConn.MongoDriverClient().Database(opts.DB).Collection(opts.Collection)
+	paths, err := collectFieldPaths(ctx, coll, filter)
+	if err != nil {
+		return opts, de.testConn.newError(PhaseExport, fmt.Errorf("could not find the fields to flatten: %w", err))
+	}
+	requested, err := requestedFields(opts)
+	if err != nil {
+		return opts, err
+	}
+	if len(requested) != 0 {
+		paths = expandFieldPaths(requested, paths)
+	}
+	if len(paths) == 0 {
+		return opts, de.testConn.newError(PhaseExport, errors.New("no fields were found to export as CSV"))
+	}
+	outputOpts := *opts.OutputFormatOptions
+	outputOpts.Fields = strings.Join(paths, ",")
+	outputOpts.FieldFile = ""
+	opts.OutputFormatOptions = &outputOpts
+	return opts, nil
+}
+
+// exportQuery parses the query set using Query
+func (de *DatabaseExporter) exportQuery(opts mongoexport.Options) (bson.D, error) {
+	filter := bson.D{}
+	if len(opts.Query) != 0 {
+		if err := bson.UnmarshalExtJSON([]byte(opts.Query), false, &filter); err != nil {
+			return nil, de.testConn.newError(PhaseExport, fmt.Errorf("could not parse query: %w", err))
+		}
+	}
+	return filter, nil
+}
+
+// requestedFields returns the CSV fields set using Fields or FieldFile
+func requestedFields(opts mongoexport.Options) ([]string, error) {
+	if len(opts.FieldFile) != 0 {
+		contents, err := ioutil.ReadFile(opts.FieldFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read field file: %w", err)
+		}
+		return strings.Fields(string(contents)), nil
+	} else if len(opts.Fields) != 0 {
+		return strings.Split(opts.Fields, ","), nil
+	}
+	return nil, nil
+}
+
+// Transform redacts or rewrites the exported documents using t. Transformed exports read the
+// documents through the driver rather than mongoexport, but produce the same output formats.
+// CSV columns are found by scanning the transformed documents if no Fields were set.
+func (de *DatabaseExporter) Transform(t *Transform) *DatabaseExporter {
+	if de.err != nil || t == nil {
+		return de
+	}
+	if err := t.Validate(); err != nil {
+		de.err = de.testConn.newError(PhaseExport, err)
+		return de
+	}
+	de.transform = t
+	return de
+}
+
+// exportTransformed exports the documents selected by opts through de.transform
+func (de *DatabaseExporter) exportTransformed(opts mongoexport.Options, w io.Writer) (numDocs int64, err error) {
+	ctx := context.Background()
+	filter, err := de.exportQuery(opts)
+	if err != nil {
+		return 0, err
+	}
+	filter = de.transform.withKeepFilter(opts.Collection, filter)
+	findOpts := options.Find()
+	if len(opts.Sort) != 0 {
+		var sort bson.D
+		if err = bson.UnmarshalExtJSON([]byte(opts.Sort), false, &sort); err != nil {
+			return 0, de.testConn.newError(PhaseExport, fmt.Errorf("could not parse sort: %w", err))
+		}
+		findOpts.SetSort(sort)
+	}
+	if opts.Skip > 0 {
+		findOpts.SetSkip(opts.Skip)
+	}
+	if opts.Limit > 0 {
+		findOpts.SetLimit(opts.Limit)
+	}
+	coll := de.testConn.MongoDriverClient().Database(opts.DB).Collection(opts.Collection)
+
+	format := ExportJSON
+	var fields []string
+	if opts.Type == "csv" {
+		format = ExportCSV
+		if fields, err = requestedFields(opts); err != nil {
+			return 0, err
+		}
+		if de.flatten || len(fields) == 0 {
+			// Columns come from the transformed documents, so dropped fields don't appear
+			seen := map[string]bool{}
+			err = de.eachTransformed(ctx, coll, filter, findOpts, func(doc bson.Raw) error {
+				return addLeafPaths(seen, "", doc)
+			})
+			if err != nil {
+				return 0, err
+			}
+			paths := make([]string, 0, len(seen))
+			for p := range seen {
+				paths = append(paths, p)
+			}
+			sortFieldPaths(paths)
+			if len(fields) != 0 {
+				paths = expandFieldPaths(fields, paths)
+			}
+			fields = paths
+		}
+		if len(fields) == 0 {
+			return 0, de.testConn.newError(PhaseExport, errors.New("no fields were found to export as CSV"))
+		}
+	} else if opts.JSONArray {
+		format = ExportJSONArray
+	}
+	encoder := newDocumentEncoder(w, format, fields, jsonStyle{
+		relaxed: opts.JSONFormat != mongoexport.Canonical,
+		pretty:  opts.Pretty,
+	})
+	err = de.eachTransformed(ctx, coll, filter, findOpts, func(doc bson.Raw) error {
+		numDocs++
+		return encoder.Encode(doc)
+	})
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		de.testConn.logger.Error("Could not export transformed documents", Fields{"err": err})
+		return numDocs, de.testConn.newError(PhaseExport, err)
+	}
+	de.testConn.logger.Debug("Exported transformed documents", Fields{
+		"numDocs":    numDocs,
+		"database":   opts.DB,
+		"collection": opts.Collection,
+	})
+	return numDocs, nil
+}
+
+// eachTransformed calls fn with every document in coll matching filter, after it has been
+// transformed
+func (de *DatabaseExporter) eachTransformed(ctx context.Context, coll *mongo.Collection, filter bson.D, findOpts *options.FindOptions, fn func(doc bson.Raw) error) error {
+	cursor, err := coll.Find(ctx, filter, findOpts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if doc, err = de.transform.apply(coll.Name(), doc); err != nil {
+			return err
+		}
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err = fn(raw); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// write exports to the file configured with Filepath, or to a new temp file if none was
+// configured, and returns the path written to. Existing files are truncated. The output is
+// gzip compressed if CompressToGZIP was called.
+func (de *DatabaseExporter) write() (fpath string, err error) {
+	if de.err != nil {
+		return "", de.err
+	}
 	var file *os.File
-	if len(de.filepath) == 0 {
+	isTemp := len(de.filepath) == 0
+	if isTemp {
 		// For our use-case, spawn a temp file to output to.
-		filePattern := fmt.Sprintf("mongoexport-%s-%s-*-%s",
-			de.baseOpts.DB, de.baseOpts.Collection, "."+de.baseOpts.Type)
-		file, err = ioutil.TempFile(os.TempDir(), filePattern)
+		file, err = ioutil.TempFile(os.TempDir(), exportFilePattern(de.baseOpts.DB, de.baseOpts.Collection, de.baseOpts.Type, de.compressToGZ))
 	} else {
-		file, err = os.Open(de.filepath)
+		file, err = os.OpenFile(de.filepath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	}
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("could not open export file: %w", err)
+	}
+	err = writeExportFile(file, de.compressToGZ, func(w io.Writer) error {
+		_, err := de.ToWriter(w)
+		return err
+	})
+	if err != nil {
+		// Clean up temp files, but never remove a file the caller asked us to write
+		if isTemp {
+			_ = os.Remove(file.Name())
+		}
+		return "", err
 	}
+	return file.Name(), nil
+}
 
-	if de.compressToGZ {
-		// TODO: Is this the correct method for doing gzip with this library?
-		writer = gzip.NewWriter(file)
-	} else {
-		writer = file
+// exportFilePattern returns the temp file pattern for an export, e.g. mongoexport-db-coll-*.json.gz
+func exportFilePattern(dbName, collectionName, exportType string, compressToGZ bool) string {
+	if len(exportType) == 0 {
+		exportType = "json"
 	}
+	pattern := fmt.Sprintf("mongoexport-%s-%s-*.%s", dbName, collectionName, exportType)
+	if compressToGZ {
+		pattern += ".gz"
+	}
+	return pattern
+}
 
-	// Export everything to the temp file
-	numDocs, err := exporter.Export(writer)
-	if err != nil {
-		log.Logvf(log.Always, "Failed: %v", err)
-		// Always remove files in the case of export failure
-		file.Close()
-		_ = os.Remove(file.Name())
-		return nil, err
+// writeExportFile runs export against file (through a gzip writer if requested), then flushes
+// and closes everything. file is always closed.
+func writeExportFile(file *os.File, compressToGZ bool, export func(w io.Writer) error) error {
+	if !compressToGZ {
+		err := export(file)
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("could not close export file: %w", closeErr)
+		}
+		return err
 	}
-	log.Logvf(log.Always, "Number of documents written: %d", numDocs)
-	return file, err
+	gzWriter := gzip.NewWriter(file)
+	err := export(gzWriter)
+	// The gzip footer is only written on Close - without it the archive is truncated
+	if closeErr := gzWriter.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("could not finish gzip export: %w", closeErr)
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("could not close export file: %w", closeErr)
+	}
+	return err
+}
+
+// CompressToGZIP gzip compresses files written by ToFile, ToJSONFile and CSVFile
+func (de *DatabaseExporter) CompressToGZIP() *DatabaseExporter {
+	de.compressToGZ = true
+	return de
+}
+
+// ToFile writes the documents to disk in the configured format and returns the path the file
+// was written to. Unless Filepath was called, a temp file is created which the caller is
+// expected to remove.
+func (de *DatabaseExporter) ToFile() (fpath string, err error) {
+	return de.write()
 }
 
 // ToJSONFile writes a JSON formatted file to disk and returns the path the file was written to
 func (de *DatabaseExporter) ToJSONFile(prettify, jsonArray, relaxedJSON, compressToGZIP bool) (fpath string, err error) {
+	if de.err != nil {
+		return "", de.err
+	}
 	de.baseOpts.Pretty = prettify
 	de.baseOpts.JSONFormat = mongoexport.Canonical
 	if relaxedJSON {
@@ -161,76 +673,17 @@ func (de *DatabaseExporter) ToJSONFile(prettify, jsonArray, relaxedJSON, compres
 	}
 	de.baseOpts.Type = "json"
 	de.baseOpts.JSONArray = jsonArray
-	file, err := de.write()
-	if err != nil {
-		return "", err
+	if compressToGZIP {
+		de.compressToGZ = true
 	}
-	defer file.Close()
-	return file.Name(), nil
+	return de.write()
 }
+
+// CSVFile writes a CSV file to disk and returns the path the file was written to
 func (de *DatabaseExporter) CSVFile() (fpath string, err error) {
-	de.baseOpts.Type = "csv"
-	file, err := de.write()
-	if err != nil {
-		return "", err
+	if de.err != nil {
+		return "", de.err
 	}
-	defer file.Close()
-	return file.Name(), nil
+	de.baseOpts.Type = "csv"
+	return de.write()
 }
-
-// // ExportDatabasetoJSON runs mongoexport against the current instance connected to TestConnection
-// // for the specified dbName
-// // The caller is responsible for closing/deleting the file
-// // This code used the main function from mongoexport as a starting point
-// // 		https://github.com/mongodb/mongo-tools/blob/f684129d7865/mongoexport/main/mongoexport.go
-// // mongoexport/mongoimport correspond to eachother - they are usually for working with JSON
-// // the don't fully preserve bson
-// func (testConn *TestConnection) ExportDatabasetoJSON(dbName, collectionName string, compressToGZ bool) (mongoExportTempFile *os.File, err error) {
-
-// 	rawArgs := []string{"-d", dbName, "-c", collectionName, testConn.mongoURI}
-// 	opts, err := mongoexport.ParseOptions(rawArgs, "mongotest", "master")
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	exporter, err := mongoexport.New(opts)
-// 	if err != nil {
-// 		log.Logvf(log.Always, "%v", err)
-// 		if se, ok := err.(util.SetupError); ok && se.Message != "" {
-// 			log.Logv(log.Always, se.Message)
-// 		}
-
-// 		return nil, err
-// 	}
-// 	defer exporter.Close()
-
-// 	// For our use-case, spawn a temp file to output to.
-// 	filePattern := fmt.Sprintf("mongoexport-%s-%s-*-%s", dbName, collectionName, ".json")
-// 	mongoExportTempFile, err = ioutil.TempFile(os.TempDir(), filePattern)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	var writer io.Writer
-// 	if compressToGZ {
-// 		writer = gzip.NewWriter(mongoExportTempFile)
-// 	} else {
-// 		writer = mongoExportTempFile
-// 	}
-
-// 	// Export everything to the temp file
-// 	numDocs, err := exporter.Export(writer)
-// 	if err != nil {
-// 		log.Logvf(log.Always, "Failed: %v", err)
-// 		_ = mongoExportTempFile.Close()
-// 		_ = os.Remove(mongoExportTempFile.Name())
-// 		return nil, err
-// 	}
-
-// 	if numDocs == 1 {
-// 		log.Logvf(log.Always, "exported %v record", numDocs)
-// 	} else {
-// 		log.Logvf(log.Always, "exported %v records", numDocs)
-// 	}
-// 	return mongoExportTempFile, err
-// }
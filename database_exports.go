@@ -0,0 +1,320 @@
+package mongotest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExportFormat is the file format written by ExportDatabase and ExportAll
+type ExportFormat string
+
+const (
+	// ExportJSON writes one Canonical Extended JSON document per line to <collection>.json
+	ExportJSON ExportFormat = "json"
+	// ExportJSONArray writes a JSON array of Canonical Extended JSON documents to <collection>.json
+	ExportJSONArray ExportFormat = "jsonArray"
+	// ExportCSV writes <collection>.csv with a header line covering every field. Embedded documents
+	// and arrays are flattened into dotted columns (see DatabaseExporter.FlattenNested). CSV has no
+	// types, so ObjectIDs, dates and the like are written as text and load back as strings - use
+	// ExportJSON or ExportJSONArray when the output needs to round-trip.
+	ExportCSV ExportFormat = "csv"
+)
+
+// exportParallelism is the number of collections exported at once
+const exportParallelism = 4
+
+// internalDatabases are never exported by ExportAll
+var internalDatabases = map[string]bool{
+	"admin":  true,
+	"config": true,
+	"local":  true,
+}
+
+// collectionSpec is the subset of a listCollections result needed to export a collection
+type collectionSpec struct {
+	Name    string   `bson:"name"`
+	Type    string   `bson:"type"`
+	Options bson.Raw `bson:"options"`
+}
+
+// ExportDatabase exports every collection in dbName to dir/<dbName>/<collection>.<ext>, along
+// with <collection>.indexes.json and <collection>.options.json sidecars. System collections and
+// views are skipped. JSON output can be loaded back using LoadFixtures with every BSON type
+// intact (CSV output loses them - see ExportCSV):
+//
+//	err := conn.ExportDatabase("app", dir, mongotest.ExportJSON)
+//	...
+//	err = otherConn.LoadFixtures(os.DirFS(dir), ".")
+func (tc *TestConnection) ExportDatabase(dbName, dir string, format ExportFormat) error {
+	ctx := context.Background()
+	specs, err := listExportableCollections(ctx, tc.MongoDriverClient().Database(dbName))
+	if err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not list collections in '%s': %w", dbName, err))
+	}
+	dbDir := filepath.Join(dir, dbName)
+	if err = os.MkdirAll(dbDir, 0755); err != nil {
+		return fmt.Errorf("could not create export directory: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan struct{}, exportParallelism)
+	for _, spec := range specs {
+		spec := spec
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := tc.exportCollection(ctx, dbName, dbDir, spec, format); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	tc.logger.Debug("Exported database", Fields{
+		"database":    dbName,
+		"collections": len(specs),
+		"dir":         dbDir,
+	})
+	return nil
+}
+
+// ExportAll exports every database except admin, config and local to dir/<db>/<collection>.json
+// using ExportDatabase. This is useful for capturing the full state of a test for debugging.
+func (tc *TestConnection) ExportAll(dir string) error {
+	dbNames, err := tc.MongoDriverClient().ListDatabaseNames(context.Background(), bson.D{})
+	if err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not list databases: %w", err))
+	}
+	for _, dbName := range dbNames {
+		if internalDatabases[dbName] {
+			continue
+		}
+		if err = tc.ExportDatabase(dbName, dir, ExportJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportConsistent exports every collection in namespaces as of a single point in time, writing
+// the same layout as ExportDatabase. Each namespace is either a database name (every collection
+// in the database is exported) or "<db>.<collection>". All of the collections are read through
+// one snapshot session, so writes made by anything else while the export runs are never
+// partially included. Snapshot reads require a replica set (see NewReplicaSetContainer) running
+// mongo 5.0 or later.
+func (tc *TestConnection) ExportConsistent(ctx context.Context, dir string, format ExportFormat, namespaces ...string) error {
+	client := tc.MongoDriverClient()
+	type namespace struct {
+		db   string
+		spec collectionSpec
+	}
+	// listCollections can't run in a snapshot session, so resolve everything up-front
+	var toExport []namespace
+	for _, ns := range namespaces {
+		dbName, collName := ns, ""
+		if i := strings.Index(ns, "."); i != -1 {
+			dbName, collName = ns[:i], ns[i+1:]
+		}
+		specs, err := listExportableCollections(ctx, client.Database(dbName))
+		if err != nil {
+			return tc.newError(PhaseExport, fmt.Errorf("could not list collections in '%s': %w", dbName, err))
+		}
+		found := false
+		for _, spec := range specs {
+			if len(collName) == 0 || spec.Name == collName {
+				toExport = append(toExport, namespace{db: dbName, spec: spec})
+				found = true
+			}
+		}
+		if len(collName) != 0 && !found {
+			return tc.newError(PhaseExport, fmt.Errorf("collection '%s' does not exist", ns))
+		}
+	}
+
+	session, err := client.StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not start a snapshot session: %w", err))
+	}
+	defer session.EndSession(ctx)
+	sessCtx := mongo.NewSessionContext(ctx, session)
+	// Sessions aren't safe for concurrent use, so collections are exported one at a time
+	for _, ns := range toExport {
+		dbDir := filepath.Join(dir, ns.db)
+		if err = os.MkdirAll(dbDir, 0755); err != nil {
+			return fmt.Errorf("could not create export directory: %w", err)
+		}
+		coll := client.Database(ns.db).Collection(ns.spec.Name)
+		if err = tc.exportCollectionAt(sessCtx, coll, filepath.Join(dbDir, ns.spec.Name+exportFileExtension(format)), format); err != nil {
+			return err
+		}
+		if err = tc.writeCollectionSidecars(ctx, coll, dbDir, ns.spec); err != nil {
+			return err
+		}
+	}
+	tc.logger.Debug("Exported consistent snapshot", Fields{
+		"namespaces":  namespaces,
+		"collections": len(toExport),
+		"dir":         dir,
+	})
+	return nil
+}
+
+// exportCollectionAt writes every document in coll to fpath, reading through the snapshot
+// session in sessCtx
+func (tc *TestConnection) exportCollectionAt(sessCtx mongo.SessionContext, coll *mongo.Collection, fpath string, format ExportFormat) error {
+	var fields []string
+	if format == ExportCSV {
+		var err error
+		if fields, err = collectFieldPaths(sessCtx, coll, bson.D{}); err != nil {
+			return tc.newError(PhaseExport, fmt.Errorf("could not find the fields in %s: %w", coll.Name(), err))
+		}
+		if len(fields) == 0 {
+			// Nothing to write, as with ExportDatabase
+			return nil
+		}
+	}
+	cursor, err := coll.Find(sessCtx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not read %s: %w", coll.Name(), err))
+	}
+	defer cursor.Close(sessCtx)
+	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open export file: %w", err)
+	}
+	err = writeExportFile(file, false, func(w io.Writer) error {
+		encoder := newDocumentEncoder(w, format, fields, jsonStyle{})
+		for cursor.Next(sessCtx) {
+			if err := encoder.Encode(cursor.Current); err != nil {
+				return err
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		return encoder.Close()
+	})
+	if err != nil {
+		_ = os.Remove(fpath)
+		return tc.newError(PhaseExport, fmt.Errorf("could not export %s: %w", coll.Name(), err))
+	}
+	return nil
+}
+
+// listExportableCollections returns the collections in db, sorted by name, skipping views and
+// system collections
+func listExportableCollections(ctx context.Context, db *mongo.Database) ([]collectionSpec, error) {
+	cursor, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var all []collectionSpec
+	if err = cursor.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	specs := make([]collectionSpec, 0, len(all))
+	for _, spec := range all {
+		if strings.HasPrefix(spec.Name, "system.") || (len(spec.Type) != 0 && spec.Type != "collection") {
+			continue
+		}
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs, nil
+}
+
+// exportCollection writes a single collection and its sidecars into dbDir
+func (tc *TestConnection) exportCollection(ctx context.Context, dbName, dbDir string, spec collectionSpec, format ExportFormat) error {
+	coll := tc.MongoDriverClient().Database(dbName).Collection(spec.Name)
+	exporter := tc.DatabaseExporter(dbName, spec.Name).CanonicalJSON()
+	switch format {
+	case ExportJSONArray:
+		exporter.JSONArray()
+	case ExportCSV:
+		fields, err := collectFieldPaths(ctx, coll, bson.D{})
+		if err != nil {
+			return tc.newError(PhaseExport, fmt.Errorf("could not find the fields in %s.%s: %w", dbName, spec.Name, err))
+		}
+		if len(fields) == 0 {
+			// mongoexport can't write a CSV without fields - an empty collection has no data to export anyway
+			return tc.writeCollectionSidecars(ctx, coll, dbDir, spec)
+		}
+		exporter.CSV().Fields(fields...)
+	default:
+		exporter.JSON()
+	}
+	if _, err := exporter.Filepath(filepath.Join(dbDir, spec.Name+exportFileExtension(format))).ToFile(); err != nil {
+		return err
+	}
+	return tc.writeCollectionSidecars(ctx, coll, dbDir, spec)
+}
+
+// writeCollectionSidecars writes the .options.json and .indexes.json files understood by LoadFixtures
+func (tc *TestConnection) writeCollectionSidecars(ctx context.Context, coll *mongo.Collection, dbDir string, spec collectionSpec) error {
+	if len(spec.Options) != 0 {
+		if elems, _ := spec.Options.Elements(); len(elems) != 0 {
+			optionsJSON, err := bson.MarshalExtJSONIndent(spec.Options, true, false, "", "  ")
+			if err != nil {
+				return fmt.Errorf("could not encode options for %s: %w", spec.Name, err)
+			}
+			if err = os.WriteFile(filepath.Join(dbDir, spec.Name+fixtureOptionsSuffix), optionsJSON, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not list indexes for %s: %w", spec.Name, err))
+	}
+	var indexes []bson.D
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return tc.newError(PhaseExport, fmt.Errorf("could not list indexes for %s: %w", spec.Name, err))
+	}
+	indexesJSON, err := marshalExtJSONArray(indexes, true)
+	if err != nil {
+		return fmt.Errorf("could not encode indexes for %s: %w", spec.Name, err)
+	}
+	return os.WriteFile(filepath.Join(dbDir, spec.Name+fixtureIndexesSuffix), indexesJSON, 0644)
+}
+
+// marshalExtJSONArray encodes docs as an indented JSON array of Canonical or Relaxed Extended
+// JSON documents
+func marshalExtJSONArray(docs []bson.D, canonical bool) ([]byte, error) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, doc := range docs {
+		docJSON, err := bson.MarshalExtJSONIndent(doc, canonical, false, "  ", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if i != 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("\n  ")
+		sb.Write(docJSON)
+	}
+	sb.WriteString("\n]\n")
+	return []byte(sb.String()), nil
+}
@@ -0,0 +1,314 @@
+package mongotest
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/util"
+	"github.com/mongodb/mongo-tools/mongoimport"
+)
+
+// ImportMode determines how imported documents are written to the collection
+type ImportMode string
+
+const (
+	// ImportModeInsert inserts every document - documents with a duplicate _id fail to import
+	ImportModeInsert ImportMode = "insert"
+	// ImportModeUpsert replaces any existing document matching the upsert fields (_id by default)
+	ImportModeUpsert ImportMode = "upsert"
+	// ImportModeMerge merges fields into any existing document matching the upsert fields (_id by default)
+	ImportModeMerge ImportMode = "merge"
+)
+
+// ImportResult is the outcome of running a DatabaseImporter
+type ImportResult struct {
+	// Imported is the number of documents that were successfully written
+	Imported uint64
+	// Failed is the number of documents that could not be written
+	Failed uint64
+	// Anonymized describes the values rewritten by the Anonymizer, when one is set (see Anonymize)
+	Anonymized *AnonymizeReport
+}
+
+// DatabaseImporter is a wrapper to enable easily importing files into a live database.
+// It mirrors DatabaseExporter and runs mongoimport in-process against the TestConnection.
+type DatabaseImporter struct {
+	testConn         *TestConnection
+	dbName           string
+	collectionName   string
+	inputType        string
+	jsonArray        bool
+	headerLine       bool
+	fields           []string
+	fieldFile        string
+	columnsHaveTypes bool
+	arrayIndexes     bool
+	drop             bool
+	mode             ImportMode
+	upsertFields     []string
+	gzip             bool
+	stopOnError      bool
+	anonymizer       *Anonymizer
+}
+
+// DatabaseImporter returns an object which can be used to import data into a collection.
+// By default, the input is expected to be JSON with one document per line (the type is
+// inferred from the file extension when using FromFile).
+func (testConn *TestConnection) DatabaseImporter(dbName, collectionName string) *DatabaseImporter {
+	return &DatabaseImporter{
+		testConn:       testConn,
+		dbName:         dbName,
+		collectionName: collectionName,
+	}
+}
+
+// JSON expects the input to contain one Extended JSON document per line
+func (di *DatabaseImporter) JSON() *DatabaseImporter {
+	di.inputType = "json"
+	di.jsonArray = false
+	return di
+}
+
+// JSONArray expects the input to be a single JSON array of documents
+func (di *DatabaseImporter) JSONArray() *DatabaseImporter {
+	di.inputType = "json"
+	di.jsonArray = true
+	return di
+}
+
+// CSV expects the input to be comma separated. Field names come from HeaderLine, Fields or FieldFile.
+func (di *DatabaseImporter) CSV() *DatabaseImporter {
+	di.inputType = "csv"
+	return di
+}
+
+// TSV expects the input to be tab separated. Field names come from HeaderLine, Fields or FieldFile.
+func (di *DatabaseImporter) TSV() *DatabaseImporter {
+	di.inputType = "tsv"
+	return di
+}
+
+// HeaderLine uses the first line of CSV/TSV input as the field names
+func (di *DatabaseImporter) HeaderLine() *DatabaseImporter {
+	di.headerLine = true
+	return di
+}
+
+// Fields sets the field names for CSV/TSV input which doesn't have a header line
+func (di *DatabaseImporter) Fields(fields ...string) *DatabaseImporter {
+	di.fields = fields
+	return di
+}
+
+// FieldFile reads the field names for CSV/TSV input from a file with one field name per line
+func (di *DatabaseImporter) FieldFile(f string) *DatabaseImporter {
+	di.fieldFile = f
+	return di
+}
+
+// ColumnsHaveTypes indicates that the CSV/TSV field names carry their types
+// (e.g. "age.int32()" or "created.date(2006-01-02)").
+// See https://www.mongodb.com/docs/database-tools/mongoimport/#std-option-mongoimport.--columnsHaveTypes
+func (di *DatabaseImporter) ColumnsHaveTypes() *DatabaseImporter {
+	di.columnsHaveTypes = true
+	return di
+}
+
+// UseArrayIndexFields reads numeric parts of dotted CSV/TSV field names as array indexes, so a
+// column named "tags.0" is imported as the first element of the tags array rather than a field
+// named "0". This reads back CSVs written by DatabaseExporter.FlattenNested.
+func (di *DatabaseImporter) UseArrayIndexFields() *DatabaseImporter {
+	di.arrayIndexes = true
+	return di
+}
+
+// Drop drops the collection before importing
+func (di *DatabaseImporter) Drop() *DatabaseImporter {
+	di.drop = true
+	return di
+}
+
+// Mode sets how documents are written to the collection (insert by default)
+func (di *DatabaseImporter) Mode(m ImportMode) *DatabaseImporter {
+	di.mode = m
+	return di
+}
+
+// UpsertFields sets the fields used to match existing documents in ImportModeUpsert or
+// ImportModeMerge (_id by default)
+func (di *DatabaseImporter) UpsertFields(fields ...string) *DatabaseImporter {
+	di.upsertFields = fields
+	return di
+}
+
+// Gzip indicates the input is gzip compressed. Files ending in .gz are always treated as
+// compressed.
+func (di *DatabaseImporter) Gzip() *DatabaseImporter {
+	di.gzip = true
+	return di
+}
+
+// StopOnError stops the import at the first document which can't be written
+func (di *DatabaseImporter) StopOnError() *DatabaseImporter {
+	di.stopOnError = true
+	return di
+}
+
+// FromFile imports the file found at fpath. If no input type was set, it is inferred from
+// the file extension (.json, .csv or .tsv, optionally followed by .gz).
+func (di *DatabaseImporter) FromFile(fpath string) (ImportResult, error) {
+	importer, isGzip := di.forFile(fpath)
+	if !isGzip {
+		return importer.importFile(fpath)
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer f.Close()
+	return importer.fromReader(f, true)
+}
+
+// forFile returns the importer to use for fpath and whether fpath is gzipped. If no input type
+// was set, the type inferred from the extension is set on a copy, so the builder itself can still
+// be reused for files of other types.
+func (di *DatabaseImporter) forFile(fpath string) (*DatabaseImporter, bool) {
+	ext := strings.ToLower(filepath.Ext(fpath))
+	isGzip := di.gzip || ext == ".gz"
+	if ext == ".gz" {
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(fpath, filepath.Ext(fpath))))
+	}
+	if len(di.inputType) != 0 {
+		return di, isGzip
+	}
+	inferred := *di
+	switch ext {
+	case ".csv":
+		inferred.inputType = "csv"
+	case ".tsv":
+		inferred.inputType = "tsv"
+	default:
+		inferred.inputType = "json"
+	}
+	return &inferred, isGzip
+}
+
+// FromReader imports everything that can be read from r
+func (di *DatabaseImporter) FromReader(r io.Reader) (ImportResult, error) {
+	return di.fromReader(r, di.gzip)
+}
+
+// fromReader spools r to a temporary file (decompressing it if needed), as mongoimport
+// only reads from files or stdin
+func (di *DatabaseImporter) fromReader(r io.Reader, isGzip bool) (ImportResult, error) {
+	if isGzip {
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("could not read gzip input: %w", err)
+		}
+		defer gzReader.Close()
+		r = gzReader
+	}
+	filePattern := fmt.Sprintf("mongoimport-%s-%s-*", di.dbName, di.collectionName)
+	file, err := ioutil.TempFile(os.TempDir(), filePattern)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, r)
+	closeErr := file.Close()
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("could not spool input for import: %w", err)
+	} else if closeErr != nil {
+		return ImportResult{}, closeErr
+	}
+	return di.importFile(file.Name())
+}
+
+// args builds the mongoimport command line for importing fpath
+func (di *DatabaseImporter) args(fpath string) []string {
+	inputType := di.inputType
+	if len(inputType) == 0 {
+		inputType = "json"
+	}
+	rawArgs := []string{
+		"-d", di.dbName,
+		"-c", di.collectionName,
+		"--type=" + inputType,
+		"--file=" + fpath,
+	}
+	if di.jsonArray {
+		rawArgs = append(rawArgs, "--jsonArray")
+	}
+	if di.headerLine {
+		rawArgs = append(rawArgs, "--headerline")
+	}
+	if len(di.fields) != 0 {
+		rawArgs = append(rawArgs, "--fields="+strings.Join(di.fields, ","))
+	}
+	if len(di.fieldFile) != 0 {
+		rawArgs = append(rawArgs, "--fieldFile="+di.fieldFile)
+	}
+	if di.columnsHaveTypes {
+		rawArgs = append(rawArgs, "--columnsHaveTypes")
+	}
+	if di.arrayIndexes {
+		rawArgs = append(rawArgs, "--useArrayIndexFields")
+	}
+	if di.drop {
+		rawArgs = append(rawArgs, "--drop")
+	}
+	if len(di.mode) != 0 {
+		rawArgs = append(rawArgs, "--mode="+string(di.mode))
+	}
+	if len(di.upsertFields) != 0 {
+		rawArgs = append(rawArgs, "--upsertFields="+strings.Join(di.upsertFields, ","))
+	}
+	if di.stopOnError {
+		rawArgs = append(rawArgs, "--stopOnError")
+	}
+	return append(rawArgs, di.testConn.mongoURI)
+}
+
+// importFile runs mongoimport against the file found at fpath
+func (di *DatabaseImporter) importFile(fpath string) (ImportResult, error) {
+	if di.anonymizer != nil {
+		return di.importAnonymized(fpath)
+	}
+	opts, err := mongoimport.ParseOptions(di.args(fpath), "mongotest", "master")
+	if err != nil {
+		return ImportResult{}, di.testConn.newError(PhaseImport, fmt.Errorf("could not parse mongoimport options: %w", err))
+	}
+	importer, err := mongoimport.New(opts)
+	if err != nil {
+		fields := Fields{"err": err}
+		if se, ok := err.(util.SetupError); ok && se.Message != "" {
+			fields["setupMessage"] = se.Message
+		}
+		di.testConn.logger.Error("Could not initialize mongoimport", fields)
+		return ImportResult{}, di.testConn.newError(PhaseImport, err)
+	}
+	defer importer.Close()
+
+	imported, failed, err := importer.ImportDocuments()
+	result := ImportResult{
+		Imported: imported,
+		Failed:   failed,
+	}
+	if err != nil {
+		di.testConn.logger.Error("Could not import documents", Fields{"err": err})
+		return result, di.testConn.newError(PhaseImport, err)
+	}
+	di.testConn.logger.Debug("Imported documents", Fields{
+		"imported":   imported,
+		"failed":     failed,
+		"database":   di.dbName,
+		"collection": di.collectionName,
+	})
+	return result, nil
+}
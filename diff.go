@@ -0,0 +1,545 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tophergopher/mongotest/internal/bsonvalue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Namespace identifies a collection, or a whole database when Collection is empty, on a
+// TestConnection
+type Namespace struct {
+	Conn       *TestConnection
+	Database   string
+	Collection string
+}
+
+// Namespace returns the namespace dbName.collName on this connection. Leave collName empty to
+// refer to the whole database.
+func (tc *TestConnection) Namespace(dbName, collName string) Namespace {
+	return Namespace{Conn: tc, Database: dbName, Collection: collName}
+}
+
+func (ns Namespace) String() string {
+	if len(ns.Collection) == 0 {
+		return ns.Database
+	}
+	return ns.Database + "." + ns.Collection
+}
+
+// ChangeKind describes how a document or field differs between two namespaces
+type ChangeKind string
+
+const (
+	// ChangeAdded is only present in the second namespace
+	ChangeAdded ChangeKind = "added"
+	// ChangeRemoved is only present in the first namespace
+	ChangeRemoved ChangeKind = "removed"
+	// ChangeModified is present in both namespaces with a different value or BSON type
+	ChangeModified ChangeKind = "changed"
+)
+
+// DiffOption configures DiffCollections
+type DiffOption func(dc *diffConfig)
+
+type diffConfig struct {
+	ignorePaths [][]string
+}
+
+// DiffIgnorePaths skips the given dotted paths (and everything below them) when comparing
+// documents. Array indexes can be left out: "items.etag" ignores the etag of every item.
+func DiffIgnorePaths(paths ...string) DiffOption {
+	return func(dc *diffConfig) {
+		for _, p := range paths {
+			dc.ignorePaths = append(dc.ignorePaths, strings.Split(p, "."))
+		}
+	}
+}
+
+// ignored reports whether path matches one of the ignored paths
+func (dc *diffConfig) ignored(path []string) bool {
+	for _, ignore := range dc.ignorePaths {
+		if matchDiffPath(ignore, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDiffPath reports whether path is pattern or below it. Numeric segments of path are
+// skipped when the pattern doesn't name an index.
+func matchDiffPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if pattern[0] == path[0] {
+		return matchDiffPath(pattern[1:], path[1:])
+	}
+	if _, err := strconv.Atoi(path[0]); err == nil {
+		return matchDiffPath(pattern, path[1:])
+	}
+	return false
+}
+
+// FieldDiff is a single field which differs between two versions of a document
+type FieldDiff struct {
+	// Path is the dotted path to the field, including array indexes
+	Path string
+	Kind ChangeKind
+	// Old is the value in the first namespace - it is empty when the field was added
+	Old bson.RawValue
+	// New is the value in the second namespace - it is empty when the field was removed
+	New bson.RawValue
+}
+
+// DocumentDiff is a single document which differs between two namespaces
+type DocumentDiff struct {
+	// Collection is the collection holding the document
+	Collection string
+	// Key is the value of the key field matching the two versions of the document
+	Key  bson.RawValue
+	Kind ChangeKind
+	// Document is the added or removed document. It is nil for changed documents.
+	Document bson.Raw
+	// Fields are the differences within a changed document
+	Fields []FieldDiff
+}
+
+// Diff is the result of DiffCollections
+type Diff struct {
+	// A and B are the compared namespaces
+	A, B string
+	// Key is the field used to match documents between the namespaces
+	Key string
+	// Documents are the differences, in key order, grouped by collection
+	Documents []DocumentDiff
+}
+
+// Empty reports whether the namespaces hold the same documents
+func (d *Diff) Empty() bool {
+	return len(d.Documents) == 0
+}
+
+// Counts returns the number of added, removed and changed documents
+func (d *Diff) Counts() (added, removed, changed int) {
+	for _, doc := range d.Documents {
+		switch doc.Kind {
+		case ChangeAdded:
+			added++
+		case ChangeRemoved:
+			removed++
+		default:
+			changed++
+		}
+	}
+	return added, removed, changed
+}
+
+// String renders the diff for test output. Values are written as Canonical Extended JSON, so
+// changes of type are visible:
+//
+//	app.users vs app_migrated.users: 1 added, 0 removed, 1 changed
+//	~ users {"$numberInt":"1"}
+//	    age: {"$numberInt":"34"} -> {"$numberLong":"34"}
+//	+ users {"$numberInt":"2"}: {"_id":{"$numberInt":"2"},"name":"bob"}
+func (d *Diff) String() string {
+	added, removed, changed := d.Counts()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s vs %s: %d added, %d removed, %d changed", d.A, d.B, added, removed, changed)
+	for _, doc := range d.Documents {
+		key := diffValueString(doc.Key)
+		switch doc.Kind {
+		case ChangeAdded:
+			fmt.Fprintf(&sb, "\n+ %s %s: %s", doc.Collection, key, diffDocumentString(doc.Document))
+		case ChangeRemoved:
+			fmt.Fprintf(&sb, "\n- %s %s: %s", doc.Collection, key, diffDocumentString(doc.Document))
+		default:
+			fmt.Fprintf(&sb, "\n~ %s %s", doc.Collection, key)
+			for _, field := range doc.Fields {
+				switch field.Kind {
+				case ChangeAdded:
+					fmt.Fprintf(&sb, "\n    + %s: %s", field.Path, diffValueString(field.New))
+				case ChangeRemoved:
+					fmt.Fprintf(&sb, "\n    - %s: %s", field.Path, diffValueString(field.Old))
+				default:
+					fmt.Fprintf(&sb, "\n    %s: %s -> %s", field.Path, diffValueString(field.Old), diffValueString(field.New))
+				}
+			}
+		}
+	}
+	return sb.String()
+}
+
+// JSON renders the diff as a JSON document, with values written as Canonical Extended JSON
+func (d *Diff) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// MarshalJSON encodes the diff for JSON
+func (d *Diff) MarshalJSON() ([]byte, error) {
+	type jsonField struct {
+		Path    string          `json:"path"`
+		Kind    ChangeKind      `json:"kind"`
+		Old     json.RawMessage `json:"old,omitempty"`
+		New     json.RawMessage `json:"new,omitempty"`
+		OldType string          `json:"oldType,omitempty"`
+		NewType string          `json:"newType,omitempty"`
+	}
+	type jsonDocument struct {
+		Collection string          `json:"collection"`
+		Key        json.RawMessage `json:"key"`
+		Kind       ChangeKind      `json:"kind"`
+		Document   json.RawMessage `json:"document,omitempty"`
+		Fields     []jsonField     `json:"fields,omitempty"`
+	}
+	added, removed, changed := d.Counts()
+	out := struct {
+		A         string         `json:"a"`
+		B         string         `json:"b"`
+		Key       string         `json:"key"`
+		Added     int            `json:"added"`
+		Removed   int            `json:"removed"`
+		Changed   int            `json:"changed"`
+		Documents []jsonDocument `json:"documents"`
+	}{A: d.A, B: d.B, Key: d.Key, Added: added, Removed: removed, Changed: changed, Documents: []jsonDocument{}}
+	for _, doc := range d.Documents {
+		jsonDoc := jsonDocument{
+			Collection: doc.Collection,
+			Key:        json.RawMessage(diffValueString(doc.Key)),
+			Kind:       doc.Kind,
+		}
+		if doc.Document != nil {
+			jsonDoc.Document = json.RawMessage(diffDocumentString(doc.Document))
+		}
+		for _, field := range doc.Fields {
+			jsonField := jsonField{Path: field.Path, Kind: field.Kind}
+			if field.Old.Type != 0 {
+				jsonField.Old = json.RawMessage(diffValueString(field.Old))
+				jsonField.OldType = field.Old.Type.String()
+			}
+			if field.New.Type != 0 {
+				jsonField.New = json.RawMessage(diffValueString(field.New))
+				jsonField.NewType = field.New.Type.String()
+			}
+			jsonDoc.Fields = append(jsonDoc.Fields, jsonField)
+		}
+		out.Documents = append(out.Documents, jsonDoc)
+	}
+	return json.Marshal(out)
+}
+
+// diffValueString writes value as Canonical Extended JSON
+func diffValueString(value bson.RawValue) string {
+	if value.Type == 0 {
+		return "null"
+	}
+	out, err := bsonvalue.ExtJSON(value, true)
+	if err != nil {
+		return value.String()
+	}
+	return out
+}
+
+// diffDocumentString writes doc as Canonical Extended JSON
+func diffDocumentString(doc bson.Raw) string {
+	out, err := bson.MarshalExtJSON(doc, true, false)
+	if err != nil {
+		return doc.String()
+	}
+	return string(out)
+}
+
+// DiffCollections compares the documents in two namespaces, matching them up by the dotted key
+// field (_id by default). The namespaces can be on the same or different TestConnections, which
+// makes this useful for checking migrations and ETL jobs. Fields are compared by BSON type as
+// well as value, so an int32 becoming an int64 counts as a change. When both namespaces are
+// databases, every collection in either of them is compared.
+//
+//	diff, err := mongotest.DiffCollections(ctx, conn.Namespace("app", "users"),
+//		conn.Namespace("app_migrated", "users"), "email", mongotest.DiffIgnorePaths("updatedAt"))
+//	...
+//	if !diff.Empty() {
+//		t.Errorf("Migration changed users:\n%s", diff)
+//	}
+func DiffCollections(ctx context.Context, a, b Namespace, key string, opts ...DiffOption) (*Diff, error) {
+	if len(key) == 0 {
+		key = "_id"
+	}
+	dc := &diffConfig{}
+	for _, opt := range opts {
+		opt(dc)
+	}
+	diff := &Diff{A: a.String(), B: b.String(), Key: key}
+	if (len(a.Collection) == 0) != (len(b.Collection) == 0) {
+		return nil, fmt.Errorf("cannot compare %s with %s: both namespaces must be collections or both must be databases", a, b)
+	}
+	if len(a.Collection) != 0 {
+		return diff, diffCollection(ctx, a, b, key, dc, diff)
+	}
+
+	collNames := map[string]bool{}
+	for _, ns := range []Namespace{a, b} {
+		specs, err := listExportableCollections(ctx, ns.Conn.MongoDriverClient().Database(ns.Database))
+		if err != nil {
+			return nil, fmt.Errorf("could not list collections in '%s': %w", ns, err)
+		}
+		for _, spec := range specs {
+			collNames[spec.Name] = true
+		}
+	}
+	sorted := make([]string, 0, len(collNames))
+	for collName := range collNames {
+		sorted = append(sorted, collName)
+	}
+	sort.Strings(sorted)
+	for _, collName := range sorted {
+		collA, collB := a, b
+		collA.Collection, collB.Collection = collName, collName
+		if err := diffCollection(ctx, collA, collB, key, dc, diff); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+// keyedDocument is a document along with the value of its key field
+type keyedDocument struct {
+	key bson.RawValue
+	doc bson.Raw
+}
+
+// diffCollection appends the differences between the collections a and b to diff
+func diffCollection(ctx context.Context, a, b Namespace, key string, dc *diffConfig, diff *Diff) error {
+	docsA, err := readKeyedDocuments(ctx, a, key)
+	if err != nil {
+		return err
+	}
+	docsB, err := readKeyedDocuments(ctx, b, key)
+	if err != nil {
+		return err
+	}
+	byKey := make(map[string]bson.Raw, len(docsB))
+	for _, kd := range docsB {
+		byKey[kd.key.String()] = kd.doc
+	}
+	first := len(diff.Documents)
+	seen := make(map[string]bool, len(docsA))
+	for _, kd := range docsA {
+		k := kd.key.String()
+		seen[k] = true
+		other, ok := byKey[k]
+		if !ok {
+			diff.Documents = append(diff.Documents, DocumentDiff{Collection: a.Collection, Key: kd.key, Kind: ChangeRemoved, Document: kd.doc})
+			continue
+		}
+		var fields []FieldDiff
+		if err = diffDocuments(kd.doc, other, nil, dc, &fields); err != nil {
+			return fmt.Errorf("could not compare %s %s: %w", a, k, err)
+		}
+		if len(fields) != 0 {
+			diff.Documents = append(diff.Documents, DocumentDiff{Collection: a.Collection, Key: kd.key, Kind: ChangeModified, Fields: fields})
+		}
+	}
+	for _, kd := range docsB {
+		if !seen[kd.key.String()] {
+			diff.Documents = append(diff.Documents, DocumentDiff{Collection: b.Collection, Key: kd.key, Kind: ChangeAdded, Document: kd.doc})
+		}
+	}
+	// Both sides were read in key order - slot the added documents in between the others
+	docs := diff.Documents[first:]
+	sort.SliceStable(docs, func(i, j int) bool {
+		return compareDiffKeys(docs[i].Key, docs[j].Key) < 0
+	})
+	return nil
+}
+
+// diffKeyTypeOrder ranks BSON types the way the server sorts them. Numbers rank together, as do
+// strings and symbols.
+var diffKeyTypeOrder = map[bsontype.Type]int{
+	bsontype.MinKey:           1,
+	bsontype.Undefined:        2,
+	bsontype.Null:             2,
+	bsontype.Int32:            3,
+	bsontype.Int64:            3,
+	bsontype.Double:           3,
+	bsontype.Decimal128:       3,
+	bsontype.String:           4,
+	bsontype.Symbol:           4,
+	bsontype.EmbeddedDocument: 5,
+	bsontype.Array:            6,
+	bsontype.Binary:           7,
+	bsontype.ObjectID:         8,
+	bsontype.Boolean:          9,
+	bsontype.DateTime:         10,
+	bsontype.Timestamp:        11,
+	bsontype.Regex:            12,
+	bsontype.DBPointer:        13,
+	bsontype.JavaScript:       14,
+	bsontype.CodeWithScope:    15,
+	bsontype.MaxKey:           16,
+}
+
+// compareDiffKeys orders two key values by type, then by value, following the server's sort
+// order for the types keys usually have. Other values of the same type are ordered by their
+// encoding, which is stable but may differ from the server.
+func compareDiffKeys(a, b bson.RawValue) int {
+	if rankA, rankB := diffKeyTypeOrder[a.Type], diffKeyTypeOrder[b.Type]; rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+	if numA, ok := bsonvalue.Number(a); ok {
+		numB, _ := bsonvalue.Number(b)
+		switch {
+		case numA < numB:
+			return -1
+		case numA > numB:
+			return 1
+		}
+		return 0
+	}
+	switch a.Type {
+	case bsontype.String, bsontype.Symbol:
+		return strings.Compare(diffKeyString(a), diffKeyString(b))
+	case bsontype.ObjectID:
+		idA, idB := a.ObjectID(), b.ObjectID()
+		return bytes.Compare(idA[:], idB[:])
+	case bsontype.Boolean:
+		boolA, boolB := a.Boolean(), b.Boolean()
+		switch {
+		case boolA == boolB:
+			return 0
+		case boolB:
+			return -1
+		}
+		return 1
+	case bsontype.DateTime:
+		return compareInt64(a.DateTime(), b.DateTime())
+	case bsontype.Timestamp:
+		tA, iA := a.Timestamp()
+		tB, iB := b.Timestamp()
+		if tA != tB {
+			return compareInt64(int64(tA), int64(tB))
+		}
+		return compareInt64(int64(iA), int64(iB))
+	}
+	return bytes.Compare(a.Value, b.Value)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// diffKeyString returns the contents of a string or symbol value
+func diffKeyString(value bson.RawValue) string {
+	if value.Type == bsontype.Symbol {
+		return value.Symbol()
+	}
+	return value.StringValue()
+}
+
+// readKeyedDocuments reads every document in ns, sorted by key. Every document must have the key
+// field, and its value must be unique.
+func readKeyedDocuments(ctx context.Context, ns Namespace, key string) ([]keyedDocument, error) {
+	coll := ns.Conn.MongoDriverClient().Database(ns.Database).Collection(ns.Collection)
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: key, Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", ns, err)
+	}
+	defer cursor.Close(ctx)
+	var docs []keyedDocument
+	seen := map[string]bool{}
+	for cursor.Next(ctx) {
+		doc := append(bson.Raw{}, cursor.Current...)
+		value, err := doc.LookupErr(strings.Split(key, ".")...)
+		if err != nil {
+			return nil, fmt.Errorf("document in %s has no '%s' key: %s", ns, key, doc)
+		}
+		if seen[value.String()] {
+			return nil, fmt.Errorf("documents in %s share the '%s' key %s", ns, key, value)
+		}
+		seen[value.String()] = true
+		docs = append(docs, keyedDocument{key: value, doc: doc})
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", ns, err)
+	}
+	return docs, nil
+}
+
+// diffDocuments appends the field differences between the documents (or arrays) a and b to fields
+func diffDocuments(a, b bson.Raw, prefix []string, dc *diffConfig, fields *[]FieldDiff) error {
+	elemsA, err := a.Elements()
+	if err != nil {
+		return err
+	}
+	elemsB, err := b.Elements()
+	if err != nil {
+		return err
+	}
+	valuesB := make(map[string]bson.RawValue, len(elemsB))
+	for _, elem := range elemsB {
+		valuesB[elem.Key()] = elem.Value()
+	}
+	seen := make(map[string]bool, len(elemsA))
+	for _, elem := range elemsA {
+		path := append(append([]string{}, prefix...), elem.Key())
+		seen[elem.Key()] = true
+		if dc.ignored(path) {
+			continue
+		}
+		oldValue := elem.Value()
+		newValue, ok := valuesB[elem.Key()]
+		if !ok {
+			*fields = append(*fields, FieldDiff{Path: strings.Join(path, "."), Kind: ChangeRemoved, Old: oldValue})
+			continue
+		}
+		if err = diffValues(oldValue, newValue, path, dc, fields); err != nil {
+			return err
+		}
+	}
+	for _, elem := range elemsB {
+		path := append(append([]string{}, prefix...), elem.Key())
+		if !seen[elem.Key()] && !dc.ignored(path) {
+			*fields = append(*fields, FieldDiff{Path: strings.Join(path, "."), Kind: ChangeAdded, New: elem.Value()})
+		}
+	}
+	return nil
+}
+
+// diffValues appends the differences between two values of the same field to fields, recursing
+// into embedded documents and arrays
+func diffValues(oldValue, newValue bson.RawValue, path []string, dc *diffConfig, fields *[]FieldDiff) error {
+	if oldValue.Type == newValue.Type {
+		switch oldValue.Type {
+		case bsontype.EmbeddedDocument:
+			return diffDocuments(oldValue.Document(), newValue.Document(), path, dc, fields)
+		case bsontype.Array:
+			return diffDocuments(bson.Raw(oldValue.Array()), bson.Raw(newValue.Array()), path, dc, fields)
+		}
+		if bytes.Equal(oldValue.Value, newValue.Value) {
+			return nil
+		}
+	}
+	*fields = append(*fields, FieldDiff{Path: strings.Join(path, "."), Kind: ChangeModified, Old: oldValue, New: newValue})
+	return nil
+}
@@ -1,6 +1,12 @@
 package mongotest
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	docker "github.com/docker/docker/client"
+)
 
 var (
 	// ErrFailedToConnectToDockerDaemon denotes that we couldn't connect to the docker daemon
@@ -10,17 +16,148 @@ var (
 	ErrNoAvailablePorts = errors.New("no ports are available to bind the docker mongo instance to")
 	// ErrMongoContainerAlreadyRunning
 	ErrMongoContainerAlreadyRunning = errors.New("the mongo container is already running - an attempt was made to call it a second time")
+	// ErrContainerPathIsDirectory denotes that a single file was requested from the container, but
+	// the path pointed at a directory
+	ErrContainerPathIsDirectory = errors.New("the requested container path is a directory")
+	// ErrContainerPathIsNotDirectory denotes that a directory was requested from the container, but
+	// the path pointed at something else
+	ErrContainerPathIsNotDirectory = errors.New("the requested container path is not a directory")
+
+	// ErrImagePull denotes that the mongo image could not be pulled
+	ErrImagePull = errors.New("could not pull the mongo image")
+	// ErrContainerCreate denotes that the mongo container could not be created
+	ErrContainerCreate = errors.New("could not create the mongo container")
+	// ErrContainerStart denotes that the mongo container was created, but could not be started
+	ErrContainerStart = errors.New("could not start the mongo container")
+	// ErrReadiness denotes that mongod never started responding inside the container
+	ErrReadiness = errors.New("mongo did not become ready")
+	// ErrReplicaSetInit denotes that the container could not be made into a replica set
+	ErrReplicaSetInit = errors.New("could not initialize the replica set")
+	// ErrExec denotes that a command could not be executed inside the container
+	ErrExec = errors.New("could not execute the command in the mongo container")
+	// ErrExport denotes that data could not be exported from the database
+	ErrExport = errors.New("could not export data from the database")
+	// ErrImport denotes that data could not be imported into the database
+	ErrImport = errors.New("could not import data into the database")
+	// ErrDump denotes that a snapshot of the database could not be taken
+	ErrDump = errors.New("could not dump the database")
+	// ErrRestore denotes that a snapshot could not be restored into the database
+	ErrRestore = errors.New("could not restore the database")
+	// ErrReset denotes that the data in the database could not be reset
+	ErrReset = errors.New("could not reset the database")
 )
 
+// Phase identifies the step of working with a mongo container in which an error occurred
+type Phase string
+
+const (
+	PhaseImagePull       Phase = "image pull"
+	PhaseContainerCreate Phase = "container create"
+	PhaseContainerStart  Phase = "container start"
+	PhaseReadiness       Phase = "readiness"
+	PhaseReplicaSetInit  Phase = "replica set init"
+	PhaseExec            Phase = "exec"
+	PhaseExport          Phase = "export"
+	PhaseImport          Phase = "import"
+	PhaseDump            Phase = "dump"
+	PhaseRestore         Phase = "restore"
+	PhaseReset           Phase = "reset"
+)
+
+// phaseSentinels maps each Phase to the sentinel error matched by errors.Is
+var phaseSentinels = map[Phase]error{
+	PhaseImagePull:       ErrImagePull,
+	PhaseContainerCreate: ErrContainerCreate,
+	PhaseContainerStart:  ErrContainerStart,
+	PhaseReadiness:       ErrReadiness,
+	PhaseReplicaSetInit:  ErrReplicaSetInit,
+	PhaseExec:            ErrExec,
+	PhaseExport:          ErrExport,
+	PhaseImport:          ErrImport,
+	PhaseDump:            ErrDump,
+	PhaseRestore:         ErrRestore,
+	PhaseReset:           ErrReset,
+}
+
+// MongoTestError is returned whenever something goes wrong working with a mongo container.
+// It matches the sentinel error for its Phase using errors.Is (e.g. ErrReadiness), as well as
+// ErrFailedToConnectToDockerDaemon if the docker daemon could not be reached. This allows, for
+// example, skipping tests when docker is unavailable while still failing them if mongod crashed:
+//
+//	if errors.Is(err, mongotest.ErrFailedToConnectToDockerDaemon) {
+//		t.Skip("docker is not available")
+//	}
 type MongoTestError struct {
-	err error
+	// Phase is the step in which the error occurred
+	Phase Phase
+	// ContainerID is the ID of the mongo container, if one had been created
+	ContainerID string
+	// Image is the docker image the container was created from
+	Image string
+	// Port is the host port mongo is bound to
+	Port int
+	// Logs are the last lines logged by mongod, when they were available
+	Logs []string
+	// Err is the underlying cause
+	Err error
 }
 
+// NewMongoTestError wraps err in a MongoTestError which isn't tied to any Phase
 func NewMongoTestError(err error) *MongoTestError {
 	return &MongoTestError{
-		err: err,
+		Err: err,
+	}
+}
+
+// newError wraps err in a MongoTestError describing the container tc is running
+func (tc *TestConnection) newError(phase Phase, err error) *MongoTestError {
+	return &MongoTestError{
+		Phase:       phase,
+		ContainerID: tc.mongoContainerID,
+		Image:       tc.mongoImage,
+		Port:        tc.portNumber,
+		Err:         err,
 	}
 }
+
+func (mte *MongoTestError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("mongotest")
+	if len(mte.Phase) != 0 {
+		fmt.Fprintf(&sb, ": %s failed", mte.Phase)
+	}
+	details := []string{}
+	if len(mte.ContainerID) != 0 {
+		details = append(details, "container="+mte.ContainerID)
+	}
+	if len(mte.Image) != 0 {
+		details = append(details, "image="+mte.Image)
+	}
+	if mte.Port != 0 {
+		details = append(details, fmt.Sprintf("port=%d", mte.Port))
+	}
+	if len(details) != 0 {
+		fmt.Fprintf(&sb, " (%s)", strings.Join(details, " "))
+	}
+	if mte.Err != nil {
+		fmt.Fprintf(&sb, ": %v", mte.Err)
+	}
+	if len(mte.Logs) != 0 {
+		sb.WriteString("\nlast mongod log lines:\n")
+		sb.WriteString(strings.Join(mte.Logs, "\n"))
+	}
+	return sb.String()
+}
+
 func (mte *MongoTestError) Unwrap() error {
-	return mte.err
+	return mte.Err
+}
+
+// Is reports whether target is the sentinel error for this error's Phase, or whether target is
+// ErrFailedToConnectToDockerDaemon and the docker daemon could not be reached.
+func (mte *MongoTestError) Is(target error) bool {
+	if sentinel, ok := phaseSentinels[mte.Phase]; ok && target == sentinel {
+		return true
+	}
+	return target == ErrFailedToConnectToDockerDaemon && mte.Err != nil && docker.IsErrConnectionFailed(mte.Err)
 }
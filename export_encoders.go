@@ -0,0 +1,288 @@
+package mongotest
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tophergopher/mongotest/internal/bsonvalue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// documentEncoder writes documents read through the driver in one of the ExportFormats, producing
+// the same output as the equivalent mongoexport options
+type documentEncoder interface {
+	Encode(doc bson.Raw) error
+	// Close writes anything still pending (e.g. the end of a JSON array). It does not close the
+	// underlying writer.
+	Close() error
+}
+
+// jsonStyle configures how documents are written as Extended JSON
+type jsonStyle struct {
+	// relaxed writes Relaxed rather than Canonical Extended JSON
+	relaxed bool
+	// pretty indents each document
+	pretty bool
+}
+
+func (style jsonStyle) marshal(doc bson.Raw) ([]byte, error) {
+	if style.pretty {
+		return bson.MarshalExtJSONIndent(doc, !style.relaxed, false, "", "\t")
+	}
+	return bson.MarshalExtJSON(doc, !style.relaxed, false)
+}
+
+// newDocumentEncoder returns an encoder writing format to w. fields are the CSV columns and are
+// ignored for JSON formats.
+func newDocumentEncoder(w io.Writer, format ExportFormat, fields []string, style jsonStyle) documentEncoder {
+	switch format {
+	case ExportJSONArray:
+		return &jsonArrayEncoder{w: w, style: style}
+	case ExportCSV:
+		return &csvEncoder{w: csv.NewWriter(w), fields: fields}
+	default:
+		return &jsonLinesEncoder{w: w, style: style}
+	}
+}
+
+// exportFileExtension returns the extension used for files written in format
+func exportFileExtension(format ExportFormat) string {
+	if format == ExportCSV {
+		return ".csv"
+	}
+	return ".json"
+}
+
+// jsonLinesEncoder writes one Extended JSON document per line
+type jsonLinesEncoder struct {
+	w     io.Writer
+	style jsonStyle
+}
+
+func (e *jsonLinesEncoder) Encode(doc bson.Raw) error {
+	out, err := e.style.marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(out, '\n'))
+	return err
+}
+
+func (e *jsonLinesEncoder) Close() error {
+	return nil
+}
+
+// jsonArrayEncoder writes a JSON array of Extended JSON documents
+type jsonArrayEncoder struct {
+	w       io.Writer
+	style   jsonStyle
+	started bool
+}
+
+func (e *jsonArrayEncoder) Encode(doc bson.Raw) error {
+	out, err := e.style.marshal(doc)
+	if err != nil {
+		return err
+	}
+	prefix := ","
+	if !e.started {
+		prefix = "["
+		e.started = true
+	}
+	_, err = io.WriteString(e.w, prefix+string(out))
+	return err
+}
+
+func (e *jsonArrayEncoder) Close() error {
+	if !e.started {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// csvEncoder writes a header line followed by one row per document. Fields may be dotted paths
+// into embedded documents.
+type csvEncoder struct {
+	w             *csv.Writer
+	fields        []string
+	headerWritten bool
+}
+
+func (e *csvEncoder) Encode(doc bson.Raw) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	row := make([]string, len(e.fields))
+	for i, field := range e.fields {
+		value, err := doc.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			// Missing fields are left blank, as mongoexport does
+			continue
+		}
+		if row[i], err = csvValue(value); err != nil {
+			return fmt.Errorf("could not encode field '%s': %w", field, err)
+		}
+	}
+	return e.w.Write(row)
+}
+
+func (e *csvEncoder) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) writeHeader() error {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+	return e.w.Write(e.fields)
+}
+
+// csvValue formats a single BSON value the same way mongoexport does for CSV output
+func csvValue(value bson.RawValue) (string, error) {
+	switch value.Type {
+	case bsontype.String:
+		return value.StringValue(), nil
+	case bsontype.ObjectID:
+		return fmt.Sprintf("ObjectId(%s)", value.ObjectID().Hex()), nil
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10), nil
+	case bsontype.Int64:
+		return strconv.FormatInt(value.Int64(), 10), nil
+	case bsontype.Double:
+		return strconv.FormatFloat(value.Double(), 'g', -1, 64), nil
+	case bsontype.Decimal128:
+		return value.Decimal128().String(), nil
+	case bsontype.Boolean:
+		return strconv.FormatBool(value.Boolean()), nil
+	case bsontype.DateTime:
+		return value.Time().UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	case bsontype.Timestamp:
+		t, i := value.Timestamp()
+		return fmt.Sprintf("Timestamp(%d, %d)", t, i), nil
+	case bsontype.Null, bsontype.Undefined:
+		return "", nil
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		// Nested values are written as Extended JSON, as mongoexport does
+		return bsonvalue.ExtJSON(value, false)
+	default:
+		var v interface{}
+		if err := value.Unmarshal(&v); err != nil {
+			return "", err
+		}
+		return fmt.Sprint(v), nil
+	}
+}
+
+// collectFieldPaths returns the dotted path of every leaf value in the documents in coll matching
+// filter, sorted by sortFieldPaths
+func collectFieldPaths(ctx context.Context, coll *mongo.Collection, filter bson.D) ([]string, error) {
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	seen := map[string]bool{}
+	for cursor.Next(ctx) {
+		if err = addLeafPaths(seen, "", cursor.Current); err != nil {
+			return nil, err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sortFieldPaths(paths)
+	return paths, nil
+}
+
+// addLeafPaths adds the path of every non-document, non-array value in doc to seen. Empty
+// documents and arrays have no values to write, so they don't produce a path.
+func addLeafPaths(seen map[string]bool, prefix string, doc bson.Raw) error {
+	elems, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		p := elem.Key()
+		if len(prefix) != 0 {
+			p = prefix + "." + p
+		}
+		value := elem.Value()
+		switch value.Type {
+		case bsontype.EmbeddedDocument:
+			err = addLeafPaths(seen, p, value.Document())
+		case bsontype.Array:
+			err = addLeafPaths(seen, p, bson.Raw(value.Array()))
+		default:
+			seen[p] = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandFieldPaths replaces each requested field holding a nested value with the leaf paths
+// below it. Requested fields which weren't found are kept as-is.
+func expandFieldPaths(requested, paths []string) []string {
+	expanded := []string{}
+	for _, field := range requested {
+		field = strings.TrimSpace(field)
+		found := false
+		for _, p := range paths {
+			if p == field || strings.HasPrefix(p, field+".") {
+				expanded = append(expanded, p)
+				found = true
+			}
+		}
+		if !found {
+			expanded = append(expanded, field)
+		}
+	}
+	return expanded
+}
+
+// sortFieldPaths sorts dotted paths segment by segment, keeping _id first. Numeric segments
+// (array indexes) are compared numerically, so "tags.2" sorts before "tags.10".
+func sortFieldPaths(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		return fieldPathLess(paths[i], paths[j])
+	})
+}
+
+func fieldPathLess(a, b string) bool {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	if aParts[0] != bParts[0] && (aParts[0] == "_id" || bParts[0] == "_id") {
+		return aParts[0] == "_id"
+	}
+	for k := 0; k < len(aParts) && k < len(bParts); k++ {
+		if aParts[k] == bParts[k] {
+			continue
+		}
+		aNum, aErr := strconv.Atoi(aParts[k])
+		bNum, bErr := strconv.Atoi(bParts[k])
+		if aErr == nil && bErr == nil {
+			return aNum < bNum
+		}
+		return aParts[k] < bParts[k]
+	}
+	return len(aParts) < len(bParts)
+}
@@ -0,0 +1,150 @@
+package mongotest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fake value kinds understood by redaction rules, the anonymizer and the data generators
+const (
+	FakeName      = "name"
+	FakeFirstName = "firstName"
+	FakeLastName  = "lastName"
+	FakeEmail     = "email"
+	FakePhone     = "phone"
+	FakeAddress   = "address"
+	FakeCity      = "city"
+	FakeCompany   = "company"
+	FakeUsername  = "username"
+	FakeUUID      = "uuid"
+	FakeWord      = "word"
+	FakeSentence  = "sentence"
+)
+
+var (
+	fakeFirstNames = []string{
+		"Alex", "Blair", "Casey", "Dana", "Eden", "Frankie", "Gray", "Harper", "Indy", "Jordan",
+		"Kai", "Logan", "Morgan", "Noel", "Oakley", "Parker", "Quinn", "Riley", "Sage", "Taylor",
+		"Umi", "Val", "Wren", "Xen", "Yael", "Zion",
+	}
+	fakeLastNames = []string{
+		"Adams", "Brooks", "Carter", "Diaz", "Ellis", "Fischer", "Garcia", "Hughes", "Ito", "Jensen",
+		"Khan", "Lopez", "Murphy", "Nguyen", "Okafor", "Patel", "Quinn", "Rossi", "Silva", "Tanaka",
+		"Underwood", "Varga", "Walsh", "Xu", "Young", "Zhang",
+	}
+	fakeStreets = []string{
+		"Maple", "Oak", "Cedar", "Elm", "Pine", "Birch", "Willow", "Lake", "Hill", "River",
+	}
+	fakeStreetSuffixes = []string{"St", "Ave", "Rd", "Ln", "Way", "Ct"}
+	fakeCities         = []string{
+		"Springfield", "Riverton", "Fairview", "Greenville", "Franklin", "Clinton", "Salem",
+		"Madison", "Georgetown", "Arlington", "Ashland", "Dover",
+	}
+	fakeCompanySuffixes = []string{"Inc", "LLC", "Group", "Labs", "Co", "Partners"}
+	fakeWords           = []string{
+		"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet",
+		"kilo", "lima", "mike", "november", "oscar", "papa", "quebec", "romeo", "sierra", "tango",
+		"uniform", "victor", "whiskey", "xray", "yankee", "zulu",
+	}
+	fakeDomains = []string{"example.com", "example.org", "example.net"}
+)
+
+// fakeGenerators produce a fake value of each kind from a deterministic source
+var fakeGenerators = map[string]func(src *fakeSource) string{
+	FakeFirstName: func(src *fakeSource) string { return src.pick(fakeFirstNames) },
+	FakeLastName:  func(src *fakeSource) string { return src.pick(fakeLastNames) },
+	FakeName: func(src *fakeSource) string {
+		return src.pick(fakeFirstNames) + " " + src.pick(fakeLastNames)
+	},
+	FakeEmail: func(src *fakeSource) string {
+		return fmt.Sprintf("%s.%s%d@%s", strings.ToLower(src.pick(fakeFirstNames)),
+			strings.ToLower(src.pick(fakeLastNames)), src.intn(1000), src.pick(fakeDomains))
+	},
+	FakePhone: func(src *fakeSource) string {
+		return fmt.Sprintf("+1-555-%03d-%04d", src.intn(1000), src.intn(10000))
+	},
+	FakeAddress: func(src *fakeSource) string {
+		return fmt.Sprintf("%d %s %s", 1+src.intn(9999), src.pick(fakeStreets), src.pick(fakeStreetSuffixes))
+	},
+	FakeCity: func(src *fakeSource) string { return src.pick(fakeCities) },
+	FakeCompany: func(src *fakeSource) string {
+		return src.pick(fakeLastNames) + " " + src.pick(fakeCompanySuffixes)
+	},
+	FakeUsername: func(src *fakeSource) string {
+		return fmt.Sprintf("%s%d", strings.ToLower(src.pick(fakeWords)), src.intn(10000))
+	},
+	FakeUUID: func(src *fakeSource) string {
+		b := src.bytes(16)
+		// Version 4, variant 10
+		b[6] = (b[6] & 0x0f) | 0x40
+		b[8] = (b[8] & 0x3f) | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	},
+	FakeWord: func(src *fakeSource) string { return src.pick(fakeWords) },
+	FakeSentence: func(src *fakeSource) string {
+		words := make([]string, 4+src.intn(5))
+		for i := range words {
+			words[i] = src.pick(fakeWords)
+		}
+		sentence := strings.Join(words, " ")
+		return strings.ToUpper(sentence[:1]) + sentence[1:] + "."
+	},
+}
+
+// FakeKinds returns every fake value kind, sorted
+func FakeKinds() []string {
+	kinds := make([]string, 0, len(fakeGenerators))
+	for kind := range fakeGenerators {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// fakeValue returns a fake value of the given kind. The value is derived from seed, so the same
+// seed always produces the same value.
+func fakeValue(kind string, seed []byte) (string, error) {
+	generate, ok := fakeGenerators[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown fake value kind '%s' (expected one of %s)", kind, strings.Join(FakeKinds(), ", "))
+	}
+	return generate(newFakeSource(seed)), nil
+}
+
+// fakeSource is a deterministic stream of pseudo-random bytes derived from a seed, by hashing
+// the seed with an incrementing counter
+type fakeSource struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func newFakeSource(seed []byte) *fakeSource {
+	return &fakeSource{seed: seed}
+}
+
+// bytes returns the next n bytes of the stream
+func (src *fakeSource) bytes(n int) []byte {
+	for len(src.buf) < n {
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], src.counter)
+		src.counter++
+		sum := sha256.Sum256(append(append([]byte{}, src.seed...), counter[:]...))
+		src.buf = append(src.buf, sum[:]...)
+	}
+	out := src.buf[:n]
+	src.buf = src.buf[n:]
+	return out
+}
+
+// intn returns a number in [0, n)
+func (src *fakeSource) intn(n int) int {
+	return int(binary.BigEndian.Uint64(src.bytes(8)) % uint64(n))
+}
+
+func (src *fakeSource) pick(options []string) string {
+	return options[src.intn(len(options))]
+}
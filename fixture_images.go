@@ -0,0 +1,195 @@
+package mongotest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+)
+
+const (
+	// fixtureImageRepository is the local repository fixture images are committed to
+	fixtureImageRepository = "mongotest-fixtures"
+	// fixtureImageLabelKey and fixtureImageLabelValue mark images created by NewTestConnectionFromFixtureImage
+	fixtureImageLabelKey   = "mongotest"
+	fixtureImageLabelValue = "fixture-image"
+	// fixtureImageDBPath is where mongod keeps its data in fixture images. The official mongo
+	// image declares /data/db as a VOLUME, and volumes are not included by docker commit - so the
+	// data has to live somewhere else to survive the commit.
+	fixtureImageDBPath = "/data/mongotest"
+	// mongodbUID is the uid (and gid) of the mongodb user in the official mongo image
+	mongodbUID = 999
+	// fixtureImageStopTimeout is how long mongod is given to shut down cleanly before the commit
+	fixtureImageStopTimeout = 30 * time.Second
+)
+
+// FixtureImage describes a data set which is seeded once, committed into a local docker image
+// and then reused by every TestConnection started from it. The image is tagged with a hash of
+// the fixture files, Version, and the mongo image, so it is rebuilt whenever any of them change.
+type FixtureImage struct {
+	// FS holds the fixture files. Every file below Root contributes to the image hash.
+	FS fs.FS
+	// Root is the fixture directory within FS
+	Root string
+	// Seed loads the fixtures into a fresh container. Defaults to LoadFixtures(FS, Root).
+	Seed func(tc *TestConnection) error
+	// Version should be bumped whenever Seed changes in a way the fixture files don't capture
+	Version string
+}
+
+// NewTestConnectionFromFixtureImage spawns a mongo container which already contains the data
+// described by fi. The first call on a system seeds a container, commits it into a local image
+// and removes the seed container - subsequent calls start straight from that image, skipping
+// the (potentially slow) seeding. Use PruneFixtureImages to clean up the images afterwards.
+func NewTestConnectionFromFixtureImage(fi FixtureImage, opts ...Option) (*TestConnection, error) {
+	tc := &TestConnection{
+		logger:       defaultLogger(),
+		mongoVersion: "latest",
+	}
+	for _, opt := range opts {
+		opt(tc)
+	}
+	if err := tc.initDocker(); err != nil {
+		return nil, err
+	}
+	imageTag, err := tc.fixtureImageTag(fi)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, withDBPath(fixtureImageDBPath))
+	if _, _, err = tc.dockerClient.ImageInspectWithRaw(context.Background(), imageTag); err == nil {
+		tc.logger.Debug("Starting from existing fixture image", Fields{"image": imageTag})
+		return NewTestConnection(true, append(opts, withImage(imageTag))...)
+	} else if !docker.IsErrNotFound(err) {
+		return nil, tc.newError(PhaseContainerCreate, err)
+	}
+	if err = buildFixtureImage(fi, imageTag, opts...); err != nil {
+		return nil, err
+	}
+	return NewTestConnection(true, append(opts, withImage(imageTag))...)
+}
+
+// PruneFixtureImages removes every image created by NewTestConnectionFromFixtureImage
+func PruneFixtureImages(ctx context.Context) error {
+	tc := &TestConnection{logger: defaultLogger()}
+	if err := tc.initDocker(); err != nil {
+		return err
+	}
+	images, err := tc.dockerClient.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", fixtureImageLabelKey+"="+fixtureImageLabelValue)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list fixture images: %w", err)
+	}
+	for _, image := range images {
+		if _, err = tc.dockerClient.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{
+			Force:         true,
+			PruneChildren: true,
+		}); err != nil && !docker.IsErrNotFound(err) {
+			return fmt.Errorf("could not remove fixture image %s: %w", image.ID, err)
+		}
+		tc.logger.Info("Removed fixture image", Fields{"image": image.ID, "tags": image.RepoTags})
+	}
+	return nil
+}
+
+// buildFixtureImage seeds a fresh container, stops it so mongod flushes everything to disk,
+// and commits it as imageTag
+func buildFixtureImage(fi FixtureImage, imageTag string, opts ...Option) error {
+	seedConn, err := NewTestConnection(true, opts...)
+	if err != nil {
+		return err
+	}
+	defer seedConn.KillMongoContainer()
+	seedConn.logger.Info("Seeding fixture image", Fields{"image": imageTag})
+	seed := fi.Seed
+	if seed == nil {
+		seed = func(tc *TestConnection) error {
+			return tc.LoadFixtures(fi.FS, fi.Root)
+		}
+	}
+	if err = seed(seedConn); err != nil {
+		return fmt.Errorf("could not seed fixture image %s: %w", imageTag, err)
+	}
+	ctx := context.Background()
+	stopTimeout := fixtureImageStopTimeout
+	if err = seedConn.dockerClient.ContainerStop(ctx, seedConn.mongoContainerID, &stopTimeout); err != nil {
+		return seedConn.newError(PhaseContainerStart, fmt.Errorf("could not stop seeded container: %w", err))
+	}
+	if _, err = seedConn.dockerClient.ContainerCommit(ctx, seedConn.mongoContainerID, types.ContainerCommitOptions{
+		Reference: imageTag,
+		Comment:   "mongotest fixture image",
+		Changes:   []string{fmt.Sprintf("LABEL %s=%s", fixtureImageLabelKey, fixtureImageLabelValue)},
+	}); err != nil {
+		return seedConn.newError(PhaseContainerCreate, fmt.Errorf("could not commit fixture image: %w", err))
+	}
+	seedConn.logger.Info("Committed fixture image", Fields{"image": imageTag})
+	return nil
+}
+
+// fixtureImageTag returns the image tag for fi, pulling the base mongo image if needed so
+// its ID can be included in the hash
+func (tc *TestConnection) fixtureImageTag(fi FixtureImage) (string, error) {
+	baseImage := mongoImageForVersion(tc.mongoVersion)
+	if len(tc.imageOverride) != 0 {
+		baseImage = tc.imageOverride
+	}
+	inspect, _, err := tc.dockerClient.ImageInspectWithRaw(context.Background(), baseImage)
+	if docker.IsErrNotFound(err) {
+		if err = tc.pullMongoContainer(baseImage); err != nil {
+			return "", err
+		}
+		inspect, _, err = tc.dockerClient.ImageInspectWithRaw(context.Background(), baseImage)
+	}
+	if err != nil {
+		return "", tc.newError(PhaseImagePull, err)
+	}
+	sum, err := fixtureHash(fi, baseImage, inspect.ID)
+	if err != nil {
+		return "", err
+	}
+	return fixtureImageRepository + ":" + sum[:16], nil
+}
+
+// fixtureHash hashes every file below fi.Root along with fi.Version and the base image
+func fixtureHash(fi FixtureImage, baseImage, baseImageID string) (string, error) {
+	h := sha256.New()
+	writeHashField(h, "version", fi.Version)
+	writeHashField(h, "image", baseImage)
+	writeHashField(h, "imageID", baseImageID)
+	writeHashField(h, "dbPath", fixtureImageDBPath)
+	if fi.FS != nil {
+		// WalkDir visits entries in lexical order, so the hash is stable
+		err := fs.WalkDir(fi.FS, fi.Root, func(fpath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			contents, err := fs.ReadFile(fi.FS, fpath)
+			if err != nil {
+				return err
+			}
+			writeHashField(h, "file", fpath)
+			writeHashField(h, "contents", string(contents))
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not hash fixtures in '%s': %w", fi.Root, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeHashField writes a length-prefixed field so adjacent values can't run together
+func writeHashField(h hash.Hash, name, value string) {
+	fmt.Fprintf(h, "%s:%d:%s\n", name, len(value), value)
+}
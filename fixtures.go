@@ -0,0 +1,379 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// fixtureInsertBatchSize is the number of documents inserted per InsertMany call
+const fixtureInsertBatchSize = 1000
+
+// namespaceExistsCode is the server error code returned when creating a collection that exists
+const namespaceExistsCode = 48
+
+const (
+	fixtureIndexesSuffix  = ".indexes.json"
+	fixtureOptionsSuffix  = ".options.json"
+	fixtureMetadataSuffix = ".metadata.json"
+)
+
+// fixtureDataExtensions are the data file extensions understood by LoadFixtures
+var fixtureDataExtensions = []string{".json", ".ndjson", ".csv", ".bson"}
+
+// collectionFixture gathers the files found for a single collection
+type collectionFixture struct {
+	dataFiles    []string
+	indexesFile  string
+	optionsFile  string
+	metadataFile string
+}
+
+// LoadFixtures loads every fixture found below root in fsys, which is expected to be laid out as
+//
+//	<root>/<db>/<collection>.json      - a JSON array or one Extended JSON document per line
+//	<root>/<db>/<collection>.ndjson    - one Extended JSON document per line
+//	<root>/<db>/<collection>.csv       - CSV with a header line
+//	<root>/<db>/<collection>.bson      - BSON documents, as written by mongodump
+//
+// Optional sidecar files configure the collection:
+//
+//	<root>/<db>/<collection>.options.json - options passed to the create command (e.g. capped, validator)
+//	<root>/<db>/<collection>.indexes.json - a JSON array of index specs, as returned by listIndexes
+//
+// The <collection>.metadata.json files written by mongodump alongside .bson files are read for
+// the options and indexes of collections which don't have the sidecars above.
+//
+// fsys can be an embed.FS, so fixtures can ship with the test binary:
+//
+//	//go:embed testdata/fixtures
+//	var fixtures embed.FS
+//	...
+//	err := conn.LoadFixtures(fixtures, "testdata/fixtures")
+func (tc *TestConnection) LoadFixtures(fsys fs.FS, root string) error {
+	dbEntries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return fmt.Errorf("could not read fixture directory '%s': %w", root, err)
+	}
+	for _, dbEntry := range dbEntries {
+		if !dbEntry.IsDir() {
+			continue
+		}
+		dbName := dbEntry.Name()
+		fixtures, err := findCollectionFixtures(fsys, path.Join(root, dbName))
+		if err != nil {
+			return err
+		}
+		collNames := make([]string, 0, len(fixtures))
+		for collName := range fixtures {
+			collNames = append(collNames, collName)
+		}
+		sort.Strings(collNames)
+		for _, collName := range collNames {
+			if err = tc.loadCollectionFixture(fsys, dbName, collName, fixtures[collName]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findCollectionFixtures groups the fixture files found in dbDir by collection
+func findCollectionFixtures(fsys fs.FS, dbDir string) (map[string]*collectionFixture, error) {
+	entries, err := fs.ReadDir(fsys, dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read fixture directory '%s': %w", dbDir, err)
+	}
+	fixtures := map[string]*collectionFixture{}
+	get := func(collName string) *collectionFixture {
+		if _, ok := fixtures[collName]; !ok {
+			fixtures[collName] = &collectionFixture{}
+		}
+		return fixtures[collName]
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		fpath := path.Join(dbDir, name)
+		switch {
+		case strings.HasSuffix(name, fixtureIndexesSuffix):
+			get(strings.TrimSuffix(name, fixtureIndexesSuffix)).indexesFile = fpath
+		case strings.HasSuffix(name, fixtureOptionsSuffix):
+			get(strings.TrimSuffix(name, fixtureOptionsSuffix)).optionsFile = fpath
+		case strings.HasSuffix(name, fixtureMetadataSuffix):
+			get(strings.TrimSuffix(name, fixtureMetadataSuffix)).metadataFile = fpath
+		default:
+			ext := path.Ext(name)
+			for _, dataExt := range fixtureDataExtensions {
+				if ext == dataExt {
+					fixture := get(strings.TrimSuffix(name, ext))
+					fixture.dataFiles = append(fixture.dataFiles, fpath)
+				}
+			}
+		}
+	}
+	return fixtures, nil
+}
+
+// loadCollectionFixture creates the collection, loads its data and then builds its indexes
+func (tc *TestConnection) loadCollectionFixture(fsys fs.FS, dbName, collName string, fixture *collectionFixture) error {
+	ctx := context.Background()
+	db := tc.MongoDriverClient().Database(dbName)
+	// mongodump metadata supplies the options and indexes, unless sidecars override them
+	var metadata dumpMetadata
+	var err error
+	if len(fixture.metadataFile) != 0 {
+		if metadata, err = readDumpMetadata(fsys, fixture.metadataFile); err != nil {
+			return err
+		}
+	}
+	optionsFile, collOpts := fixture.metadataFile, metadata.Options
+	if len(fixture.optionsFile) != 0 {
+		optionsFile = fixture.optionsFile
+		if collOpts, err = readExtJSONDocument(fsys, fixture.optionsFile); err != nil {
+			return err
+		}
+	}
+	if len(optionsFile) != 0 {
+		if err = createCollection(ctx, db, collName, collOpts); err != nil {
+			return fmt.Errorf("could not create collection from '%s': %w", optionsFile, err)
+		}
+	}
+	for _, dataFile := range fixture.dataFiles {
+		if err = tc.loadFixtureFile(ctx, fsys, db.Collection(collName), dataFile); err != nil {
+			return fmt.Errorf("could not load fixture '%s': %w", dataFile, err)
+		}
+	}
+	indexesFile, indexes := fixture.metadataFile, metadata.Indexes
+	if len(fixture.indexesFile) != 0 {
+		indexesFile = fixture.indexesFile
+		if indexes, err = readExtJSONArray(fsys, fixture.indexesFile); err != nil {
+			return err
+		}
+	}
+	if err = createIndexes(ctx, db, collName, indexes); err != nil {
+		return fmt.Errorf("could not create indexes from '%s': %w", indexesFile, err)
+	}
+	return nil
+}
+
+// dumpMetadata is the part of a mongodump <collection>.metadata.json file used by LoadFixtures
+type dumpMetadata struct {
+	Options bson.D   `bson:"options"`
+	Indexes []bson.D `bson:"indexes"`
+}
+
+// readDumpMetadata reads a mongodump metadata file from fpath
+func readDumpMetadata(fsys fs.FS, fpath string) (dumpMetadata, error) {
+	var metadata dumpMetadata
+	data, err := fs.ReadFile(fsys, fpath)
+	if err != nil {
+		return metadata, err
+	}
+	if err = bson.UnmarshalExtJSON(data, false, &metadata); err != nil {
+		return metadata, fmt.Errorf("could not parse '%s': %w", fpath, err)
+	}
+	return metadata, nil
+}
+
+// loadFixtureFile inserts the documents in a single data file into coll
+func (tc *TestConnection) loadFixtureFile(ctx context.Context, fsys fs.FS, coll *mongo.Collection, fpath string) error {
+	data, err := fs.ReadFile(fsys, fpath)
+	if err != nil {
+		return err
+	}
+	var docs []interface{}
+	switch path.Ext(fpath) {
+	case ".csv":
+		_, err = tc.DatabaseImporter(coll.Database().Name(), coll.Name()).CSV().HeaderLine().
+			UseArrayIndexFields().StopOnError().FromReader(bytes.NewReader(data))
+		return err
+	case ".bson":
+		docs, err = decodeBSONFixture(data)
+	case ".ndjson":
+		docs, err = decodeNDJSONFixture(data)
+	default:
+		docs, err = decodeJSONFixture(data)
+	}
+	if err != nil {
+		return err
+	}
+	return insertInBatches(ctx, coll, docs)
+}
+
+// insertInBatches inserts docs into coll, fixtureInsertBatchSize documents at a time
+func insertInBatches(ctx context.Context, coll *mongo.Collection, docs []interface{}) error {
+	for start := 0; start < len(docs); start += fixtureInsertBatchSize {
+		end := start + fixtureInsertBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		if _, err := coll.InsertMany(ctx, docs[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeJSONFixture decodes either a JSON array of documents or one document per line
+func decodeJSONFixture(data []byte) ([]interface{}, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return decodeNDJSONFixture(data)
+	}
+	return decodeExtJSONArray(trimmed)
+}
+
+// decodeExtJSONArray decodes a JSON array of Extended JSON documents
+func decodeExtJSONArray(data []byte) ([]interface{}, error) {
+	// Extended JSON can only be unmarshalled into a document, so wrap the array in one
+	wrapped := append(append([]byte(`{"docs":`), data...), '}')
+	var wrapper struct {
+		Docs []bson.D `bson:"docs"`
+	}
+	if err := bson.UnmarshalExtJSON(wrapped, false, &wrapper); err != nil {
+		return nil, fmt.Errorf("could not parse JSON array: %w", err)
+	}
+	docs := make([]interface{}, 0, len(wrapper.Docs))
+	for _, doc := range wrapper.Docs {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// decodeNDJSONFixture decodes one Extended JSON document per line
+func decodeNDJSONFixture(data []byte) ([]interface{}, error) {
+	docs := []interface{}{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			return nil, fmt.Errorf("could not parse line %d: %w", i+1, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// decodeBSONFixture splits concatenated BSON documents, as written by mongodump
+func decodeBSONFixture(data []byte) ([]interface{}, error) {
+	docs := []interface{}{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated BSON document")
+		}
+		docLen := int(binary.LittleEndian.Uint32(data[:4]))
+		if docLen < 5 || docLen > len(data) {
+			return nil, errors.New("truncated BSON document")
+		}
+		doc := bson.Raw(data[:docLen])
+		if err := doc.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid BSON document: %w", err)
+		}
+		docs = append(docs, doc)
+		data = data[docLen:]
+	}
+	return docs, nil
+}
+
+// readExtJSONDocument reads a single Extended JSON document from fpath
+func readExtJSONDocument(fsys fs.FS, fpath string) (bson.D, error) {
+	data, err := fs.ReadFile(fsys, fpath)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err = bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %w", fpath, err)
+	}
+	return doc, nil
+}
+
+// readExtJSONArray reads a JSON array of Extended JSON documents from fpath
+func readExtJSONArray(fsys fs.FS, fpath string) ([]bson.D, error) {
+	data, err := fs.ReadFile(fsys, fpath)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := decodeExtJSONArray(bytes.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %w", fpath, err)
+	}
+	specs := make([]bson.D, 0, len(docs))
+	for _, doc := range docs {
+		specs = append(specs, doc.(bson.D))
+	}
+	return specs, nil
+}
+
+// createCollection runs the create command with the provided options. It is not an error
+// for the collection to already exist.
+func createCollection(ctx context.Context, db *mongo.Database, collName string, collOpts bson.D) error {
+	cmd := append(bson.D{{Key: "create", Value: collName}}, collOpts...)
+	err := db.RunCommand(ctx, cmd).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == namespaceExistsCode {
+		return nil
+	}
+	return err
+}
+
+// createIndexes builds the provided index specs. Specs can be copied straight from the output
+// of listIndexes - the default _id index is skipped and a name is generated for specs without one.
+func createIndexes(ctx context.Context, db *mongo.Database, collName string, specs []bson.D) error {
+	indexes := bson.A{}
+	for _, spec := range specs {
+		if name, _ := spec.Map()["name"].(string); name == "_id_" {
+			continue
+		}
+		cleaned := bson.D{}
+		hasName := false
+		var keys bson.D
+		for _, elem := range spec {
+			switch elem.Key {
+			case "v", "ns":
+				// Server managed fields which can't be passed back to createIndexes
+				continue
+			case "name":
+				hasName = true
+			case "key":
+				keys, _ = elem.Value.(bson.D)
+			}
+			cleaned = append(cleaned, elem)
+		}
+		if !hasName {
+			cleaned = append(cleaned, bson.E{Key: "name", Value: indexName(keys)})
+		}
+		indexes = append(indexes, cleaned)
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	return db.RunCommand(ctx, bson.D{
+		{Key: "createIndexes", Value: collName},
+		{Key: "indexes", Value: indexes},
+	}).Err()
+}
+
+// indexName generates an index name the same way the server does (e.g. "name_1_age_-1")
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
@@ -0,0 +1,545 @@
+package mongotest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// generateEpoch is the latest date generated, so generated dates don't depend on the clock
+var generateEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// fakerKinds maps the hints used by faker-style struct tags to fake value kinds
+var fakerKinds = map[string]string{
+	"name":            FakeName,
+	"first_name":      FakeFirstName,
+	"last_name":       FakeLastName,
+	"email":           FakeEmail,
+	"phone_number":    FakePhone,
+	"toll_free_phone": FakePhone,
+	"e_164_phone":     FakePhone,
+	"address":         FakeAddress,
+	"city":            FakeCity,
+	"company":         FakeCompany,
+	"username":        FakeUsername,
+	"uuid_hyphenated": FakeUUID,
+	"uuid_digit":      FakeUUID,
+	"word":            FakeWord,
+	"sentence":        FakeSentence,
+}
+
+// fieldNameKinds are the fake value kinds used for string fields without a hint, keyed by the
+// lowercased field name without separators
+var fieldNameKinds = map[string]string{
+	"name":        FakeName,
+	"fullname":    FakeName,
+	"firstname":   FakeFirstName,
+	"givenname":   FakeFirstName,
+	"lastname":    FakeLastName,
+	"surname":     FakeLastName,
+	"familyname":  FakeLastName,
+	"email":       FakeEmail,
+	"emailaddr":   FakeEmail,
+	"phone":       FakePhone,
+	"phonenumber": FakePhone,
+	"address":     FakeAddress,
+	"street":      FakeAddress,
+	"city":        FakeCity,
+	"company":     FakeCompany,
+	"username":    FakeUsername,
+	"login":       FakeUsername,
+	"uuid":        FakeUUID,
+	"description": FakeSentence,
+	"comment":     FakeSentence,
+	"title":       FakeSentence,
+}
+
+// FieldGenerator returns the value of a field in the i'th generated document. rnd is seeded from
+// the generator's seed, the document and the field, so it can be used for deterministic values.
+type FieldGenerator func(i int, rnd *rand.Rand) interface{}
+
+// GenerateOption configures Generate, InsertGenerated and GenerateFromValidator
+type GenerateOption func(gc *generateConfig)
+
+type generateConfig struct {
+	fields     map[string]FieldGenerator
+	violations int
+	// err is the first invalid option, returned when generating
+	err error
+}
+
+// WithFieldGenerator overrides the values generated for the field at path, using the BSON field
+// names (e.g. "address.city"). The value must be assignable to the field, except that numbers
+// are converted when they fit and values of named types are converted to the same kind (e.g. a
+// string for a `type Status string` field).
+func WithFieldGenerator(path string, generate FieldGenerator) GenerateOption {
+	return func(gc *generateConfig) {
+		gc.fields[path] = generate
+	}
+}
+
+// WithFieldValues cycles through values for the field at path, e.g. to spread documents across
+// a few known tenants
+func WithFieldValues(path string, values ...interface{}) GenerateOption {
+	if len(values) == 0 {
+		return func(gc *generateConfig) {
+			if gc.err == nil {
+				gc.err = fmt.Errorf("field %s: WithFieldValues needs at least one value", path)
+			}
+		}
+	}
+	return WithFieldGenerator(path, func(i int, _ *rand.Rand) interface{} {
+		return values[i%len(values)]
+	})
+}
+
+// WithFieldSequence numbers the field at path (e.g. "user-%d" gives user-1, user-2, ...), which
+// is useful for fields with unique indexes
+func WithFieldSequence(path, format string) GenerateOption {
+	return WithFieldGenerator(path, func(i int, _ *rand.Rand) interface{} {
+		return fmt.Sprintf(format, i+1)
+	})
+}
+
+// Generate returns n realistic values of the struct T, derived from seed. The same seed always
+// generates the same values, so failing tests can be reproduced. Values are chosen from each
+// field's type and BSON name (e.g. an "email" string gets an email address), and can be steered
+// with faker-style `faker` struct tags:
+//
+//	type User struct {
+//		ID      primitive.ObjectID `bson:"_id"`
+//		Handle  string             `bson:"handle" faker:"username"`
+//		Plan    string             `bson:"plan" faker:"oneof: free, pro, team"`
+//		Age     int                `bson:"age" faker:"boundary_start=18, boundary_end=90"`
+//		Tags    []string           `bson:"tags" faker:"len=3"`
+//		Secrets string             `bson:"secrets" faker:"-"`
+//	}
+//
+//	users, err := mongotest.Generate[User](42, 100, mongotest.WithFieldSequence("handle", "user%d"))
+//
+// The hints are the fake value kinds (see FakeKinds) and their faker names (e.g. "first_name"),
+// "oneof: a, b", "boundary_start=<n>, boundary_end=<n>", "len=<n>" and "-" to leave the field
+// empty. Other hints are ignored. Interface and raw document fields are left empty, as are
+// pointers, slices and maps of a struct already being generated (e.g. `Manager *User` in User).
+func Generate[T any](seed int64, n int, opts ...GenerateOption) ([]T, error) {
+	gc := &generateConfig{fields: map[string]FieldGenerator{}}
+	for _, opt := range opts {
+		opt(gc)
+	}
+	if gc.err != nil {
+		return nil, gc.err
+	}
+	valueType := reflect.TypeOf((*T)(nil)).Elem()
+	structType := valueType
+	for structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("only structs can be generated, not %s", valueType)
+	}
+	values := make([]T, n)
+	for i := range values {
+		g := &generator{config: gc, seed: seed, doc: i, visiting: map[reflect.Type]bool{}}
+		if err := g.fill(reflect.ValueOf(&values[i]).Elem(), "", fakerHints{}); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// InsertGenerated generates n values of T (see Generate) and inserts them into the collection,
+// returning the inserted values
+func InsertGenerated[T any](conn *TestConnection, dbName, collName string, seed int64, n int, opts ...GenerateOption) ([]T, error) {
+	values, err := Generate[T](seed, n, opts...)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]interface{}, len(values))
+	for i := range values {
+		docs[i] = values[i]
+	}
+	coll := conn.MongoDriverClient().Database(dbName).Collection(collName)
+	if err = insertInBatches(context.Background(), coll, docs); err != nil {
+		return values, fmt.Errorf("could not insert generated documents into %s.%s: %w", dbName, collName, err)
+	}
+	conn.logger.Debug("Inserted generated documents", Fields{
+		"database":   dbName,
+		"collection": collName,
+		"documents":  len(docs),
+		"seed":       seed,
+	})
+	return values, nil
+}
+
+// fakerHints are the parsed hints of a faker struct tag
+type fakerHints struct {
+	skip        bool
+	kind        string
+	oneOf       []string
+	length      int
+	hasBoundary bool
+	start, end  float64
+}
+
+// parseFakerHints parses a faker struct tag, e.g. "oneof: a, b" or "boundary_start=1, boundary_end=9"
+func parseFakerHints(tag string) (fakerHints, error) {
+	var hints fakerHints
+	tag = strings.TrimSpace(tag)
+	switch {
+	case tag == "-":
+		hints.skip = true
+		return hints, nil
+	case strings.HasPrefix(tag, "oneof:"):
+		for _, option := range strings.Split(strings.TrimPrefix(tag, "oneof:"), ",") {
+			hints.oneOf = append(hints.oneOf, strings.TrimSpace(option))
+		}
+		return hints, nil
+	}
+	for _, hint := range strings.Split(tag, ",") {
+		hint = strings.TrimSpace(hint)
+		name, value := hint, ""
+		if i := strings.Index(hint, "="); i != -1 {
+			name, value = strings.TrimSpace(hint[:i]), strings.TrimSpace(hint[i+1:])
+		}
+		var err error
+		switch name {
+		case "len":
+			hints.length, err = strconv.Atoi(value)
+		case "boundary_start":
+			hints.hasBoundary = true
+			hints.start, err = strconv.ParseFloat(value, 64)
+		case "boundary_end":
+			hints.hasBoundary = true
+			hints.end, err = strconv.ParseFloat(value, 64)
+		default:
+			if _, ok := fakeGenerators[name]; ok {
+				hints.kind = name
+			} else if kind, ok := fakerKinds[name]; ok {
+				hints.kind = kind
+			}
+		}
+		if err != nil {
+			return hints, fmt.Errorf("invalid faker hint '%s': %w", hint, err)
+		}
+	}
+	if hints.hasBoundary && hints.end < hints.start {
+		return hints, fmt.Errorf("boundary_end %v is less than boundary_start %v", hints.end, hints.start)
+	}
+	return hints, nil
+}
+
+// generator fills in a single generated document
+type generator struct {
+	config *generateConfig
+	seed   int64
+	doc    int
+	// visiting are the structs being filled in, so recursive types stop at the first repeat
+	visiting map[reflect.Type]bool
+}
+
+// source returns the random source for the value at path. Each value has its own source, so
+// adding a field to a model doesn't change the values generated for the others.
+func (g *generator) source(path string) *fakeSource {
+	seed := make([]byte, 16, 16+len(path))
+	binary.BigEndian.PutUint64(seed[:8], uint64(g.seed))
+	binary.BigEndian.PutUint64(seed[8:], uint64(g.doc))
+	return newFakeSource(append(seed, path...))
+}
+
+// fill sets v to a generated value for the field at path
+func (g *generator) fill(v reflect.Value, path string, hints fakerHints) error {
+	if override, ok := g.config.fields[path]; ok && len(path) != 0 {
+		return g.override(v, path, override)
+	}
+	if hints.skip || g.recursive(v.Type()) {
+		return nil
+	}
+	src := g.source(path)
+	switch v.Type() {
+	case timeType:
+		v.Set(reflect.ValueOf(generateTime(src)))
+		return nil
+	case dateTimeType:
+		v.Set(reflect.ValueOf(primitive.NewDateTimeFromTime(generateTime(src))))
+		return nil
+	case objectIDType:
+		oid := primitive.NewObjectIDFromTimestamp(generateTime(src))
+		copy(oid[4:], src.bytes(8))
+		v.Set(reflect.ValueOf(oid))
+		return nil
+	case decimal128Type:
+		d, err := primitive.ParseDecimal128(strconv.FormatFloat(generateFloat(src, hints), 'f', 2, 64))
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+		return nil
+	case binaryType:
+		v.Set(reflect.ValueOf(primitive.Binary{Data: src.bytes(16)}))
+		return nil
+	case timestampType:
+		v.Set(reflect.ValueOf(primitive.Timestamp{T: uint32(generateTime(src).Unix())}))
+		return nil
+	case regexType, rawType, documentType, arrayType:
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := g.fill(elem.Elem(), path, hints); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		return g.fillStruct(v, path)
+	case reflect.String:
+		v.SetString(generateString(src, path, hints))
+	case reflect.Bool:
+		v.SetBool(src.intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := generateInt(src, hints, v.Type().Bits(), false)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", path, err)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := generateInt(src, hints, v.Type().Bits(), true)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", path, err)
+		}
+		v.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(generateFloat(src, hints))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			length := 16
+			if hints.length != 0 {
+				length = hints.length
+			}
+			v.SetBytes(append([]byte{}, src.bytes(length)...))
+			return nil
+		}
+		length := 1 + src.intn(3)
+		if hints.length != 0 {
+			length = hints.length
+		}
+		v.Set(reflect.MakeSlice(v.Type(), length, length))
+		fallthrough
+	case reflect.Array:
+		elemHints := fakerHints{kind: hints.kind, oneOf: hints.oneOf, hasBoundary: hints.hasBoundary, start: hints.start, end: hints.end}
+		for i := 0; i < v.Len(); i++ {
+			if err := g.fillElement(v.Index(i), path, i, elemHints); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		length := 1 + src.intn(3)
+		if hints.length != 0 {
+			length = hints.length
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), length))
+		for i := 0; i < length; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			key.SetString(fmt.Sprintf("%s%d", src.pick(fakeWords), i))
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := g.fillElement(elem, path, i, fakerHints{}); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
+
+// fillElement fills the i'th element of the array or map at path. Overrides of nested fields
+// use the path without the element index (e.g. "addresses.city").
+func (g *generator) fillElement(v reflect.Value, path string, i int, hints fakerHints) error {
+	// Each element gets its own seed, while nested paths keep matching the overrides
+	elemSeed := int64(binary.BigEndian.Uint64(g.source(path + "." + strconv.Itoa(i)).bytes(8)))
+	elemGenerator := &generator{config: g.config, seed: elemSeed, doc: g.doc, visiting: g.visiting}
+	if v.Kind() == reflect.Struct || (v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct) {
+		if v.Kind() == reflect.Ptr {
+			v.Set(reflect.New(v.Type().Elem()))
+			v = v.Elem()
+		}
+		return elemGenerator.fillStruct(v, path)
+	}
+	return elemGenerator.fill(v, path+".$", hints)
+}
+
+// fillStruct fills each encoded field of the struct at path
+func (g *generator) fillStruct(v reflect.Value, path string) error {
+	if g.visiting == nil {
+		g.visiting = map[reflect.Type]bool{}
+	}
+	g.visiting[v.Type()] = true
+	defer delete(g.visiting, v.Type())
+	for _, mf := range modelFields(v.Type()) {
+		fieldPath := mf.key
+		if len(path) != 0 {
+			fieldPath = path + "." + mf.key
+		}
+		if mf.inline {
+			fieldPath = path
+		}
+		hints, err := parseFakerHints(mf.field.Tag.Get("faker"))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", fieldPath, err)
+		}
+		field := v.FieldByIndex(mf.field.Index)
+		if mf.inline && field.Kind() == reflect.Struct {
+			err = g.fillStruct(field, path)
+		} else {
+			err = g.fill(field, fieldPath, hints)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recursive reports whether t is a pointer, slice or map of a struct which is already being
+// filled in. These are left nil or empty, as filling them would never end.
+func (g *generator) recursive(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		nested := modelStructType(t)
+		return nested != nil && g.visiting[nested]
+	case reflect.Map:
+		nested := modelStructType(t.Elem())
+		return nested != nil && g.visiting[nested]
+	}
+	return false
+}
+
+// override sets v to the value returned by an override
+func (g *generator) override(v reflect.Value, path string, generate FieldGenerator) error {
+	src := g.source(path)
+	rnd := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(src.bytes(8)))))
+	value := generate(g.doc, rnd)
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	switch {
+	case rv.Type().AssignableTo(v.Type()):
+		v.Set(rv)
+		return nil
+	case rv.Kind() == v.Kind() && rv.Type().ConvertibleTo(v.Type()):
+		// e.g. a string for a named string type
+		v.Set(rv.Convert(v.Type()))
+		return nil
+	case isNumericKind(rv.Kind()) && isNumericKind(v.Kind()):
+		// Numbers can be converted, as long as nothing is truncated or overflows
+		converted := rv.Convert(v.Type())
+		if converted.Convert(rv.Type()).Interface() == rv.Interface() {
+			v.Set(converted)
+			return nil
+		}
+		return fmt.Errorf("field %s: the override returned %v, which doesn't fit in a %s", path, value, v.Type())
+	}
+	return fmt.Errorf("field %s: the override returned a %s, which can't be stored in a %s", path, rv.Type(), v.Type())
+}
+
+// isNumericKind reports whether kind is an integer or floating point number
+func isNumericKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// generateTime returns a time within the year before generateEpoch, truncated to the
+// millisecond precision of BSON dates
+func generateTime(src *fakeSource) time.Time {
+	offset := time.Duration(src.intn(365*24*60*60*1000)) * time.Millisecond
+	return generateEpoch.Add(-offset)
+}
+
+// generateString returns a string for the field at path, using hints or the field's name
+func generateString(src *fakeSource, path string, hints fakerHints) string {
+	if len(hints.oneOf) != 0 {
+		return src.pick(hints.oneOf)
+	}
+	kind := hints.kind
+	if len(kind) == 0 {
+		name := path[strings.LastIndex(path, ".")+1:]
+		kind = fieldNameKinds[strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(name))]
+	}
+	if generate, ok := fakeGenerators[kind]; ok {
+		return generate(src)
+	}
+	if hints.length != 0 {
+		const alphabet = "abcdefghijklmnopqrstuvwxyz"
+		out := make([]byte, hints.length)
+		for i := range out {
+			out[i] = alphabet[src.intn(len(alphabet))]
+		}
+		return string(out)
+	}
+	return src.pick(fakeWords)
+}
+
+// generateInt returns an integer which fits in the given number of bits, within the hinted
+// boundaries (defaulting to [0, 1000])
+func generateInt(src *fakeSource, hints fakerHints, bits int, unsigned bool) (int64, error) {
+	if len(hints.oneOf) != 0 {
+		return strconv.ParseInt(src.pick(hints.oneOf), 10, bits)
+	}
+	start, end := int64(0), int64(1000)
+	if hints.hasBoundary {
+		start, end = int64(hints.start), int64(hints.end)
+	}
+	if unsigned && start < 0 {
+		start = 0
+	}
+	if !unsigned && bits < 64 {
+		max := int64(1)<<(bits-1) - 1
+		if end > max {
+			end = max
+		}
+	} else if unsigned && bits < 64 {
+		max := int64(1)<<bits - 1
+		if end > max {
+			end = max
+		}
+	}
+	if end < start {
+		return 0, fmt.Errorf("no %d bit integers between %d and %d", bits, start, end)
+	}
+	return start + int64(binary.BigEndian.Uint64(src.bytes(8))%uint64(end-start+1)), nil
+}
+
+// generateFloat returns a number with 2 decimal places within the hinted boundaries (defaulting
+// to [0, 1000])
+func generateFloat(src *fakeSource, hints fakerHints) float64 {
+	if len(hints.oneOf) != 0 {
+		if f, err := strconv.ParseFloat(src.pick(hints.oneOf), 64); err == nil {
+			return f
+		}
+	}
+	start, end := 0.0, 1000.0
+	if hints.hasBoundary {
+		start, end = hints.start, hints.end
+	}
+	cents := int64((end - start) * 100)
+	if cents <= 0 {
+		return start
+	}
+	return start + float64(src.intn(int(cents)+1))/100
+}
@@ -0,0 +1,386 @@
+package mongotest
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// goldenUpdateEnv is the environment variable which makes AssertCollectionGolden rewrite golden
+// files:
+//
+//	MONGOTEST_UPDATE_GOLDEN=1 go test ./...
+const goldenUpdateEnv = "MONGOTEST_UPDATE_GOLDEN"
+
+// goldenUpdateFlag is the name of the test flag which also rewrites golden files. mongotest
+// doesn't register it, but honours it when the test package does:
+//
+//	var update = flag.Bool("update", false, "rewrite golden files")
+const goldenUpdateFlag = "update"
+
+// goldenContextLines is the number of unchanged lines shown around each change in a golden diff
+const goldenContextLines = 3
+
+// goldenUpdateRequested reports whether golden files should be rewritten, either because of
+// GoldenUpdate, because goldenUpdateEnv is set to a true value or because the test binary was
+// run with -update
+func (gc *goldenConfig) goldenUpdateRequested() bool {
+	if gc.update != nil {
+		return *gc.update
+	}
+	if update, _ := strconv.ParseBool(os.Getenv(goldenUpdateEnv)); update {
+		return true
+	}
+	return goldenUpdateFlagSet(flag.CommandLine)
+}
+
+// goldenUpdateFlagSet reports whether fs has a goldenUpdateFlag flag which is set to true
+func goldenUpdateFlagSet(fs *flag.FlagSet) bool {
+	f := fs.Lookup(goldenUpdateFlag)
+	if f == nil {
+		return false
+	}
+	update, _ := strconv.ParseBool(f.Value.String())
+	return update
+}
+
+// GoldenOption configures AssertCollectionGolden
+type GoldenOption func(gc *goldenConfig)
+
+type goldenConfig struct {
+	update         *bool
+	sortKeys       []string
+	query          string
+	ignorePaths    []string
+	keepObjectIDs  bool
+	keepDates      bool
+	canonicalTypes bool
+}
+
+// GoldenUpdate rewrites the golden file instead of comparing against it when update is true,
+// overriding MONGOTEST_UPDATE_GOLDEN and -update, e.g. to wire up a differently named flag:
+//
+//	var rewrite = flag.Bool("rewrite", false, "rewrite golden files")
+//	...
+//	mongotest.AssertCollectionGolden(t, conn, "shop", "orders", path, mongotest.GoldenUpdate(*rewrite))
+func GoldenUpdate(update bool) GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.update = &update
+	}
+}
+
+// GoldenSortBy orders the documents by keys (ascending), then _id. By default, documents are
+// ordered by _id alone - sort by a stable business key when _ids are generated by the test.
+func GoldenSortBy(keys ...string) GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.sortKeys = keys
+	}
+}
+
+// GoldenQuery limits the comparison to the documents matching the Extended JSON query q
+func GoldenQuery(q string) GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.query = q
+	}
+}
+
+// GoldenIgnorePaths replaces the values at the given dotted paths with "<ignored>", for fields
+// which change from run to run (e.g. "createdBy.session" or "items.etag")
+func GoldenIgnorePaths(paths ...string) GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.ignorePaths = append(gc.ignorePaths, paths...)
+	}
+}
+
+// GoldenKeepObjectIDs writes ObjectIDs as-is. By default, each distinct ObjectID is replaced
+// with a numbered placeholder ("<ObjectID 1>", "<ObjectID 2>", ...) in the order it is first
+// seen, so references between documents are still checked.
+func GoldenKeepObjectIDs() GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.keepObjectIDs = true
+	}
+}
+
+// GoldenKeepDates writes dates and timestamps as-is. By default they're replaced with "<Date>"
+// and "<Timestamp>".
+func GoldenKeepDates() GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.keepDates = true
+	}
+}
+
+// GoldenCanonicalTypes writes the golden file as Canonical rather than Relaxed Extended JSON, so
+// number types are compared too (e.g. an int32 changing to an int64 fails the assertion).
+func GoldenCanonicalTypes() GoldenOption {
+	return func(gc *goldenConfig) {
+		gc.canonicalTypes = true
+	}
+}
+
+// AssertCollectionGolden exports dbName.collName and compares it against the golden file at
+// goldenPath, failing tb with a line diff if they differ. Volatile values (ObjectIDs, dates and
+// any GoldenIgnorePaths) are normalized first, so the file stays stable between runs. When
+// MONGOTEST_UPDATE_GOLDEN=1 is set, the test package's own -update flag is set or
+// GoldenUpdate(true) is passed, the golden file is (re)written instead. Returns whether the
+// assertion passed.
+//
+//	mongotest.AssertCollectionGolden(t, conn, "shop", "orders", "testdata/golden/orders.json",
+//		mongotest.GoldenSortBy("orderNumber"))
+func AssertCollectionGolden(tb testing.TB, conn *TestConnection, dbName, collName, goldenPath string, opts ...GoldenOption) bool {
+	tb.Helper()
+	gc := &goldenConfig{}
+	for _, opt := range opts {
+		opt(gc)
+	}
+	got, err := goldenCollection(conn, dbName, collName, gc)
+	if err != nil {
+		tb.Errorf("Could not export %s.%s for golden comparison: %v", dbName, collName, err)
+		return false
+	}
+
+	if gc.goldenUpdateRequested() {
+		if err = os.MkdirAll(filepath.Dir(goldenPath), 0755); err == nil {
+			err = os.WriteFile(goldenPath, got, 0644)
+		}
+		if err != nil {
+			tb.Errorf("Could not update golden file %s: %v", goldenPath, err)
+			return false
+		}
+		tb.Logf("Updated golden file %s", goldenPath)
+		return true
+	}
+
+	want, err := os.ReadFile(goldenPath)
+	if errors.Is(err, os.ErrNotExist) {
+		tb.Errorf("Golden file %s does not exist - run the test with %s=1 to create it", goldenPath, goldenUpdateEnv)
+		return false
+	} else if err != nil {
+		tb.Errorf("Could not read golden file %s: %v", goldenPath, err)
+		return false
+	}
+	// Tolerate golden files edited on Windows
+	want = bytes.ReplaceAll(want, []byte("\r\n"), []byte("\n"))
+	if bytes.Equal(want, got) {
+		return true
+	}
+	tb.Errorf("%s.%s does not match golden file %s (run the test with %s=1 to accept the changes):\n%s",
+		dbName, collName, goldenPath, goldenUpdateEnv, lineDiff(string(want), string(got)))
+	return false
+}
+
+// goldenCollection exports the collection in a stable order and returns it as a normalized JSON array
+func goldenCollection(conn *TestConnection, dbName, collName string, gc *goldenConfig) ([]byte, error) {
+	sort := bson.D{}
+	for _, key := range gc.sortKeys {
+		if key != "_id" {
+			sort = append(sort, bson.E{Key: key, Value: 1})
+		}
+	}
+	sort = append(sort, bson.E{Key: "_id", Value: 1})
+	sortJSON, err := bson.MarshalExtJSON(sort, false, false)
+	if err != nil {
+		return nil, err
+	}
+	exporter := conn.DatabaseExporter(dbName, collName).CanonicalJSON().Sort(string(sortJSON))
+	if len(gc.query) != 0 {
+		exporter.Query(gc.query)
+	}
+	it, err := exporter.Iterate()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	normalizer := &goldenNormalizer{config: gc, objectIDs: map[primitive.ObjectID]int{}}
+	docs := []bson.D{}
+	for it.Next() {
+		doc, err := normalizer.normalize(it.Document())
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	return marshalExtJSONArray(docs, gc.canonicalTypes)
+}
+
+// goldenNormalizer replaces volatile values with stable placeholders
+type goldenNormalizer struct {
+	config    *goldenConfig
+	objectIDs map[primitive.ObjectID]int
+}
+
+func (gn *goldenNormalizer) normalize(doc bson.D) (bson.D, error) {
+	for _, p := range gn.config.ignorePaths {
+		var err error
+		doc, err = transformPath(doc, strings.Split(p, "."), func(interface{}) (interface{}, bool, error) {
+			return "<ignored>", true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not ignore '%s': %w", p, err)
+		}
+	}
+	return gn.normalizeValue(doc).(bson.D), nil
+}
+
+func (gn *goldenNormalizer) normalizeValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case bson.D:
+		out := make(bson.D, len(typed))
+		for i, elem := range typed {
+			out[i] = bson.E{Key: elem.Key, Value: gn.normalizeValue(elem.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(typed))
+		for i, item := range typed {
+			out[i] = gn.normalizeValue(item)
+		}
+		return out
+	case primitive.ObjectID:
+		if gn.config.keepObjectIDs {
+			return value
+		}
+		n, ok := gn.objectIDs[typed]
+		if !ok {
+			n = len(gn.objectIDs) + 1
+			gn.objectIDs[typed] = n
+		}
+		return fmt.Sprintf("<ObjectID %d>", n)
+	case primitive.DateTime:
+		if gn.config.keepDates {
+			return value
+		}
+		return "<Date>"
+	case primitive.Timestamp:
+		if gn.config.keepDates {
+			return value
+		}
+		return "<Timestamp>"
+	}
+	return value
+}
+
+// lineDiff returns a readable diff of want and got: removed lines are prefixed with "-", added
+// lines with "+", and long runs of unchanged lines are elided
+func lineDiff(want, got string) string {
+	a, b := splitLines(want), splitLines(got)
+	// Only the lines between the common prefix and suffix need diffing
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var lines []goldenDiffLine
+	for _, line := range a[:prefix] {
+		lines = append(lines, goldenDiffLine{' ', line})
+	}
+	lines = append(lines, diffLines(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, goldenDiffLine{' ', line})
+	}
+
+	var sb strings.Builder
+	sb.WriteString("--- want\n+++ got\n")
+	elided := false
+	for k, line := range lines {
+		nearChange := false
+		for d := k - goldenContextLines; d <= k+goldenContextLines; d++ {
+			if d >= 0 && d < len(lines) && lines[d].op != ' ' {
+				nearChange = true
+				break
+			}
+		}
+		if line.op == ' ' && !nearChange {
+			if !elided {
+				sb.WriteString("  ...\n")
+				elided = true
+			}
+			continue
+		}
+		elided = false
+		sb.WriteByte(line.op)
+		sb.WriteString(" ")
+		sb.WriteString(line.text)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// goldenDiffMaxCells caps the size of the table used to diff golden files line by line. Beyond
+// it, the differing lines are shown as removed, then added.
+const goldenDiffMaxCells = 1 << 22
+
+// goldenDiffLine is a line of a golden diff - op is ' ', '-' or '+'
+type goldenDiffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the shortest edit turning a into b, using their longest common subsequence
+func diffLines(a, b []string) []goldenDiffLine {
+	var lines []goldenDiffLine
+	if (len(a)+1)*(len(b)+1) > goldenDiffMaxCells {
+		for _, line := range a {
+			lines = append(lines, goldenDiffLine{'-', line})
+		}
+		for _, line := range b {
+			lines = append(lines, goldenDiffLine{'+', line})
+		}
+		return lines
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, goldenDiffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, goldenDiffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, goldenDiffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// splitLines splits s into lines, ignoring the final newline
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,79 @@
+// Package bsonvalue holds the BSON value helpers shared by mongotest and its assert package
+package bsonvalue
+
+import (
+	"bytes"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// ExtJSON writes a single value (which need not be a document) as Canonical or Relaxed
+// Extended JSON
+func ExtJSON(value interface{}, canonical bool) (string, error) {
+	out, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, canonical, false)
+	if err != nil {
+		return "", err
+	}
+	// Strip the wrapper document: {"v":...}
+	return string(out[len(`{"v":`) : len(out)-1]), nil
+}
+
+// Number returns the value of a numeric BSON value
+func Number(value bson.RawValue) (float64, bool) {
+	switch value.Type {
+	case bsontype.Int32:
+		return float64(value.Int32()), true
+	case bsontype.Int64:
+		return float64(value.Int64()), true
+	case bsontype.Double:
+		return value.Double(), true
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(value.Decimal128().String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Equal compares two BSON values. Numbers are compared by value, since the same number may be
+// stored with different types. Embedded documents and arrays are compared element by element,
+// in order. When subset is set, documents in got only need to contain the fields in want.
+func Equal(want, got bson.RawValue, subset bool) bool {
+	if wantNum, ok := Number(want); ok {
+		gotNum, ok := Number(got)
+		return ok && wantNum == gotNum
+	}
+	if want.Type != got.Type {
+		return false
+	}
+	if want.Type != bsontype.EmbeddedDocument && want.Type != bsontype.Array {
+		return bytes.Equal(want.Value, got.Value)
+	}
+	wantElems, err := bson.Raw(want.Value).Elements()
+	if err != nil {
+		return false
+	}
+	gotElems, err := bson.Raw(got.Value).Elements()
+	if err != nil {
+		return false
+	}
+	if subset && want.Type == bsontype.EmbeddedDocument {
+		for _, wantElem := range wantElems {
+			gotValue, err := bson.Raw(got.Value).LookupErr(wantElem.Key())
+			if err != nil || !Equal(wantElem.Value(), gotValue, subset) {
+				return false
+			}
+		}
+		return true
+	}
+	if len(wantElems) != len(gotElems) {
+		return false
+	}
+	for i := range wantElems {
+		if wantElems[i].Key() != gotElems[i].Key() || !Equal(wantElems[i].Value(), gotElems[i].Value(), subset) {
+			return false
+		}
+	}
+	return true
+}
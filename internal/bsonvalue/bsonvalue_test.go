@@ -0,0 +1,41 @@
+package bsonvalue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValues(t *testing.T) {
+	is := assert.New(t)
+	value := func(v interface{}) bson.RawValue {
+		raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+		is.NoError(err)
+		return bson.Raw(raw).Lookup("v")
+	}
+	decimal, _ := primitive.ParseDecimal128("1.5")
+	is.True(Equal(value(int32(1)), value(int64(1)), false), "Numbers should be compared by value")
+	is.True(Equal(value(1.5), value(decimal), false))
+	is.False(Equal(value(1), value("1"), false))
+	is.True(Equal(value(bson.D{{Key: "a", Value: bson.A{1, "x"}}}), value(bson.D{{Key: "a", Value: bson.A{int64(1), "x"}}}), false))
+	is.False(Equal(value(bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 2}}), value(bson.D{{Key: "b", Value: 2}, {Key: "a", Value: 1}}), false),
+		"Documents should be compared in order")
+	is.True(Equal(value(bson.D{{Key: "b", Value: 2}}), value(bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 2.0}}), true),
+		"Subsets only need the wanted fields")
+	is.False(Equal(value(bson.A{1}), value(bson.A{1, 2}), true), "Arrays should match in full, even for subsets")
+
+	n, ok := Number(value(int64(7)))
+	is.True(ok)
+	is.Equal(7.0, n)
+	_, ok = Number(value("7"))
+	is.False(ok)
+
+	out, err := ExtJSON(int64(7), true)
+	is.NoError(err)
+	is.Equal(`{"$numberLong":"7"}`, out)
+	out, err = ExtJSON(bson.D{{Key: "a", Value: int64(7)}}, false)
+	is.NoError(err)
+	is.Equal(`{"a":7}`, out)
+}
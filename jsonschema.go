@@ -0,0 +1,822 @@
+package mongotest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// schemaStringAttempts is how many strings are generated from a pattern before giving up on
+// also meeting the length limits
+const schemaStringAttempts = 50
+
+// WithViolations also generates n documents which each break a single rule of the validator,
+// for negative tests (GenerateFromValidator only)
+func WithViolations(n int) GenerateOption {
+	return func(gc *generateConfig) {
+		gc.violations = n
+	}
+}
+
+// ValidatorDocuments are the documents generated by GenerateFromValidator
+type ValidatorDocuments struct {
+	// Valid documents conform to the validator, and were inserted
+	Valid []bson.D
+	// Invalid documents each break a single rule of the validator (see WithViolations). They're
+	// not inserted, as the server would reject them.
+	Invalid []InvalidDocument
+}
+
+// InvalidDocument is a generated document which breaks a rule of the validator
+type InvalidDocument struct {
+	Document bson.D
+	// Violation describes the broken rule, e.g. "age: below the minimum of 18"
+	Violation string
+}
+
+// GenerateFromValidator reads the $jsonSchema validator of an existing collection, then
+// generates and inserts n documents which conform to it. Required fields, enums, patterns,
+// minimum/maximum, lengths and nested objects and arrays are honoured, while optional fields are
+// mostly, but not always, included. The same seed always generates the same documents.
+//
+//	docs, err := conn.GenerateFromValidator("shop", "orders", 100, 42, mongotest.WithViolations(10))
+//	...
+//	for _, invalid := range docs.Invalid {
+//		_, err = orders.InsertOne(ctx, invalid.Document)
+//		is.Error(err, invalid.Violation)
+//	}
+//
+// Field overrides (see WithFieldGenerator) also apply. Only one branch of anyOf and oneOf is
+// used, and other operators in the validator (outside of $jsonSchema) are ignored.
+func (tc *TestConnection) GenerateFromValidator(dbName, collName string, n int, seed int64, opts ...GenerateOption) (*ValidatorDocuments, error) {
+	ctx := context.Background()
+	gc := &generateConfig{fields: map[string]FieldGenerator{}}
+	for _, opt := range opts {
+		opt(gc)
+	}
+	db := tc.MongoDriverClient().Database(dbName)
+	live, err := liveCollections(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the collections in %s: %w", dbName, err)
+	}
+	spec, ok := live[collName]
+	if !ok {
+		return nil, fmt.Errorf("collection %s.%s does not exist", dbName, collName)
+	}
+	rawSchema, ok := spec.Options.Lookup("validator", "$jsonSchema").DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("collection %s.%s has no $jsonSchema validator", dbName, collName)
+	}
+	docs, err := generateFromJSONSchema(rawSchema, n, seed, gc)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate documents for %s.%s: %w", dbName, collName, err)
+	}
+	inserts := make([]interface{}, len(docs.Valid))
+	for i := range docs.Valid {
+		inserts[i] = docs.Valid[i]
+	}
+	if err = insertInBatches(ctx, db.Collection(collName), inserts); err != nil {
+		return docs, fmt.Errorf("could not insert generated documents into %s.%s: %w", dbName, collName, err)
+	}
+	tc.logger.Debug("Inserted documents generated from the validator", Fields{
+		"database":   dbName,
+		"collection": collName,
+		"documents":  len(docs.Valid),
+		"invalid":    len(docs.Invalid),
+		"seed":       seed,
+	})
+	return docs, nil
+}
+
+// generateFromJSONSchema generates n documents conforming to rawSchema, along with any
+// violations requested by gc
+func generateFromJSONSchema(rawSchema bson.Raw, n int, seed int64, gc *generateConfig) (*ValidatorDocuments, error) {
+	if gc.err != nil {
+		return nil, gc.err
+	}
+	schema, err := parseJSONSchema(rawSchema)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the validator: %w", err)
+	}
+	docs := &ValidatorDocuments{}
+	for i := 0; i < n+gc.violations; i++ {
+		g := &generator{config: gc, seed: seed, doc: i}
+		doc, err := g.generateObject(schema, "")
+		if err != nil {
+			return nil, err
+		}
+		if i < n {
+			docs.Valid = append(docs.Valid, doc)
+			continue
+		}
+		invalid, err := g.violate(schema, doc)
+		if err != nil {
+			return nil, err
+		}
+		docs.Invalid = append(docs.Invalid, invalid)
+	}
+	return docs, nil
+}
+
+// jsonSchema is the part of a $jsonSchema used to generate documents
+type jsonSchema struct {
+	BSONType             bson.RawValue `bson:"bsonType"`
+	Type                 bson.RawValue `bson:"type"`
+	Required             []string      `bson:"required"`
+	Properties           bson.Raw      `bson:"properties"`
+	AdditionalProperties bson.RawValue `bson:"additionalProperties"`
+	Enum                 bson.A        `bson:"enum"`
+	Pattern              string        `bson:"pattern"`
+	MinLength            *int64        `bson:"minLength"`
+	MaxLength            *int64        `bson:"maxLength"`
+	Minimum              *float64      `bson:"minimum"`
+	Maximum              *float64      `bson:"maximum"`
+	ExclusiveMinimum     bool          `bson:"exclusiveMinimum"`
+	ExclusiveMaximum     bool          `bson:"exclusiveMaximum"`
+	Items                bson.RawValue `bson:"items"`
+	AdditionalItems      bson.RawValue `bson:"additionalItems"`
+	MinItems             *int64        `bson:"minItems"`
+	MaxItems             *int64        `bson:"maxItems"`
+	UniqueItems          bool          `bson:"uniqueItems"`
+	AnyOf                []bson.Raw    `bson:"anyOf"`
+	OneOf                []bson.Raw    `bson:"oneOf"`
+
+	raw bson.Raw
+}
+
+// jsonSchemaTypes maps JSON schema types to BSON types
+var jsonSchemaTypes = map[string]string{
+	"object":  "object",
+	"array":   "array",
+	"string":  "string",
+	"boolean": "bool",
+	"integer": "int",
+	"number":  "number",
+	"null":    "null",
+}
+
+func parseJSONSchema(raw bson.Raw) (*jsonSchema, error) {
+	schema := &jsonSchema{raw: raw}
+	if err := bson.Unmarshal(raw, schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// property is a property declared by the schema
+type property struct {
+	name   string
+	schema *jsonSchema
+}
+
+// properties returns the declared properties, in order
+func (s *jsonSchema) properties() ([]property, error) {
+	if len(s.Properties) == 0 {
+		return nil, nil
+	}
+	elems, err := s.Properties.Elements()
+	if err != nil {
+		return nil, err
+	}
+	props := make([]property, 0, len(elems))
+	for _, elem := range elems {
+		raw, ok := elem.Value().DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("property %s is not a schema", elem.Key())
+		}
+		schema, err := parseJSONSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %w", elem.Key(), err)
+		}
+		props = append(props, property{name: elem.Key(), schema: schema})
+	}
+	return props, nil
+}
+
+// types returns the BSON types allowed by the schema, or nil if any type is allowed
+func (s *jsonSchema) types() []string {
+	var types []string
+	for i, value := range []bson.RawValue{s.BSONType, s.Type} {
+		var names []string
+		switch value.Type {
+		case bsontype.String:
+			names = []string{value.StringValue()}
+		case bsontype.Array:
+			values, _ := value.Array().Values()
+			for _, name := range values {
+				if str, ok := name.StringValueOK(); ok {
+					names = append(names, str)
+				}
+			}
+		}
+		for _, name := range names {
+			if i == 1 {
+				name = jsonSchemaTypes[name]
+			}
+			types = append(types, name)
+		}
+	}
+	return types
+}
+
+// chooseType picks the type of a generated value, preferring types other than null
+func (s *jsonSchema) chooseType(src *fakeSource) string {
+	var types []string
+	for _, name := range s.types() {
+		if name != "null" {
+			types = append(types, name)
+		}
+	}
+	switch {
+	case len(types) != 0:
+		return src.pick(types)
+	case len(s.types()) != 0:
+		return "null"
+	case len(s.Properties) != 0 || len(s.Required) != 0:
+		return "object"
+	case s.Items.Type != 0 || s.MinItems != nil || s.MaxItems != nil:
+		return "array"
+	case s.Minimum != nil || s.Maximum != nil:
+		return "number"
+	}
+	return "string"
+}
+
+// branch returns the schema combined with one of its anyOf or oneOf branches
+func (s *jsonSchema) branch(src *fakeSource) (*jsonSchema, error) {
+	branches := s.AnyOf
+	if len(branches) == 0 {
+		branches = s.OneOf
+	}
+	chosen := branches[src.intn(len(branches))]
+	merged, err := chosen.Elements()
+	if err != nil {
+		return nil, err
+	}
+	parent, err := s.raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+	out := bson.D{}
+	for _, elem := range merged {
+		out = append(out, bson.E{Key: elem.Key(), Value: elem.Value()})
+	}
+	for _, elem := range parent {
+		if elem.Key() == "anyOf" || elem.Key() == "oneOf" || chosen.Lookup(elem.Key()).Type != 0 {
+			continue
+		}
+		out = append(out, bson.E{Key: elem.Key(), Value: elem.Value()})
+	}
+	raw, err := bson.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONSchema(raw)
+}
+
+// bounds returns the numeric range allowed by the schema, defaulting to [0, 1000]
+func (s *jsonSchema) bounds(integer bool) (fakerHints, error) {
+	hints := fakerHints{hasBoundary: true, start: 0, end: 1000}
+	switch {
+	case s.Minimum != nil && s.Maximum != nil:
+		hints.start, hints.end = *s.Minimum, *s.Maximum
+	case s.Minimum != nil:
+		hints.start, hints.end = *s.Minimum, *s.Minimum+1000
+	case s.Maximum != nil && *s.Maximum < 0:
+		hints.start, hints.end = *s.Maximum-1000, *s.Maximum
+	case s.Maximum != nil:
+		hints.end = *s.Maximum
+	}
+	step := 0.01
+	if integer {
+		step = 1
+		hints.start, hints.end = math.Ceil(hints.start), math.Floor(hints.end)
+	}
+	if s.ExclusiveMinimum && s.Minimum != nil && hints.start <= *s.Minimum {
+		hints.start += step
+	}
+	if s.ExclusiveMaximum && s.Maximum != nil && hints.end >= *s.Maximum {
+		hints.end -= step
+	}
+	if hints.end < hints.start {
+		return hints, fmt.Errorf("no numbers between the minimum and maximum")
+	}
+	return hints, nil
+}
+
+// fractionalBounds reports whether the minimum or maximum isn't a whole number
+func (s *jsonSchema) fractionalBounds() bool {
+	return (s.Minimum != nil && *s.Minimum != math.Trunc(*s.Minimum)) ||
+		(s.Maximum != nil && *s.Maximum != math.Trunc(*s.Maximum))
+}
+
+// generateSchemaValue generates a value conforming to schema for the field at path. Array
+// elements skip the overrides, which apply to the whole array.
+func (g *generator) generateSchemaValue(schema *jsonSchema, path string, element bool) (interface{}, error) {
+	if override, ok := g.config.fields[path]; ok && len(path) != 0 && !element {
+		src := g.source(path)
+		return override(g.doc, rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(src.bytes(8)))))), nil
+	}
+	src := g.source(path)
+	if len(schema.AnyOf) != 0 || len(schema.OneOf) != 0 {
+		branch, err := schema.branch(src)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", path, err)
+		}
+		return g.generateSchemaValue(branch, path, true)
+	}
+	if len(schema.Enum) != 0 {
+		return schema.Enum[src.intn(len(schema.Enum))], nil
+	}
+	bsonType := schema.chooseType(src)
+	var value interface{}
+	var err error
+	switch bsonType {
+	case "object":
+		value, err = g.generateObject(schema, path)
+	case "array":
+		value, err = g.generateArray(schema, path)
+	case "string":
+		value, err = generateSchemaString(src, schema, path)
+	case "number":
+		// Integers where the bounds allow them, doubles otherwise
+		hints, boundsErr := schema.bounds(true)
+		if boundsErr == nil && !schema.fractionalBounds() {
+			var n int64
+			if n, err = generateInt(src, hints, 32, false); err == nil {
+				value = int32(n)
+			}
+		} else if hints, err = schema.bounds(false); err == nil {
+			value = generateFloat(src, hints)
+		}
+	case "int", "long":
+		var hints fakerHints
+		if hints, err = schema.bounds(true); err == nil {
+			bits := 32
+			if bsonType == "long" {
+				bits = 64
+			}
+			var n int64
+			if n, err = generateInt(src, hints, bits, false); err == nil && bits == 32 {
+				value = int32(n)
+			} else {
+				value = n
+			}
+		}
+	case "double", "decimal":
+		var hints fakerHints
+		if hints, err = schema.bounds(false); err == nil {
+			f := generateFloat(src, hints)
+			value = f
+			if bsonType == "decimal" {
+				value, err = primitive.ParseDecimal128(strconv.FormatFloat(f, 'f', 2, 64))
+			}
+		}
+	case "bool":
+		value = src.intn(2) == 1
+	case "date":
+		value = primitive.NewDateTimeFromTime(generateTime(src))
+	case "objectId":
+		oid := primitive.NewObjectIDFromTimestamp(generateTime(src))
+		copy(oid[4:], src.bytes(8))
+		value = oid
+	case "binData":
+		value = primitive.Binary{Data: src.bytes(16)}
+	case "timestamp":
+		value = primitive.Timestamp{T: uint32(generateTime(src).Unix())}
+	case "regex":
+		value = primitive.Regex{Pattern: src.pick(fakeWords)}
+	case "null":
+		value = primitive.Null{}
+	default:
+		err = fmt.Errorf("bsonType %s is not supported", bsonType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", path, err)
+	}
+	return value, nil
+}
+
+// generateObject generates a document with every required property, and most of the others
+func (g *generator) generateObject(schema *jsonSchema, path string) (bson.D, error) {
+	src := g.source(path)
+	props, err := schema.properties()
+	if err != nil {
+		return nil, err
+	}
+	required := map[string]bool{}
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	doc := bson.D{}
+	for _, prop := range props {
+		if !required[prop.name] && src.intn(5) == 0 {
+			continue
+		}
+		value, err := g.generateSchemaValue(prop.schema, joinSchemaPath(path, prop.name), false)
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: prop.name, Value: value})
+		delete(required, prop.name)
+	}
+	// Required fields without a schema can be anything
+	for _, name := range schema.Required {
+		if required[name] {
+			value, err := g.generateSchemaValue(&jsonSchema{}, joinSchemaPath(path, name), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: name, Value: value})
+		}
+	}
+	return doc, nil
+}
+
+// generateArray generates an array with between minItems and maxItems elements (defaulting to
+// between 1 and 3)
+func (g *generator) generateArray(schema *jsonSchema, path string) (bson.A, error) {
+	src := g.source(path)
+	min, max := int64(1), int64(3)
+	if schema.MinItems != nil {
+		min = *schema.MinItems
+		if max < min {
+			max = min + 2
+		}
+	}
+	if schema.MaxItems != nil {
+		max = *schema.MaxItems
+		if min > max {
+			min = max
+		}
+	}
+	length := int(min) + src.intn(int(max-min)+1)
+	items := make([]*jsonSchema, length)
+	switch schema.Items.Type {
+	case bsontype.EmbeddedDocument:
+		itemSchema, err := parseJSONSchema(schema.Items.Document())
+		if err != nil {
+			return nil, err
+		}
+		for i := range items {
+			items[i] = itemSchema
+		}
+	case bsontype.Array:
+		// Each element has its own schema, and any more than that follow additionalItems
+		values, err := schema.Items.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < length {
+			// Only generate additional items where minItems needs them
+			length = len(values)
+			if int(min) > length {
+				length = int(min)
+			}
+			items = items[:length]
+		}
+		additional := &jsonSchema{}
+		if length > len(values) {
+			switch schema.AdditionalItems.Type {
+			case bsontype.Boolean:
+				if !schema.AdditionalItems.Boolean() {
+					return nil, fmt.Errorf("field %s: minItems needs more items than allowed", path)
+				}
+			case bsontype.EmbeddedDocument:
+				if additional, err = parseJSONSchema(schema.AdditionalItems.Document()); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for i := range items {
+			if i >= len(values) {
+				items[i] = additional
+				continue
+			}
+			raw, ok := values[i].DocumentOK()
+			if !ok {
+				return nil, fmt.Errorf("field %s: item %d is not a schema", path, i)
+			}
+			if items[i], err = parseJSONSchema(raw); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		for i := range items {
+			items[i] = &jsonSchema{}
+		}
+	}
+	out := make(bson.A, 0, len(items))
+	seen := map[string]bool{}
+	for i, itemSchema := range items {
+		var item interface{}
+		for attempt := 0; ; attempt++ {
+			elemSeed := int64(binary.BigEndian.Uint64(g.source(path + "." + strconv.Itoa(i+attempt*len(items))).bytes(8)))
+			elemGenerator := &generator{config: g.config, seed: elemSeed, doc: g.doc}
+			value, err := elemGenerator.generateSchemaValue(itemSchema, path, true)
+			if err != nil {
+				return nil, err
+			}
+			key := schemaValueString(value)
+			if !schema.UniqueItems || !seen[key] {
+				item, seen[key] = value, true
+				break
+			}
+			if attempt == schemaStringAttempts {
+				return nil, fmt.Errorf("field %s: could not generate %d unique items", path, len(items))
+			}
+		}
+		out = append(out, item)
+	}
+	return out, nil
+}
+
+// generateSchemaString generates a string matching the pattern and length limits of schema
+func generateSchemaString(src *fakeSource, schema *jsonSchema, path string) (string, error) {
+	min, max := 0, -1
+	if schema.MinLength != nil {
+		min = int(*schema.MinLength)
+	}
+	if schema.MaxLength != nil {
+		max = int(*schema.MaxLength)
+	}
+	if len(schema.Pattern) == 0 {
+		str := generateString(src, path, fakerHints{})
+		for utf8.RuneCountInString(str) < min {
+			str += string(rune('a' + src.intn(26)))
+		}
+		if max >= 0 && utf8.RuneCountInString(str) > max {
+			str = string([]rune(str)[:max])
+		}
+		return str, nil
+	}
+	matcher, err := regexp.Compile(schema.Pattern)
+	if err != nil {
+		return "", fmt.Errorf("pattern %s is not supported: %w", schema.Pattern, err)
+	}
+	re, err := syntax.Parse(schema.Pattern, syntax.Perl)
+	if err != nil {
+		return "", fmt.Errorf("pattern %s is not supported: %w", schema.Pattern, err)
+	}
+	re = re.Simplify()
+	for attempt := 0; attempt < schemaStringAttempts; attempt++ {
+		var sb strings.Builder
+		writePatternString(src, re, &sb)
+		str := sb.String()
+		length := utf8.RuneCountInString(str)
+		if length >= min && (max < 0 || length <= max) && matcher.MatchString(str) {
+			return str, nil
+		}
+	}
+	return "", fmt.Errorf("could not generate a string matching %s with a length between %d and %d", schema.Pattern, min, max)
+}
+
+// patternAnyChars are the characters generated for '.'
+const patternAnyChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// writePatternString writes a random string matching re to sb
+func writePatternString(src *fakeSource, re *syntax.Regexp, sb *strings.Builder) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		sb.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		// Prefer printable ASCII characters, when the class allows them
+		var ranges []rune
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if lo < ' ' {
+				lo = ' '
+			}
+			if hi > '~' {
+				hi = '~'
+			}
+			if lo <= hi {
+				ranges = append(ranges, lo, hi)
+			}
+		}
+		if len(ranges) == 0 {
+			ranges = re.Rune
+		}
+		if len(ranges) == 0 {
+			return
+		}
+		i := 2 * src.intn(len(ranges)/2)
+		sb.WriteRune(ranges[i] + rune(src.intn(int(ranges[i+1]-ranges[i])+1)))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		sb.WriteByte(patternAnyChars[src.intn(len(patternAnyChars))])
+	case syntax.OpCapture:
+		writePatternString(src, re.Sub[0], sb)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		min, max := 0, 3
+		switch re.Op {
+		case syntax.OpPlus:
+			min, max = 1, 4
+		case syntax.OpQuest:
+			max = 1
+		case syntax.OpRepeat:
+			min, max = re.Min, re.Max
+			if max < 0 {
+				max = min + 3
+			}
+		}
+		for i := min + src.intn(max-min+1); i > 0; i-- {
+			writePatternString(src, re.Sub[0], sb)
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			writePatternString(src, sub, sb)
+		}
+	case syntax.OpAlternate:
+		writePatternString(src, re.Sub[src.intn(len(re.Sub))], sb)
+	}
+}
+
+// schemaViolation is a way to break a rule of the validator in a generated document
+type schemaViolation struct {
+	path    string
+	problem string
+	// apply returns the value at path which breaks the rule, or false to remove the value
+	apply func(value interface{}) (interface{}, bool)
+}
+
+// violate breaks a single rule of schema in doc
+func (g *generator) violate(schema *jsonSchema, doc bson.D) (InvalidDocument, error) {
+	violations, err := schemaViolations(schema, "", doc)
+	if err != nil {
+		return InvalidDocument{}, err
+	}
+	if len(violations) == 0 {
+		return InvalidDocument{}, fmt.Errorf("the validator has no rules which can be broken")
+	}
+	violation := violations[g.source("$violation").intn(len(violations))]
+	invalid := InvalidDocument{Violation: violation.path + ": " + violation.problem}
+	if len(violation.path) == 0 {
+		value, _ := violation.apply(doc)
+		invalid.Document = value.(bson.D)
+		invalid.Violation = "(document): " + violation.problem
+		return invalid, nil
+	}
+	invalid.Document, err = transformPath(doc, strings.Split(violation.path, "."), func(value interface{}) (interface{}, bool, error) {
+		value, keep := violation.apply(value)
+		return value, keep, nil
+	})
+	return invalid, err
+}
+
+// schemaViolations returns the ways value (at path) could break the rules of schema. Rules are
+// only broken in embedded documents, not in arrays of them.
+func schemaViolations(schema *jsonSchema, path string, value interface{}) ([]schemaViolation, error) {
+	var violations []schemaViolation
+	add := func(problem string, replacement interface{}) {
+		violations = append(violations, schemaViolation{path: path, problem: problem, apply: func(interface{}) (interface{}, bool) {
+			return replacement, true
+		}})
+	}
+	if types := schema.types(); len(types) != 0 && len(path) != 0 {
+		add("not of type "+strings.Join(types, "|"), wrongTypeValue(types))
+	}
+	if len(schema.Enum) != 0 && len(path) != 0 {
+		add("not one of the enum values", "<not in enum>")
+	}
+	switch typed := value.(type) {
+	case int32, int64, float64:
+		if schema.Minimum != nil {
+			below := *schema.Minimum - 1
+			if schema.ExclusiveMinimum {
+				below = *schema.Minimum
+			}
+			add(fmt.Sprintf("below the minimum of %v", *schema.Minimum), numberLike(typed, math.Floor(below)))
+		}
+		if schema.Maximum != nil {
+			above := *schema.Maximum + 1
+			if schema.ExclusiveMaximum {
+				above = *schema.Maximum
+			}
+			add(fmt.Sprintf("above the maximum of %v", *schema.Maximum), numberLike(typed, math.Ceil(above)))
+		}
+	case string:
+		if runes := []rune(typed); schema.MinLength != nil && *schema.MinLength > 0 && int64(len(runes)) >= *schema.MinLength {
+			add(fmt.Sprintf("shorter than the minLength of %d", *schema.MinLength), string(runes[:*schema.MinLength-1]))
+		}
+		if schema.MaxLength != nil {
+			add(fmt.Sprintf("longer than the maxLength of %d", *schema.MaxLength), typed+strings.Repeat("x", int(*schema.MaxLength)+1))
+		}
+		if len(schema.Pattern) != 0 {
+			if matcher, err := regexp.Compile(schema.Pattern); err == nil {
+				for _, candidate := range []string{"", "!", "<does not match>", "0"} {
+					if !matcher.MatchString(candidate) {
+						add("does not match the pattern "+schema.Pattern, candidate)
+						break
+					}
+				}
+			}
+		}
+	case bson.A:
+		if schema.MinItems != nil && *schema.MinItems > 0 && int64(len(typed)) >= *schema.MinItems {
+			add(fmt.Sprintf("fewer than the minItems of %d", *schema.MinItems), typed[:*schema.MinItems-1])
+		}
+		if schema.MaxItems != nil && len(typed) != 0 {
+			longer := append(bson.A{}, typed...)
+			for int64(len(longer)) <= *schema.MaxItems {
+				longer = append(longer, typed[0])
+			}
+			add(fmt.Sprintf("more than the maxItems of %d", *schema.MaxItems), longer)
+		}
+		if schema.UniqueItems && len(typed) != 0 {
+			add("has duplicate items", append(append(bson.A{}, typed...), typed[0]))
+		}
+	case bson.D:
+		for _, name := range schema.Required {
+			if len(path) == 0 && name == "_id" {
+				// The driver adds an _id to documents inserted without one
+				continue
+			}
+			for _, elem := range typed {
+				if elem.Key == name {
+					violations = append(violations, schemaViolation{
+						path:    joinSchemaPath(path, name),
+						problem: "missing the required field",
+						apply:   func(interface{}) (interface{}, bool) { return nil, false },
+					})
+					break
+				}
+			}
+		}
+		if allowed, ok := schema.AdditionalProperties.BooleanOK(); ok && !allowed {
+			add("has the unexpected field unexpectedField", append(append(bson.D{}, typed...), bson.E{Key: "unexpectedField", Value: true}))
+		}
+		props, err := schema.properties()
+		if err != nil {
+			return nil, err
+		}
+		for _, prop := range props {
+			for _, elem := range typed {
+				if elem.Key != prop.name {
+					continue
+				}
+				nested, err := schemaViolations(prop.schema, joinSchemaPath(path, prop.name), elem.Value)
+				if err != nil {
+					return nil, err
+				}
+				violations = append(violations, nested...)
+			}
+		}
+	}
+	return violations, nil
+}
+
+// wrongTypeValue returns a value which isn't any of types
+func wrongTypeValue(types []string) interface{} {
+	allowed := map[string]bool{}
+	for _, name := range types {
+		allowed[name] = true
+	}
+	candidates := []struct {
+		types []string
+		value interface{}
+	}{
+		{[]string{"string"}, "<wrong type>"},
+		{[]string{"int", "number"}, int32(42)},
+		{[]string{"bool"}, true},
+		{[]string{"object"}, bson.D{{Key: "wrongType", Value: true}}},
+	}
+	for _, candidate := range candidates {
+		if !allowed[candidate.types[0]] && (len(candidate.types) == 1 || !allowed[candidate.types[1]]) {
+			return candidate.value
+		}
+	}
+	return bson.A{"<wrong type>"}
+}
+
+// numberLike returns the whole number f as the same numeric type as value
+func numberLike(value interface{}, f float64) interface{} {
+	switch value.(type) {
+	case int32:
+		if f >= math.MinInt32 && f <= math.MaxInt32 {
+			return int32(f)
+		}
+		return int64(f)
+	case int64:
+		return int64(f)
+	}
+	return f
+}
+
+// joinSchemaPath appends name to the dotted path
+func joinSchemaPath(path, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
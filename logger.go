@@ -0,0 +1,143 @@
+package mongotest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are structured key/value pairs attached to a log message
+type Fields map[string]interface{}
+
+// Logger is the sink mongotest writes all of its logging to. Adapters are provided for
+// logrus (NewLogrusLogger), log/slog (NewSlogLogger) and testing.TB (NewTestingLogger).
+// By default, mongotest is silent.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+var (
+	defaultLoggerMu sync.RWMutex
+	pkgLogger       Logger = NopLogger()
+)
+
+func init() {
+	// mongo-tools logs through its own global logger - forward it to ours
+	log.SetWriter(&toolsLogWriter{})
+}
+
+// SetDefaultLogger sets the logger used by any TestConnection which wasn't created using
+// WithLogger, by ReapRunningContainers and by the vendored mongo-tools (which only supports
+// a single, global logger). Passing nil restores the silent default.
+func SetDefaultLogger(l Logger) {
+	if l == nil {
+		l = NopLogger()
+	}
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	pkgLogger = l
+}
+
+// defaultLogger returns the logger set using SetDefaultLogger
+func defaultLogger() Logger {
+	defaultLoggerMu.RLock()
+	defer defaultLoggerMu.RUnlock()
+	return pkgLogger
+}
+
+// NopLogger returns a Logger which discards everything written to it
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, Fields) {}
+func (nopLogger) Info(string, Fields)  {}
+func (nopLogger) Error(string, Fields) {}
+
+// NewLogrusLogger adapts a logrus logger (or entry) into a Logger
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	return &logrusLogger{l: l}
+}
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+func (ll *logrusLogger) Debug(msg string, fields Fields) {
+	ll.l.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+func (ll *logrusLogger) Info(msg string, fields Fields) {
+	ll.l.WithFields(logrus.Fields(fields)).Info(msg)
+}
+func (ll *logrusLogger) Error(msg string, fields Fields) {
+	ll.l.WithFields(logrus.Fields(fields)).Error(msg)
+}
+
+// NewTestingLogger returns a Logger which writes to the test log using tb.Logf, so output is
+// only shown when the test fails or when running with -v.
+func NewTestingLogger(tb testing.TB) Logger {
+	return &testingLogger{tb: tb}
+}
+
+type testingLogger struct {
+	tb testing.TB
+}
+
+func (tl *testingLogger) Debug(msg string, fields Fields) {
+	tl.tb.Helper()
+	tl.tb.Logf("DEBUG %s", formatLogLine(msg, fields))
+}
+func (tl *testingLogger) Info(msg string, fields Fields) {
+	tl.tb.Helper()
+	tl.tb.Logf("INFO %s", formatLogLine(msg, fields))
+}
+func (tl *testingLogger) Error(msg string, fields Fields) {
+	tl.tb.Helper()
+	tl.tb.Logf("ERROR %s", formatLogLine(msg, fields))
+}
+
+// formatLogLine renders a message and its fields as "msg key=value ..." with sorted keys
+func formatLogLine(msg string, fields Fields) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, k := range sortedFieldKeys(fields) {
+		fmt.Fprintf(&sb, " %s=%v", k, fields[k])
+	}
+	return sb.String()
+}
+
+// sortedFieldKeys returns the keys of fields in a stable order
+func sortedFieldKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// toolsLogWriter is handed to mongo-tools as its log output and forwards each line to
+// the default logger
+type toolsLogWriter struct{}
+
+func (tlw *toolsLogWriter) Write(p []byte) (int, error) {
+	logger := defaultLogger()
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) != 0 {
+			logger.Debug(line, Fields{"src": "mongo-tools"})
+		}
+	}
+	return len(p), nil
+}
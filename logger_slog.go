@@ -0,0 +1,35 @@
+//go:build go1.21
+
+package mongotest
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger adapts a log/slog logger into a Logger
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (sl *slogLogger) Debug(msg string, fields Fields) {
+	sl.log(slog.LevelDebug, msg, fields)
+}
+func (sl *slogLogger) Info(msg string, fields Fields) {
+	sl.log(slog.LevelInfo, msg, fields)
+}
+func (sl *slogLogger) Error(msg string, fields Fields) {
+	sl.log(slog.LevelError, msg, fields)
+}
+
+func (sl *slogLogger) log(level slog.Level, msg string, fields Fields) {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, k := range sortedFieldKeys(fields) {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+	sl.l.LogAttrs(context.Background(), level, msg, attrs...)
+}
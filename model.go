@@ -0,0 +1,427 @@
+package mongotest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// modelTag is the struct tag declaring indexes on a model
+const modelTag = "mongotest"
+
+// ModelOption configures EnsureModel and SchemaForModel
+type ModelOption func(mc *modelConfig)
+
+type modelConfig struct {
+	validator        bool
+	validationLevel  string
+	validationAction string
+}
+
+// WithModelValidator also generates a $jsonSchema validator from the model's field types.
+// Fields are required unless they're pointers or tagged omitempty.
+func WithModelValidator() ModelOption {
+	return func(mc *modelConfig) {
+		mc.validator = true
+	}
+}
+
+// WithModelValidationLevel sets the validationLevel ("off", "strict" or "moderate") used with
+// WithModelValidator
+func WithModelValidationLevel(level string) ModelOption {
+	return func(mc *modelConfig) {
+		mc.validationLevel = level
+	}
+}
+
+// WithModelValidationAction sets the validationAction ("error" or "warn") used with
+// WithModelValidator
+func WithModelValidationAction(action string) ModelOption {
+	return func(mc *modelConfig) {
+		mc.validationAction = action
+	}
+}
+
+// EnsureModel creates the indexes declared on the model T using `mongotest` struct tags, so the
+// indexes live next to the model and tests use the same ones as production. Field names come
+// from the bson tags, the same way the driver encodes T. Each tag is a list of indexes separated
+// by ';', each with comma separated options:
+//
+//	type User struct {
+//		ID        primitive.ObjectID `bson:"_id"`
+//		Email     string             `bson:"email" mongotest:"index,unique"`
+//		LastName  string             `bson:"lastName" mongotest:"index=byName"`
+//		FirstName string             `bson:"firstName" mongotest:"index=byName"`
+//		CreatedAt time.Time          `bson:"createdAt" mongotest:"index,desc;index=expiry,ttl=86400"`
+//	}
+//
+//	err := mongotest.EnsureModel[User](conn, "app", "users", mongotest.WithModelValidator())
+//
+// "index" indexes the field on its own, while "index=<name>" adds it to the compound index
+// <name>, in field order. The options are:
+//   - unique: the index is unique (any field of a compound index can set this)
+//   - sparse: the index is sparse
+//   - desc: the field is indexed in descending order
+//   - ttl=<seconds>: documents expire once the (date) field is this old
+//
+// The collection is created if needed. Changed indexes are replaced, while other indexes are
+// left alone (see ApplySchema).
+func EnsureModel[T any](conn *TestConnection, dbName, collName string, opts ...ModelOption) error {
+	collSchema, err := SchemaForModel[T](collName, opts...)
+	if err != nil {
+		return err
+	}
+	return conn.ApplySchema(&Schema{Databases: []DatabaseSchema{{
+		Name:        dbName,
+		Collections: []CollectionSchema{collSchema},
+	}}})
+}
+
+// SchemaForModel returns the collection schema EnsureModel applies for the model T, e.g. to
+// compare it with a live database using CheckSchema or to write it to a spec file
+func SchemaForModel[T any](collName string, opts ...ModelOption) (CollectionSchema, error) {
+	mc := &modelConfig{}
+	for _, opt := range opts {
+		opt(mc)
+	}
+	modelType := reflect.TypeOf((*T)(nil)).Elem()
+	for modelType.Kind() == reflect.Ptr {
+		modelType = modelType.Elem()
+	}
+	if modelType.Kind() != reflect.Struct {
+		return CollectionSchema{}, fmt.Errorf("models must be structs, not %s", modelType)
+	}
+	collSchema := CollectionSchema{Name: collName}
+	indexes, err := modelIndexes(modelType)
+	if err != nil {
+		return collSchema, fmt.Errorf("invalid %s tag on %s: %w", modelTag, modelType, err)
+	}
+	collSchema.Indexes = indexes
+	if mc.validator {
+		collSchema.Validator = bson.D{{Key: "$jsonSchema", Value: structJSONSchema(modelType, map[reflect.Type]bool{})}}
+		collSchema.ValidationLevel = mc.validationLevel
+		collSchema.ValidationAction = mc.validationAction
+	}
+	return collSchema, nil
+}
+
+// modelField is a field of a model, as the driver encodes it
+type modelField struct {
+	field reflect.StructField
+	// key is the BSON key of the field
+	key       string
+	omitEmpty bool
+	inline    bool
+}
+
+// modelFields returns the encoded fields of a struct type, following the driver's default
+// struct tag rules: the bson tag names the field (defaulting to the lowercased field name),
+// and "-" skips it
+func modelFields(structType reflect.Type) []modelField {
+	var fields []modelField
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, ok := field.Tag.Lookup("bson")
+		if !ok && !strings.Contains(string(field.Tag), ":") {
+			// The driver also accepts a bare tag as the bson tag
+			tag = string(field.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		mf := modelField{field: field, key: parts[0]}
+		if len(mf.key) == 0 {
+			mf.key = strings.ToLower(field.Name)
+		}
+		for _, option := range parts[1:] {
+			switch option {
+			case "omitempty":
+				mf.omitEmpty = true
+			case "inline":
+				mf.inline = true
+			}
+		}
+		fields = append(fields, mf)
+	}
+	return fields
+}
+
+// modelIndexes collects the indexes declared by the mongotest tags in structType, including
+// those in embedded documents
+func modelIndexes(structType reflect.Type) ([]IndexSchema, error) {
+	var indexes []IndexSchema
+	groups := map[string]int{}
+	err := collectModelIndexes(structType, "", map[reflect.Type]bool{}, &indexes, groups)
+	return indexes, err
+}
+
+func collectModelIndexes(structType reflect.Type, prefix string, visiting map[reflect.Type]bool, indexes *[]IndexSchema, groups map[string]int) error {
+	if visiting[structType] {
+		// Recursive types can't declare indexes any deeper
+		return nil
+	}
+	visiting[structType] = true
+	defer delete(visiting, structType)
+	for _, mf := range modelFields(structType) {
+		path := prefix + mf.key
+		if mf.inline {
+			path = strings.TrimSuffix(prefix, ".")
+		}
+		if tag, ok := mf.field.Tag.Lookup(modelTag); ok {
+			if mf.inline {
+				// Inlined fields have no key of their own to index
+				return fmt.Errorf("field %s: inline fields can't declare indexes, tag their fields instead", mf.field.Name)
+			}
+			if err := addModelIndexes(tag, path, indexes, groups); err != nil {
+				return fmt.Errorf("field %s: %w", mf.field.Name, err)
+			}
+		}
+		if nested := modelStructType(mf.field.Type); nested != nil {
+			nestedPrefix := path + "."
+			if len(path) == 0 {
+				nestedPrefix = ""
+			}
+			if err := collectModelIndexes(nested, nestedPrefix, visiting, indexes, groups); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// modelStructType returns the embedded document type of a field (including elements of slices
+// and pointers), or nil if the field isn't a document
+func modelStructType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || isBSONValueType(t) {
+		return nil
+	}
+	return t
+}
+
+// addModelIndexes parses a mongotest tag on the field at path
+func addModelIndexes(tag, path string, indexes *[]IndexSchema, groups map[string]int) error {
+	for _, declaration := range strings.Split(tag, ";") {
+		declaration = strings.TrimSpace(declaration)
+		if len(declaration) == 0 {
+			continue
+		}
+		options := strings.Split(declaration, ",")
+		kind, group := options[0], ""
+		if i := strings.Index(kind, "="); i != -1 {
+			kind, group = kind[:i], kind[i+1:]
+		}
+		if kind != "index" {
+			return fmt.Errorf("expected 'index' or 'index=<name>', found '%s'", options[0])
+		}
+		var index IndexSchema
+		direction := int32(1)
+		for _, option := range options[1:] {
+			name, value := option, ""
+			if i := strings.Index(option, "="); i != -1 {
+				name, value = option[:i], option[i+1:]
+			}
+			switch name {
+			case "unique":
+				index.Unique = true
+			case "sparse":
+				index.Sparse = true
+			case "desc":
+				direction = -1
+			case "ttl":
+				seconds, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid ttl '%s': %w", value, err)
+				}
+				index.ExpireAfterSeconds = &seconds
+			default:
+				return fmt.Errorf("unknown index option '%s'", option)
+			}
+		}
+		key := bson.E{Key: path, Value: direction}
+		if len(group) == 0 {
+			index.Keys = bson.D{key}
+			*indexes = append(*indexes, index)
+			continue
+		}
+		i, ok := groups[group]
+		if !ok {
+			index.Name = group
+			index.Keys = bson.D{key}
+			groups[group] = len(*indexes)
+			*indexes = append(*indexes, index)
+			continue
+		}
+		existing := &(*indexes)[i]
+		existing.Keys = append(existing.Keys, key)
+		existing.Unique = existing.Unique || index.Unique
+		existing.Sparse = existing.Sparse || index.Sparse
+		if index.ExpireAfterSeconds != nil {
+			existing.ExpireAfterSeconds = index.ExpireAfterSeconds
+		}
+		if existing.ExpireAfterSeconds != nil {
+			// The server only expires documents through single field indexes
+			return fmt.Errorf("index '%s': ttl needs an index with a single key", group)
+		}
+	}
+	return nil
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	objectIDType   = reflect.TypeOf(primitive.ObjectID{})
+	dateTimeType   = reflect.TypeOf(primitive.DateTime(0))
+	decimal128Type = reflect.TypeOf(primitive.Decimal128{})
+	binaryType     = reflect.TypeOf(primitive.Binary{})
+	timestampType  = reflect.TypeOf(primitive.Timestamp{})
+	regexType      = reflect.TypeOf(primitive.Regex{})
+	rawType        = reflect.TypeOf(bson.Raw{})
+	documentType   = reflect.TypeOf(bson.D{})
+	arrayType      = reflect.TypeOf(bson.A{})
+)
+
+// isBSONValueType reports whether t is encoded as a single BSON value rather than a document
+func isBSONValueType(t reflect.Type) bool {
+	switch t {
+	case timeType, objectIDType, decimal128Type, binaryType, timestampType, regexType:
+		return true
+	}
+	return false
+}
+
+// structJSONSchema returns the $jsonSchema matching the encoding of structType
+func structJSONSchema(structType reflect.Type, visiting map[reflect.Type]bool) bson.D {
+	schema := bson.D{{Key: "bsonType", Value: "object"}}
+	if visiting[structType] {
+		// Recursive types are only checked to be documents below the first level
+		return schema
+	}
+	visiting[structType] = true
+	defer delete(visiting, structType)
+	required := bson.A{}
+	properties := bson.D{}
+	for _, mf := range modelFields(structType) {
+		if mf.inline {
+			if nested := modelStructType(mf.field.Type); nested != nil {
+				inlined := structJSONSchema(nested, visiting).Map()
+				if props, ok := inlined["properties"].(bson.D); ok {
+					properties = append(properties, props...)
+				}
+				if req, ok := inlined["required"].(bson.A); ok {
+					required = append(required, req...)
+				}
+			}
+			continue
+		}
+		fieldSchema := typeJSONSchema(mf.field.Type, visiting)
+		if fieldSchema != nil {
+			properties = append(properties, bson.E{Key: mf.key, Value: fieldSchema})
+		}
+		if !mf.omitEmpty && mf.field.Type.Kind() != reflect.Ptr && mf.field.Type.Kind() != reflect.Interface {
+			required = append(required, mf.key)
+		}
+	}
+	if len(required) != 0 {
+		schema = append(schema, bson.E{Key: "required", Value: required})
+	}
+	if len(properties) != 0 {
+		schema = append(schema, bson.E{Key: "properties", Value: properties})
+	}
+	return schema
+}
+
+// typeJSONSchema returns the $jsonSchema for values of type t, or nil if any value is allowed
+func typeJSONSchema(t reflect.Type, visiting map[reflect.Type]bool) bson.D {
+	switch t {
+	case timeType, dateTimeType:
+		return bson.D{{Key: "bsonType", Value: "date"}}
+	case objectIDType:
+		return bson.D{{Key: "bsonType", Value: "objectId"}}
+	case decimal128Type:
+		return bson.D{{Key: "bsonType", Value: "decimal"}}
+	case binaryType:
+		return bson.D{{Key: "bsonType", Value: "binData"}}
+	case timestampType:
+		return bson.D{{Key: "bsonType", Value: "timestamp"}}
+	case regexType:
+		return bson.D{{Key: "bsonType", Value: "regex"}}
+	case rawType, documentType:
+		return bson.D{{Key: "bsonType", Value: "object"}}
+	case arrayType:
+		return bson.D{{Key: "bsonType", Value: "array"}}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem := typeJSONSchema(t.Elem(), visiting)
+		if elem == nil {
+			return nil
+		}
+		// nil pointers are encoded as null
+		return withNullBSONType(elem)
+	case reflect.String:
+		return bson.D{{Key: "bsonType", Value: "string"}}
+	case reflect.Bool:
+		return bson.D{{Key: "bsonType", Value: "bool"}}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return bson.D{{Key: "bsonType", Value: "int"}}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		// The driver encodes these as an int32 whenever the value fits
+		return bson.D{{Key: "bsonType", Value: bson.A{"int", "long"}}}
+	case reflect.Float32, reflect.Float64:
+		return bson.D{{Key: "bsonType", Value: "double"}}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return bson.D{{Key: "bsonType", Value: "binData"}}
+		}
+		schema := bson.D{{Key: "bsonType", Value: "array"}}
+		if items := typeJSONSchema(t.Elem(), visiting); items != nil {
+			schema = append(schema, bson.E{Key: "items", Value: items})
+		}
+		if t.Kind() == reflect.Slice {
+			// nil slices are encoded as null
+			return withNullBSONType(schema)
+		}
+		return schema
+	case reflect.Map:
+		schema := bson.D{{Key: "bsonType", Value: "object"}}
+		if values := typeJSONSchema(t.Elem(), visiting); values != nil {
+			schema = append(schema, bson.E{Key: "additionalProperties", Value: values})
+		}
+		return withNullBSONType(schema)
+	case reflect.Struct:
+		return structJSONSchema(t, visiting)
+	}
+	return nil
+}
+
+// withNullBSONType also allows null values for schema
+func withNullBSONType(schema bson.D) bson.D {
+	out := make(bson.D, len(schema))
+	copy(out, schema)
+	for i, elem := range out {
+		if elem.Key != "bsonType" {
+			continue
+		}
+		switch bsonType := elem.Value.(type) {
+		case string:
+			out[i].Value = bson.A{bsonType, "null"}
+		case bson.A:
+			out[i].Value = append(append(bson.A{}, bsonType...), "null")
+		}
+	}
+	return out
+}
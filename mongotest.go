@@ -1,14 +1,12 @@
 // Package mongotest provides helpers for running regressions using mongo.
 // You can find helpers for:
 // - running a database using docker
-// - TODO: importing data to the DB from files
-// - TODO: exporting data from the DB to a file
-// - TODO: cleaning up a database
+// - importing data to the DB from files (see DatabaseImporter)
+// - exporting data from the DB to files (see DatabaseExporter and ExportDatabase)
+// - cleaning up a database between tests (see DropAllDatabases and ResetData)
 package mongotest
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -19,8 +17,8 @@ import (
 	docker "github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/sirupsen/logrus"
 	"github.com/tophergopher/easymongo"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"io"
 	"io/ioutil"
@@ -30,6 +28,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,12 +38,16 @@ import (
 type TestConnection struct {
 	*easymongo.Connection
 	dockerClient     *docker.Client
-	logger           *logrus.Entry
+	logger           Logger
 	mongoContainerID string
 	caPemFile        *os.File
 	portNumber       int
 	mongoURI         string
 	mongoVersion     string
+	mongoImage       string
+	imageOverride    string
+	dbPath           string
+	failureLogLines  int
 }
 
 // initDocker initializes the various docker components we need
@@ -52,7 +55,7 @@ type TestConnection struct {
 func (testConn *TestConnection) initDocker() error {
 	dockerClient, err := docker.NewEnvClient()
 	if err != nil {
-		testConn.logger.WithField("err", err).Error("Could not connect to docker daemon")
+		testConn.logger.Error("Could not connect to docker daemon", Fields{"err": err})
 		return ErrFailedToConnectToDockerDaemon
 	}
 	testConn.dockerClient = dockerClient
@@ -65,13 +68,12 @@ func (testConn *TestConnection) initDocker() error {
 func (testConn *TestConnection) spawnAndStartMongoContainer(initTLS bool, replicaSetName *string) (err error) {
 	testConn.portNumber, err = GetAvailablePort()
 	if err != nil {
-		testConn.logger.WithField("err", err).Error("No ports were available to bind the test docker mongo container to")
+		testConn.logger.Error("No ports were available to bind the test docker mongo container to", Fields{"err": err})
 		return ErrNoAvailablePorts
 	}
-	// TODO: Consider using different error types for these returns
 	testConn.mongoContainerID, err = testConn.startMongoContainer(testConn.mongoVersion, testConn.portNumber, initTLS, replicaSetName)
 	if err != nil {
-		testConn.logger.WithField("err", err).Error("Could not spawn the to mongo container")
+		testConn.logger.Error("Could not spawn the to mongo container", Fields{"err": err})
 		return err
 	}
 	testConn.mongoURI = fmt.Sprintf("mongodb://127.0.0.1:%d/?directConnection=true", testConn.portNumber)
@@ -83,8 +85,8 @@ func (testConn *TestConnection) spawnAndStartMongoContainer(initTLS bool, replic
 
 // NewReplicaSetContainer spawns a new docker container and configures it as a 1 member
 // replicaset. The resulting connection is returned.
-func NewReplicaSetContainer(rsName string) (*TestConnection, error) {
-	conn, err := initTestConnectionAndContainer(true, &rsName)
+func NewReplicaSetContainer(rsName string, opts ...Option) (*TestConnection, error) {
+	conn, err := initTestConnectionAndContainer(true, &rsName, opts...)
 	if err != nil {
 		return conn, err
 	}
@@ -100,43 +102,47 @@ func NewReplicaSetContainer(rsName string) (*TestConnection, error) {
 // If spinupDockerContainer is False, then no docker shenanigans occur, instead
 // an attempt is made to connect to a locally running mongo instance
 // (e.g. mongodb://127.0.0.1:27017).
-func NewTestConnection(spinupDockerContainer bool) (*TestConnection, error) {
-	return initTestConnectionAndContainer(spinupDockerContainer, nil)
+// Options can be provided to further configure the TestConnection (e.g. WithLogger).
+func NewTestConnection(spinupDockerContainer bool, opts ...Option) (*TestConnection, error) {
+	return initTestConnectionAndContainer(spinupDockerContainer, nil, opts...)
 }
 
 // initTestConnectionAndContainer does all the juicy logic of actually creating a docker client,
 // spawning the mongo container, connecting to the mongo container and optionally initializing a replicaSet.
-func initTestConnectionAndContainer(spinupDockerContainer bool, replicaSetName *string) (*TestConnection, error) {
-	// TODO: How should we be handling logging? What do other libraries typically do?
-	logger := logrus.New().WithField("src", "mongotest.TestConnection")
-	testConn := &TestConnection{
-		logger:       logger,
+func initTestConnectionAndContainer(spinupDockerContainer bool, replicaSetName *string, opts ...Option) (testConn *TestConnection, err error) {
+	testConn = &TestConnection{
+		logger:       defaultLogger(),
 		mongoVersion: "latest",
 	}
+	for _, opt := range opts {
+		opt(testConn)
+	}
+	logger := testConn.logger
 	defer func() {
-		if err := recover(); err != nil {
-			logger.WithFields(logrus.Fields{
-				"err":   err,
+		if r := recover(); r != nil {
+			logger.Error("A panic occurred when trying to initialize a TestConnection - auto-destroying mongo container", Fields{
+				"err":   r,
 				"stack": string(debug.Stack()),
-			}).Error("A panic occurred when trying to initialize a TestConnection - auto-destroying mongo container")
-			// Initialization crashed - ensure the mongo container is destroyed
+			})
+			// Initialization crashed - ensure the mongo container is destroyed and report
+			// the panic as an error instead
 			_ = testConn.KillMongoContainer()
-			// Re-raise the panic
-			panic(err)
+			err = fmt.Errorf("a panic occurred when trying to initialize a TestConnection: %v", r)
 		}
 	}()
 	if err := testConn.initDocker(); err != nil {
-		logger.WithFields(logrus.Fields{
+		logger.Error("Could not init the docker client - is the docker damon running?", Fields{
 			"err":      err,
 			"mongoURI": testConn.mongoURI,
-		}).Error("Could not init the docker client - is the docker damon running?")
+		})
 		return testConn, err
 	}
 	if spinupDockerContainer {
 		initTLS := false
 		err := testConn.spawnAndStartMongoContainer(initTLS, replicaSetName)
 		if err != nil {
-			// Error logged already
+			// Error logged already - the container may have been created without starting
+			_ = testConn.KillMongoContainer()
 			return testConn, err
 		}
 		// Try using a finalizer to kill the mongo container if it goes out of scope
@@ -147,41 +153,15 @@ func initTestConnectionAndContainer(spinupDockerContainer bool, replicaSetName *
 		// Cache the connection to allow for auto-reaping later
 		cacheConnection(testConn)
 	}
-	if replicaSetName != nil {
-		// Set up the replicaset prior to connecting
-		mongoRsInitScript := fmt.Sprintf("rs.initiate({'_id': 'cf', 'members': [{'_id': 0, 'host': 'localhost:27017'}]})")
-		numRetries := 3
-		var output string
-		var err error
-		for i := 1; i <= numRetries; i++ {
-			output, err = testConn.RunMongoScriptOnContainer(mongoRsInitScript)
-			if err == nil {
-				// If it came back successfully, break out of the retry loop
-				break
-			}
-			// Otherwise, wait a tick and try again - note that each retry waits a little longer - just a
-			// basic linear back-off.
-			time.Sleep(time.Millisecond * 200 * time.Duration(numRetries))
-			// If we are at the end of our retries, err will be preserved outside the loop
-		}
-		if err != nil {
-			logger.WithFields(logrus.Fields{
-				"err":      err,
-				"mongoURI": testConn.mongoURI,
-				"output":   output,
-			}).Error("Could not make container into a replicaset after multiple retries")
-			return testConn, err
-		}
-	}
 	conn, err := easymongo.ConnectWith(testConn.mongoURI).Connect()
 	testConn.Connection = conn
 	// also create a quick-fail connection for the ping
 	if err != nil {
-		logger.WithFields(logrus.Fields{
+		logger.Error("Could not connect to mongo instance", Fields{
 			"err":      err,
 			"mongoURI": testConn.mongoURI,
-		}).Error("Could not connect to mongo instance")
-		return testConn, err
+		})
+		return testConn, testConn.newError(PhaseReadiness, err)
 	}
 	// Allow up to 1 second for the mongo container to come up across 5 retrie=
 	numChecks := 5
@@ -200,38 +180,83 @@ func initTestConnectionAndContainer(spinupDockerContainer bool, replicaSetName *
 		// } else if errors.Is(err, topology.ErrServerSelectionTimeout) {
 		// 	fmt.Println("SERVER SELECTION TIMEOUT ERROR")
 		// }
-		logger.WithFields(logrus.Fields{
+		logger.Debug("Could not connect to test database - sleeping and retrying.", Fields{
 			"currentRetry":      i + 1,
 			"maxRetries":        numChecks,
 			"sleepMilliseconds": sleepTime.Milliseconds(),
-		}).Debug("Could not connect to test database - sleeping and retrying.")
+		})
 		// otherwise, we need to wait a bit before checking again
 		time.Sleep(sleepTime)
 	}
 	if err != nil {
-		logger.WithFields(logrus.Fields{
+		logger.Error(fmt.Sprintf("Could not ping the test mongo instance after %d checks", numChecks), Fields{
 			"err":      err,
 			"mongoURI": testConn.mongoURI,
-		}).Errorf("Could not ping the test mongo instance after %d checks", numChecks)
+		})
+		readinessErr := testConn.newError(PhaseReadiness,
+			fmt.Errorf("could not ping the test mongo instance after %d checks: %w", numChecks, err))
+		// Grab whatever mongod had to say before the container goes away
+		readinessErr.Logs = testConn.recentLogLines()
 		// Try to teardown the mongo container (it might not have started)
 		_ = testConn.KillMongoContainer()
-		return testConn, err
+		return testConn, readinessErr
+	}
+	if replicaSetName != nil {
+		if err = testConn.initiateReplicaSet(*replicaSetName); err != nil {
+			logger.Error("Could not make container into a replicaset", Fields{
+				"err":      err,
+				"mongoURI": testConn.mongoURI,
+			})
+			return testConn, testConn.newError(PhaseReplicaSetInit, err)
+		}
 	}
 	// The container is now alive and mongo is responding to pings
 	return testConn, nil
 }
 
+// alreadyInitializedCode is the server error code returned when initiating an initiated replica set
+const alreadyInitializedCode = 23
+
+// initiateReplicaSet makes the container into a single member replica set named rsName, then
+// waits for the member to become primary so it can accept writes
+func (tc *TestConnection) initiateReplicaSet(rsName string) error {
+	ctx := context.Background()
+	admin := tc.MongoDriverClient().Database("admin")
+	err := admin.RunCommand(ctx, bson.D{{Key: "replSetInitiate", Value: bson.D{
+		{Key: "_id", Value: rsName},
+		{Key: "members", Value: bson.A{
+			bson.D{{Key: "_id", Value: 0}, {Key: "host", Value: "localhost:27017"}},
+		}},
+	}}}).Err()
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == alreadyInitializedCode) {
+		return fmt.Errorf("could not initiate replica set '%s': %w", rsName, err)
+	}
+	// Elections usually take a couple of seconds - allow up to 30
+	numChecks := 60
+	sleepTime := time.Millisecond * 500
+	for i := 0; i < numChecks; i++ {
+		var status struct {
+			IsMaster bool `bson:"ismaster"`
+		}
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&status)
+		if err == nil && status.IsMaster {
+			return nil
+		}
+		time.Sleep(sleepTime)
+	}
+	if err == nil {
+		err = errors.New("the member never became primary")
+	}
+	return fmt.Errorf("replica set '%s' was not ready after %d checks: %w", rsName, numChecks, err)
+}
+
 // MongoContainerID returns the ID of the running docker container
 // If no container is running, an empty string will be returned.
 func (tc *TestConnection) MongoContainerID() string {
 	return tc.mongoContainerID
 }
 
-// func (tc *TestConnection) ImportFromFile(filepath string) {
-// 	// Open the file
-
-// }
-
 // GetAvailablePort returns an available port on the system.
 func GetAvailablePort() (port int, err error) {
 	// Create a new server without specifying a port
@@ -261,20 +286,20 @@ func GetAvailablePort() (port int, err error) {
 func (tc *TestConnection) pullMongoContainer(mongoImageName string) (err error) {
 	// TODO: Is this better to do as an error handler?
 	// Pull the initial container
-	tc.logger.Info("Starting mongo docker image pull")
+	tc.logger.Info("Starting mongo docker image pull", nil)
 	rc, err := tc.dockerClient.ImagePull(context.Background(), mongoImageName, types.ImagePullOptions{})
 	if err != nil {
-		return fmt.Errorf("could not pull mongo container: %v", err)
+		return tc.newError(PhaseImagePull, err)
 	}
 	defer rc.Close()
 	if _, err := ioutil.ReadAll(rc); err != nil {
-		return fmt.Errorf("could not pull mongo container: %v", err)
+		return tc.newError(PhaseImagePull, err)
 	}
-	tc.logger.Info("Done pulling mongo docker image")
+	tc.logger.Info("Done pulling mongo docker image", nil)
 	return nil
 }
 
-func containerConfig(mongoImageName, portName string, useTLS bool, replicaSetName *string) *container.Config {
+func containerConfig(mongoImageName, portName string, useTLS bool, replicaSetName *string, dbPath string) *container.Config {
 	conf := &container.Config{
 		Image: mongoImageName,
 		Labels: map[string]string{
@@ -298,23 +323,30 @@ func containerConfig(mongoImageName, portName string, useTLS bool, replicaSetNam
 	if replicaSetName != nil {
 		conf.Cmd = append(conf.Cmd, "--replSet", *replicaSetName)
 	}
+	if len(dbPath) != 0 {
+		conf.Cmd = append(conf.Cmd, "--dbpath", dbPath)
+	}
 	return conf
 }
 
 // These flags are based on this docker run command:
 // docker run -d -v /path/to/pem/:/etc/ssl/ mongo:3.6 --sslMode requireSSL --sslPEMKeyFile /etc/ssl/mongodb.pem <additional options>
-func dockerHostConfigWithTLS(portName string) (conf *container.HostConfig, caPemFile *os.File) {
+func dockerHostConfigWithTLS(portName string) (conf *container.HostConfig, caPemFile *os.File, err error) {
 	// Get the default dockerHostConfig
 	conf = dockerHostConfig(portName)
-	// Write out
-	caPemFile, err := ioutil.TempFile(os.TempDir(), "mongo-tls-")
+	_, pemFile, _, err := CreateCARoot()
 	if err != nil {
-		panic(fmt.Errorf("could not create temporary file during testing: %w", err))
+		return nil, nil, fmt.Errorf("could not generate CA cert during testing: %w", err)
 	}
-	_, pemFile, _ := GenerateCARoot()
-	_, err = caPemFile.Write(pemFile)
+	// Write out
+	caPemFile, err = ioutil.TempFile(os.TempDir(), "mongo-tls-")
 	if err != nil {
-		panic(fmt.Errorf("could not write cert to temporary file during testing: %w", err))
+		return nil, nil, fmt.Errorf("could not create temporary file during testing: %w", err)
+	}
+	if _, err = caPemFile.Write(pemFile); err != nil {
+		_ = caPemFile.Close()
+		_ = os.Remove(caPemFile.Name())
+		return nil, nil, fmt.Errorf("could not write cert to temporary file during testing: %w", err)
 	}
 	conf.Mounts = []mount.Mount{{
 		Type: mount.TypeBind,
@@ -324,7 +356,12 @@ func dockerHostConfigWithTLS(portName string) (conf *container.HostConfig, caPem
 		// the whole directory, but this should work
 		Target: "/etc/ssl/mongodb.pem",
 	}}
-	return conf, caPemFile
+	return conf, caPemFile, nil
+}
+
+// mongoImageForVersion returns the official mongo image for the provided version (tag)
+func mongoImageForVersion(mongoVersion string) string {
+	return "registry.hub.docker.com/library/mongo:" + mongoVersion
 }
 
 func dockerHostConfig(portName string) *container.HostConfig {
@@ -351,14 +388,22 @@ func (tc *TestConnection) startMongoContainer(mongoVersion string, portNumber in
 	}
 	portName := fmt.Sprintf("%d/tcp", portNumber)
 	containerName := fmt.Sprintf("mongo-%d", portNumber)
-	mongoImageName := "registry.hub.docker.com/library/mongo:" + mongoVersion
+	mongoImageName := mongoImageForVersion(mongoVersion)
+	if len(tc.imageOverride) != 0 {
+		mongoImageName = tc.imageOverride
+	}
+	tc.mongoImage = mongoImageName
 	hostConf := dockerHostConfig(portName)
 	if initTLS {
-		hostConf, tc.caPemFile = dockerHostConfigWithTLS(portName)
+		hostConf, tc.caPemFile, err = dockerHostConfigWithTLS(portName)
+		if err != nil {
+			tc.logger.Error("Could not configure TLS for the docker container", Fields{"err": err})
+			return "", tc.newError(PhaseContainerCreate, err)
+		}
 	}
 	containerResp, err := tc.dockerClient.ContainerCreate(
 		context.Background(),
-		containerConfig(mongoImageName, portName, initTLS, replicaSetName),
+		containerConfig(mongoImageName, portName, initTLS, replicaSetName, tc.dbPath),
 		hostConf,
 		&network.NetworkingConfig{},
 		&v1.Platform{
@@ -366,40 +411,45 @@ func (tc *TestConnection) startMongoContainer(mongoVersion string, portNumber in
 			OS:           "linux",
 		},
 		containerName)
-	if err != nil && docker.IsErrNotFound(err) {
+	if err != nil && docker.IsErrNotFound(err) && len(tc.imageOverride) == 0 {
 		// The image didn't exist locally - go grab it
 		if err = tc.pullMongoContainer(mongoImageName); err != nil {
 			// The pull didn't succeed, bail
-			tc.logger.WithField("err", err).Error("Could not pull the docker container")
+			tc.logger.Error("Could not pull the docker container", Fields{"err": err})
 			return "", err
 		}
 		// Now that the pull is complete, we can try to call start again
 		return tc.startMongoContainer(mongoVersion, portNumber, initTLS, replicaSetName)
 	} else if err != nil {
-		tc.logger.WithField("err", err).Error("Could not start the docker container")
-		return "", err
+		tc.logger.Error("Could not create the docker container", Fields{"err": err})
+		return "", tc.newError(PhaseContainerCreate, err)
 	}
 	containerID = containerResp.ID
 	tc.mongoContainerID = containerID
+	if len(tc.dbPath) != 0 {
+		// A custom dbpath must exist (and be owned by the mongodb user) before mongod starts
+		if err = tc.createContainerDir(tc.dbPath, mongodbUID, mongodbUID, 0755); err != nil {
+			tc.logger.Error("Could not create the data directory in the docker container", Fields{"err": err})
+			return containerID, tc.newError(PhaseContainerCreate, err)
+		}
+	}
 
 	err = tc.dockerClient.ContainerStart(
 		context.Background(),
 		containerID,
 		types.ContainerStartOptions{})
 	if err != nil {
-		tc.logger.WithFields(logrus.Fields{
+		tc.logger.Error("Could not start the docker container", Fields{
 			"containerID": containerID,
 			"err":         err,
-		}).Error("Could not start the docker container")
-		return containerID, err
-	}
-	tc.logger.WithFields(
-		logrus.Fields{
-			"containerName":      containerName,
-			"containerMongoPort": portNumber,
-			"containerID":        containerID,
-		},
-	).Info("Successfully spawned mongo docker test container.")
+		})
+		return containerID, tc.newError(PhaseContainerStart, err)
+	}
+	tc.logger.Info("Successfully spawned mongo docker test container.", Fields{
+		"containerName":      containerName,
+		"containerMongoPort": portNumber,
+		"containerID":        containerID,
+	})
 	return containerID, err
 }
 
@@ -410,27 +460,8 @@ func (tc *TestConnection) RunMongoScriptOnContainer(mongoScript string) (output
 	fname := fmt.Sprintf("mongoScript-%s.js", strconv.Itoa(rand.Intn(9999999)))
 	folderName := "/tmp/"
 	destinationPath := folderName + fname
-	var buf bytes.Buffer
-	tw := tar.NewWriter(&buf)
-	header := &tar.Header{
-		Name: fname,
-		Mode: 0777,
-		Size: int64(len(mongoScript)),
-	}
-	if err = tw.WriteHeader(header); err != nil {
-		return output, fmt.Errorf("could not write tar header to archive when copying file to mongo: %w", err)
-	}
-
-	if _, err = tw.Write([]byte(mongoScript)); err != nil {
-		return output, fmt.Errorf("could not copy mongo script into a tar archive in preparation for copying to container: %w", err)
-	}
-	_ = tw.Flush()
-	if err = tw.Close(); err != nil {
-		return output, fmt.Errorf("could not close tar archive in preparation for copying to container: %w", err)
-	}
-	if err = tc.dockerClient.CopyToContainer(context.Background(), tc.mongoContainerID,
-		folderName, &buf, types.CopyToContainerOptions{}); err != nil {
-		return output, fmt.Errorf("could not copy file from host to container: %w", err)
+	if err = tc.CopyReaderToContainer(strings.NewReader(mongoScript), destinationPath, 0777); err != nil {
+		return output, tc.newError(PhaseExec, err)
 	}
 
 	// and execute the file
@@ -455,11 +486,11 @@ func (tc *TestConnection) ExecCommandInMongoContainer(cmd []string) (output stri
 	}
 	execIDObj, err := tc.dockerClient.ContainerExecCreate(context.Background(), tc.mongoContainerID, execOpts)
 	if err != nil {
-		err = fmt.Errorf("could not create execution context for container %s: %w", tc.mongoContainerID, err)
-		tc.logger.WithFields(logrus.Fields{
+		err = tc.newError(PhaseExec, fmt.Errorf("could not create execution context: %w", err))
+		tc.logger.Error("Could not create execution context for provided command", Fields{
 			"err": err,
 			"cmd": cmd,
-		}).Error("Could not create execution context for provided command")
+		})
 		return output, err
 	}
 	// Kick off the command and attach to the container - it will return a reader object we can read from
@@ -469,11 +500,11 @@ func (tc *TestConnection) ExecCommandInMongoContainer(cmd []string) (output stri
 	})
 	if err != nil {
 		// Error attaching to container - we won't get an
-		err = fmt.Errorf("could not attach to execution context for container %s: %w", tc.mongoContainerID, err)
-		tc.logger.WithFields(logrus.Fields{
+		err = tc.newError(PhaseExec, fmt.Errorf("could not attach to execution context: %w", err))
+		tc.logger.Error("Could not attach to execution context for provided container", Fields{
 			"err": err,
 			"cmd": cmd,
-		}).Error("Could not attach to execution context for provided container")
+		})
 		return output, err
 	}
 	defer attachedRes.Close()
@@ -495,11 +526,11 @@ func (tc *TestConnection) ExecCommandInMongoContainer(cmd []string) (output stri
 				resultsExist = false
 				break
 			}
-			err = fmt.Errorf("could not read lines from container '%s': %w", tc.mongoContainerID, err)
-			tc.logger.WithFields(logrus.Fields{
+			err = tc.newError(PhaseExec, fmt.Errorf("could not read lines from container: %w", err))
+			tc.logger.Error("Could not execute provided command", Fields{
 				"err": err,
 				"cmd": cmd,
-			}).Error("Could not execute provided command")
+			})
 			return output, err
 		}
 		results += string(line) + "\n"
@@ -509,20 +540,20 @@ func (tc *TestConnection) ExecCommandInMongoContainer(cmd []string) (output stri
 
 	inspectRes, err := tc.dockerClient.ContainerExecInspect(context.Background(), execIDObj.ID)
 	if err != nil {
-		err = fmt.Errorf("could not inspect command execution in container %s: %w", tc.mongoContainerID, err)
-		tc.logger.WithFields(logrus.Fields{
+		err = tc.newError(PhaseExec, fmt.Errorf("could not inspect command execution: %w", err))
+		tc.logger.Error("Could not inspect container after executing provided command", Fields{
 			"err": err,
 			"cmd": cmd,
-		}).Error("Could not inspect container after executing provided command")
+		})
 		return output, err
 	}
 	if inspectRes.ExitCode > 0 {
 		// The command itself returned a bad exit code (e.g. malformed command)
-		err = fmt.Errorf("could not execute provided command in container %s: \n%s", tc.mongoContainerID, results)
-		tc.logger.WithFields(logrus.Fields{
+		err = tc.newError(PhaseExec, fmt.Errorf("command exited with code %d: \n%s", inspectRes.ExitCode, results))
+		tc.logger.Debug("There was an error executing the provided command", Fields{
 			"err": err,
 			"cmd": cmd,
-		}).Debug("There was an error executing the provided command")
+		})
 	}
 	return output, err
 }
@@ -540,11 +571,12 @@ func (tc *TestConnection) KillMongoContainer() (err error) {
 	}
 	if tc.caPemFile != nil {
 		// If a tmp CA pem file was written out to the OS, attempt to clean it up
-		err = os.Remove(tc.caPemFile.Name())
-		tc.logger.WithFields(logrus.Fields{
-			"err":         err,
-			"containerID": tc.caPemFile.Name(),
-		}).Error("Could not delete generated CA PEM temporary file - still will attempt to teardown docker container...")
+		if err = os.Remove(tc.caPemFile.Name()); err != nil {
+			tc.logger.Error("Could not delete generated CA PEM temporary file - still will attempt to teardown docker container...", Fields{
+				"err":  err,
+				"file": tc.caPemFile.Name(),
+			})
+		}
 		err = nil
 		tc.caPemFile = nil
 	} // Note that we do not error out if we couldn't clean-up the temporary file
@@ -555,14 +587,13 @@ func (tc *TestConnection) KillMongoContainer() (err error) {
 			Force:         true,
 		})
 	if err != nil {
-		tc.logger.WithFields(logrus.Fields{
+		tc.logger.Error("Could not remove container", Fields{
 			"err":         err,
 			"containerID": tc.mongoContainerID,
-		}).Error("Could not remove container")
+		})
 		return err
 	}
-	tc.logger.WithField("containerID", tc.mongoContainerID).Debug(
-		"Successfully removed container")
+	tc.logger.Debug("Successfully removed container", Fields{"containerID": tc.mongoContainerID})
 	// Once removed - unset the container ID
 	tc.mongoContainerID = ""
 	return nil
@@ -573,9 +604,9 @@ func (tc *TestConnection) KillMongoContainer() (err error) {
 // then kills the mongo container as it exits.
 // A note that the function isn't actually executed inside the container, instead
 // a connection is established to the mongo server from the host system.
-func EasyMongoWithContainer(f func(c *easymongo.Connection) error) (err error) {
+func EasyMongoWithContainer(f func(c *easymongo.Connection) error, opts ...Option) (err error) {
 	spinupDockerContainer := true
-	tc, err := NewTestConnection(spinupDockerContainer)
+	tc, err := NewTestConnection(spinupDockerContainer, opts...)
 	if err != nil {
 		return err
 	}
@@ -589,9 +620,9 @@ func EasyMongoWithContainer(f func(c *easymongo.Connection) error) (err error) {
 // then kills the mongo container as it exits.
 // A note that the function isn't actually executed inside the container, instead
 // a connection is established to the mongo server from the host system.
-func MongoClientWithContainer(f func(m *mongo.Client) error) error {
+func MongoClientWithContainer(f func(m *mongo.Client) error, opts ...Option) error {
 	spinupDockerContainer := true
-	tc, err := NewTestConnection(spinupDockerContainer)
+	tc, err := NewTestConnection(spinupDockerContainer, opts...)
 	if err != nil {
 		return err
 	}
@@ -599,6 +630,3 @@ func MongoClientWithContainer(f func(m *mongo.Client) error) error {
 	// Run whatever function it is using the mongo driver connection
 	return f(tc.Connection.MongoDriverClient())
 }
-
-// TODO: DropAllDatabases
-// TODO
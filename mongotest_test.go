@@ -4,10 +4,30 @@
 package mongotest
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	docker "github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestTLSConnectivity(t *testing.T) {
@@ -16,6 +36,11 @@ func TestTLSConnectivity(t *testing.T) {
 	is.NotNil(rootCert)
 	is.NotEmpty(rootPem)
 	is.NotNil(privKey)
+	rootCert, rootPem, privKey, err := CreateCARoot()
+	is.NoError(err, "Could not create the CA root")
+	is.NotNil(rootCert)
+	is.NotEmpty(rootPem)
+	is.NotNil(privKey)
 	t.Skipf("TODO: Support TLSConnectivity")
 }
 
@@ -53,6 +78,40 @@ func TestMongoContainer(t *testing.T) {
 		is.Contains(top.Processes[0], "mongod --bind_ip_all", "The mongo daemon was not running")
 	})
 
+	t.Run("Container logs can be read", func(t *testing.T) {
+		is := assert.New(t)
+		entries, err := conn.Logs(context.Background(), time.Time{})
+		is.NoError(err, "Could not read the container logs")
+		is.NotEmpty(entries, "mongod should have logged during start-up")
+	})
+
+	t.Run("Files can be copied to and from the container", func(t *testing.T) {
+		is := assert.New(t)
+		contents := "db.getSiblingDB('fixtures').foo.insertOne({})"
+		err := conn.CopyReaderToContainer(strings.NewReader(contents), "/mongotest/fixtures/foo.js", 0644)
+		is.NoError(err, "Could not copy the reader into the container")
+		rc, err := conn.CopyFromContainer("/mongotest/fixtures/foo.js")
+		is.NoError(err, "Could not copy the file back out of the container")
+		if err != nil {
+			t.FailNow()
+		}
+		defer rc.Close()
+		copied, err := io.ReadAll(rc)
+		is.NoError(err)
+		is.Equal(contents, string(copied), "The file contents changed on the round trip")
+
+		_, err = conn.CopyFromContainer("/mongotest/fixtures")
+		is.ErrorIs(err, ErrContainerPathIsDirectory)
+
+		hostDir := t.TempDir()
+		err = conn.CopyDirFromContainer("/mongotest/fixtures", hostDir)
+		is.NoError(err, "Could not copy the directory out of the container")
+		is.FileExists(filepath.Join(hostDir, "foo.js"))
+
+		err = conn.CopyDirFromContainer("/mongotest/fixtures/foo.js", t.TempDir())
+		is.ErrorIs(err, ErrContainerPathIsNotDirectory, "Files can't be copied as directories")
+	})
+
 	t.Run("Container can be killed", func(t *testing.T) {
 		is := assert.New(t)
 		containerID := conn.MongoContainerID()
@@ -78,3 +137,1939 @@ func TestGetAvailablePort(t *testing.T) {
 	is.NoError(err, "Could not find an available port")
 	is.Greater(portNumber, 0, "Port number should be greater than 0")
 }
+
+func TestTarRoundTrip(t *testing.T) {
+	is := assert.New(t)
+	srcDir := t.TempDir()
+	is.NoError(os.MkdirAll(filepath.Join(srcDir, "nested"), 0755))
+	is.NoError(os.WriteFile(filepath.Join(srcDir, "nested", "keyfile"), []byte("secret"), 0400))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	is.NoError(tarHostPath(tw, srcDir, "etc/fixtures"))
+	is.NoError(tw.Close())
+
+	dstDir := t.TempDir()
+	is.NoError(untarToHostDir(tar.NewReader(&buf), "etc/fixtures", dstDir))
+	info, err := os.Stat(filepath.Join(dstDir, "nested", "keyfile"))
+	is.NoError(err, "The nested file was not extracted")
+	if err == nil {
+		is.Equal(os.FileMode(0400), info.Mode().Perm(), "Permissions were not preserved")
+	}
+
+	// Entries sharing the directory's name are only skipped at the root
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	for _, header := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "logs/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "logs/logs", Mode: 0644, Size: 2},
+		{Typeflag: tar.TypeDir, Name: "logs/archive/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "logs/archive/logs", Mode: 0644, Size: 2},
+	} {
+		is.NoError(tw.WriteHeader(header))
+		if header.Size != 0 {
+			_, err = tw.Write([]byte("ok"))
+			is.NoError(err)
+		}
+	}
+	is.NoError(tw.Close())
+	dstDir = t.TempDir()
+	is.NoError(untarToHostDir(tar.NewReader(&buf), "logs", dstDir))
+	is.FileExists(filepath.Join(dstDir, "logs"), "Entries named like the root should be extracted")
+	is.FileExists(filepath.Join(dstDir, "archive", "logs"))
+
+	_, err = containerArchiveName("relative/path")
+	is.Error(err, "Relative container paths should be rejected")
+}
+
+func TestLoggers(t *testing.T) {
+	is := assert.New(t)
+	is.Equal("msg a=1 b=two", formatLogLine("msg", Fields{"b": "two", "a": 1}), "Fields should be sorted")
+
+	var buf bytes.Buffer
+	logrusLogger := logrus.New()
+	logrusLogger.SetOutput(&buf)
+	SetDefaultLogger(NewLogrusLogger(logrusLogger))
+	t.Cleanup(func() {
+		SetDefaultLogger(nil)
+	})
+	defaultLogger().Error("Could not do the thing", Fields{"containerID": "abc"})
+	is.Contains(buf.String(), "Could not do the thing")
+	is.Contains(buf.String(), "containerID=abc")
+
+	tc := &TestConnection{logger: defaultLogger()}
+	WithLogger(NewTestingLogger(t))(tc)
+	is.IsType(&testingLogger{}, tc.logger, "WithLogger should override the default logger")
+}
+
+func TestParseLogLine(t *testing.T) {
+	is := assert.New(t)
+	structured := `{"t":{"$date":"2022-08-01T15:16:17.180+00:00"},"s":"I","c":"NETWORK","id":23016,"ctx":"listener","msg":"Waiting for connections","attr":{"port":27017,"ssl":"off"}}`
+	entry := parseLogLine(structured)
+	is.Equal("I", entry.Severity)
+	is.Equal("NETWORK", entry.Component)
+	is.Equal(int64(23016), entry.ID)
+	is.Equal("listener", entry.Context)
+	is.Equal("Waiting for connections", entry.Message)
+	is.Equal(float64(27017), entry.Attributes["port"])
+	is.Equal(2022, entry.Timestamp.Year())
+	is.Equal(structured, entry.String())
+
+	legacy := "2019-03-04T15:16:17.180+0000 I NETWORK  [initandlisten] waiting for connections on port 27017"
+	entry = parseLogLine(legacy)
+	is.Equal(legacy, entry.Message, "Unstructured lines should be passed through")
+	is.Empty(entry.Severity)
+}
+
+func TestMongoTestError(t *testing.T) {
+	is := assert.New(t)
+	tc := &TestConnection{
+		mongoContainerID: "abc123",
+		mongoImage:       "mongo:latest",
+		portNumber:       27018,
+	}
+	cause := errors.New("connection refused")
+	var err error = tc.newError(PhaseReadiness, cause)
+	err = fmt.Errorf("setting up test: %w", err)
+
+	is.ErrorIs(err, ErrReadiness, "The phase sentinel should match")
+	is.ErrorIs(err, cause, "The underlying cause should match")
+	is.NotErrorIs(err, ErrImagePull, "Other phases should not match")
+	is.NotErrorIs(err, ErrFailedToConnectToDockerDaemon, "The daemon was reachable")
+	var mte *MongoTestError
+	if is.ErrorAs(err, &mte) {
+		is.Equal("abc123", mte.ContainerID)
+		is.Equal("mongo:latest", mte.Image)
+		is.Equal(27018, mte.Port)
+	}
+	is.Contains(err.Error(), "readiness failed (container=abc123 image=mongo:latest port=27018): connection refused")
+
+	err = tc.newError(PhaseContainerCreate, docker.ErrorConnectionFailed("unix:///var/run/docker.sock"))
+	is.ErrorIs(err, ErrFailedToConnectToDockerDaemon, "Connection failures should be reported as docker being unavailable")
+	is.ErrorIs(err, ErrContainerCreate)
+}
+
+func TestDatabaseImporterArgs(t *testing.T) {
+	is := assert.New(t)
+	tc := &TestConnection{mongoURI: "mongodb://127.0.0.1:27018/?directConnection=true"}
+	args := tc.DatabaseImporter("db", "coll").CSV().HeaderLine().UseArrayIndexFields().Drop().
+		Mode(ImportModeUpsert).UpsertFields("email", "tenant").args("/tmp/in.csv")
+	is.Equal([]string{
+		"-d", "db", "-c", "coll", "--type=csv", "--file=/tmp/in.csv",
+		"--headerline", "--useArrayIndexFields", "--drop", "--mode=upsert", "--upsertFields=email,tenant",
+		"mongodb://127.0.0.1:27018/?directConnection=true",
+	}, args)
+
+	args = tc.DatabaseImporter("db", "coll").JSONArray().args("/tmp/in.json")
+	is.Contains(args, "--type=json")
+	is.Contains(args, "--jsonArray")
+
+	// Inferring the type from one file shouldn't stick to the builder
+	builder := tc.DatabaseImporter("db", "coll").HeaderLine()
+	importer, isGzip := builder.forFile("/tmp/in.CSV.gz")
+	is.True(isGzip)
+	is.Contains(importer.args("/tmp/in.csv"), "--type=csv")
+	importer, isGzip = builder.forFile("/tmp/in.tsv")
+	is.False(isGzip)
+	is.Contains(importer.args("/tmp/in.tsv"), "--type=tsv", "The type should be inferred afresh for each file")
+	is.Empty(builder.inputType, "The builder should not be changed by inferring a type")
+	importer, _ = builder.TSV().forFile("/tmp/in.csv")
+	is.Same(builder, importer, "An explicit type should be used as is")
+	is.Contains(importer.args("/tmp/in.csv"), "--type=tsv")
+}
+
+// discoveryFixtures are the fixtures used to test finding and loading fixture files
+var discoveryFixtures = fstest.MapFS{
+	"fixtures/shop/users.json":               {Data: []byte(`[{"_id": {"$oid": "5f1b2c3d4e5f6a7b8c9d0e1f"}, "name": "Alice", "email": "alice@example.com"}, {"name": "Bob", "email": "bob@example.com"}]`)},
+	"fixtures/shop/users.indexes.json":       {Data: []byte(`[{"v": 2, "key": {"_id": 1}, "name": "_id_"}, {"key": {"email": 1}, "unique": true}]`)},
+	"fixtures/shop/orders.v2.ndjson":         {Data: []byte("{\"total\": {\"$numberDecimal\": \"9.99\"}}\n\n{\"total\": 1}\n")},
+	"fixtures/shop/orders.v2.options.json":   {Data: []byte(`{"capped": true, "size": 4096}`)},
+	"fixtures/shop/README.md":                {Data: []byte("ignored")},
+	"fixtures/shop/nested/ignored.json":      {Data: []byte("{}")},
+	"fixtures/warehouse/stock.csv":           {Data: []byte("sku,qty\nabc,1\n")},
+	"fixtures/warehouse/stock.options.json":  {Data: []byte(`{}`)},
+	"fixtures/warehouse/stock.indexes.json":  {Data: []byte(`[]`)},
+	"fixtures/warehouse/stock-archive.bson":  {Data: []byte{}},
+	"fixtures/warehouse/stock-archive2.json": {Data: []byte(``)},
+	"fixtures/archive/events.bson": {Data: func() []byte {
+		raw, _ := bson.Marshal(bson.D{{Key: "kind", Value: "click"}})
+		return raw
+	}()},
+	"fixtures/archive/events.metadata.json": {Data: []byte(`{"options": {"capped": true, "size": {"$numberLong": "4096"}},
+		"indexes": [{"v": 2, "key": {"_id": 1}, "name": "_id_"}, {"v": 2, "key": {"kind": 1}, "name": "kind_1"}],
+		"uuid": "0b6f0d4e9a5c4b2e8f3a1c7d5e9b2a4f", "collectionName": "events", "type": "collection"}`)},
+}
+
+func TestFixtureDiscovery(t *testing.T) {
+	is := assert.New(t)
+	fsys := discoveryFixtures
+	fixtures, err := findCollectionFixtures(fsys, "fixtures/shop")
+	is.NoError(err)
+	is.Len(fixtures, 2)
+	is.Equal([]string{"fixtures/shop/users.json"}, fixtures["users"].dataFiles)
+	is.Equal("fixtures/shop/users.indexes.json", fixtures["users"].indexesFile)
+	is.Equal("fixtures/shop/orders.v2.options.json", fixtures["orders.v2"].optionsFile, "Collection names may contain dots")
+	fixtures, err = findCollectionFixtures(fsys, "fixtures/warehouse")
+	is.NoError(err)
+	is.Len(fixtures, 3)
+	is.Equal(&collectionFixture{
+		dataFiles:   []string{"fixtures/warehouse/stock.csv"},
+		indexesFile: "fixtures/warehouse/stock.indexes.json",
+		optionsFile: "fixtures/warehouse/stock.options.json",
+	}, fixtures["stock"], "Sidecars should be grouped with their data file")
+	is.Equal([]string{"fixtures/warehouse/stock-archive.bson"}, fixtures["stock-archive"].dataFiles)
+	is.Equal([]string{"fixtures/warehouse/stock-archive2.json"}, fixtures["stock-archive2"].dataFiles)
+	fixtures, err = findCollectionFixtures(fsys, "fixtures/archive")
+	is.NoError(err)
+	is.Equal(map[string]*collectionFixture{"events": {
+		dataFiles:    []string{"fixtures/archive/events.bson"},
+		metadataFile: "fixtures/archive/events.metadata.json",
+	}}, fixtures, "mongodump metadata files should not be loaded as data")
+	metadata, err := readDumpMetadata(fsys, "fixtures/archive/events.metadata.json")
+	is.NoError(err)
+	is.Equal(bson.D{{Key: "capped", Value: true}, {Key: "size", Value: int64(4096)}}, metadata.Options)
+	is.Len(metadata.Indexes, 2)
+
+	docs, err := decodeJSONFixture(fsys["fixtures/shop/users.json"].Data)
+	is.NoError(err)
+	is.Len(docs, 2)
+	is.IsType(primitive.ObjectID{}, docs[0].(bson.D)[0].Value, "Extended JSON types should be preserved")
+	docs, err = decodeJSONFixture(fsys["fixtures/shop/orders.v2.ndjson"].Data)
+	is.NoError(err)
+	is.Len(docs, 2, "Blank lines should be skipped")
+	is.IsType(primitive.Decimal128{}, docs[0].(bson.D)[0].Value)
+
+	raw, err := bson.Marshal(bson.D{{Key: "a", Value: 1}})
+	is.NoError(err)
+	docs, err = decodeBSONFixture(append(append([]byte{}, raw...), raw...))
+	is.NoError(err)
+	is.Len(docs, 2)
+	_, err = decodeBSONFixture(raw[:len(raw)-1])
+	is.Error(err, "Truncated documents should be rejected")
+
+	is.Equal("email_1_age_-1", indexName(bson.D{{Key: "email", Value: int32(1)}, {Key: "age", Value: -1}}))
+}
+
+func TestLoadFixtures(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	if !is.NoError(conn.LoadFixtures(discoveryFixtures, "fixtures"), "Could not load the fixtures") {
+		t.FailNow()
+	}
+	ctx := context.Background()
+	client := conn.MongoDriverClient()
+	count := func(dbName, collName string, filter bson.D) int64 {
+		n, err := client.Database(dbName).Collection(collName).CountDocuments(ctx, filter)
+		is.NoError(err)
+		return n
+	}
+
+	shopColls, err := client.Database("shop").ListCollectionNames(ctx, bson.D{})
+	is.NoError(err)
+	is.ElementsMatch([]string{"users", "orders.v2"}, shopColls, "Only data files and sidecars should become collections")
+	is.EqualValues(2, count("shop", "users", bson.D{}))
+	is.EqualValues(1, count("shop", "users", bson.D{{Key: "_id", Value: bson.D{{Key: "$type", Value: "objectId"}}}, {Key: "name", Value: "Alice"}}))
+	indexes, err := client.Database("shop").Collection("users").Indexes().ListSpecifications(ctx)
+	is.NoError(err)
+	var unique []string
+	for _, index := range indexes {
+		if index.Unique != nil && *index.Unique {
+			unique = append(unique, index.Name)
+		}
+	}
+	is.Equal([]string{"email_1"}, unique, "The indexes sidecar should be applied")
+
+	specs, err := client.Database("shop").ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: "orders.v2"}})
+	is.NoError(err)
+	if is.Len(specs, 1) {
+		capped, _ := specs[0].Options.Lookup("capped").BooleanOK()
+		is.True(capped, "The options sidecar should be applied")
+	}
+	var orders []bson.M
+	cursor, err := client.Database("shop").Collection("orders.v2").Find(ctx, bson.D{})
+	is.NoError(err)
+	is.NoError(cursor.All(ctx, &orders))
+	if is.Len(orders, 2) {
+		is.IsType(primitive.Decimal128{}, orders[0]["total"], "Extended JSON types should be preserved")
+	}
+
+	warehouseColls, err := client.Database("warehouse").ListCollectionNames(ctx, bson.D{})
+	is.NoError(err)
+	is.Equal([]string{"stock"}, warehouseColls, "Empty data files should not create collections")
+	is.EqualValues(1, count("warehouse", "stock", bson.D{{Key: "sku", Value: "abc"}}),
+		"CSV fixtures should be imported with their header line")
+
+	is.EqualValues(1, count("archive", "events", bson.D{{Key: "kind", Value: "click"}}))
+	specs, err = client.Database("archive").ListCollectionSpecifications(ctx, bson.D{})
+	is.NoError(err)
+	if is.Len(specs, 1, "mongodump metadata should not become a collection") {
+		capped, _ := specs[0].Options.Lookup("capped").BooleanOK()
+		is.True(capped, "Options should be read from mongodump metadata")
+	}
+	eventIndexes, err := client.Database("archive").Collection("events").Indexes().ListSpecifications(ctx)
+	is.NoError(err)
+	is.Len(eventIndexes, 2, "Indexes should be read from mongodump metadata")
+}
+
+func TestYAMLFixtureTemplates(t *testing.T) {
+	is := assert.New(t)
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	state := newYAMLFixtureState(now)
+
+	users := `
+- _anchor: alice
+  name: Alice
+  signedUp: {{ daysAgo 30 }}
+  tags: [admin, "007"]
+  balance: !decimal 9.99
+- name: Bob
+  lastSeen: {{ ago "36h" }}
+  visits: 3000000000
+`
+	orders := `
+- _id: {{ oid }}
+  user: {{ ref "alice" }}
+  number: {{ seq "orders" }}
+- user: {{ ref "alice" }}
+  number: {{ seq "orders" }}
+`
+	docs, err := state.decode("shop/users.yaml", []byte(users))
+	is.NoError(err)
+	if !is.Len(docs, 2) {
+		t.FailNow()
+	}
+	alice := docs[0].(bson.D)
+	is.Equal("_id", alice[0].Key, "Anchored documents should be given an _id")
+	is.Equal(state.anchors["alice"], alice[0].Value)
+	is.NotContains(alice.Map(), yamlAnchorKey, "The anchor key should be stripped")
+	is.Equal(primitive.NewDateTimeFromTime(now.AddDate(0, 0, -30)), alice.Map()["signedUp"])
+	is.Equal(bson.A{"admin", "007"}, alice.Map()["tags"], "Quoted scalars should stay strings")
+	is.IsType(primitive.Decimal128{}, alice.Map()["balance"])
+	bob := docs[1].(bson.D).Map()
+	is.Equal(primitive.NewDateTimeFromTime(now.Add(-36*time.Hour)), bob["lastSeen"])
+	is.Equal(int64(3000000000), bob["visits"], "Integers which don't fit in an int32 should be int64s")
+
+	docs, err = state.decode("shop/orders.yaml", []byte(orders))
+	is.NoError(err)
+	is.Len(docs, 2)
+	is.Equal(state.anchors["alice"], docs[0].(bson.D).Map()["user"], "References should resolve across files")
+	is.Equal(int32(1), docs[0].(bson.D).Map()["number"])
+	is.Equal(int32(2), docs[1].(bson.D).Map()["number"])
+	is.IsType(primitive.ObjectID{}, docs[0].(bson.D).Map()["_id"])
+
+	_, err = state.decode("shop/bad.yaml", []byte(`- _anchor: alice
+  _id: {{ oid }}`))
+	is.Error(err, "Re-anchoring with a different _id should fail")
+	_, err = state.decode("shop/bad.yaml", []byte(`name: not a list`))
+	is.Error(err)
+	is.NoError(state.checkReferences())
+
+	_, err = state.decode("shop/orders.yaml", []byte(`- user: {{ ref "carol" }}`))
+	is.NoError(err)
+	err = state.checkReferences()
+	if is.Error(err, "References to anchors which are never defined should be reported") {
+		is.Contains(err.Error(), "carol")
+	}
+
+	merges := `
+- &base {name: base, plan: free, region: eu}
+- &extra {plan: pro, seats: 5}
+- <<: [*base, *extra]
+  name: merged
+- region: us
+  <<: *base
+`
+	docs, err = state.decode("shop/merges.yaml", []byte(merges))
+	is.NoError(err)
+	if is.Len(docs, 4) {
+		is.Equal(bson.D{
+			{Key: "name", Value: "merged"},
+			{Key: "plan", Value: "free"},
+			{Key: "region", Value: "eu"},
+			{Key: "seats", Value: int32(5)},
+		}, docs[2], "Explicit keys and earlier merged maps should win")
+		is.Equal(bson.D{
+			{Key: "region", Value: "us"},
+			{Key: "name", Value: "base"},
+			{Key: "plan", Value: "free"},
+		}, docs[3], "Keys set before a merge should not be overwritten")
+	}
+	_, err = state.decode("shop/bad.yaml", []byte("- <<: [1, 2]"))
+	is.Error(err, "Only maps can be merged")
+	_, err = state.decode("shop/bad.yaml", []byte("- <<: scalar"))
+	is.Error(err, "Only maps can be merged")
+}
+
+func TestSnapshots(t *testing.T) {
+	is := assert.New(t)
+	snapshot, err := ReadSnapshot(bytes.NewReader([]byte{0x1f, 0x8b, 0x08}))
+	is.NoError(err)
+	is.True(snapshot.Gzip(), "Gzip archives should be detected")
+
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	coll := conn.MongoDriverClient().Database("snapshots").Collection("things")
+	_, err = coll.InsertMany(ctx, []interface{}{
+		bson.M{"n": int64(1)}, bson.M{"n": int64(2)},
+	})
+	is.NoError(err)
+	snapshot, err = conn.Dump(ctx, DumpOptions{Database: "snapshots", Gzip: true})
+	if !is.NoError(err, "Could not dump the database") {
+		t.FailNow()
+	}
+
+	// Mutate the data, then restore it from the snapshot
+	_, err = coll.InsertOne(ctx, bson.M{"n": int64(3)})
+	is.NoError(err)
+	fpath := filepath.Join(t.TempDir(), "snapshot.archive.gz")
+	is.NoError(snapshot.SaveToFile(fpath))
+	snapshot, err = LoadSnapshotFile(fpath)
+	is.NoError(err)
+	is.NoError(conn.Restore(ctx, snapshot), "Could not restore the snapshot")
+	count, err := coll.CountDocuments(ctx, bson.M{})
+	is.NoError(err)
+	is.Equal(int64(2), count, "The collection should match the snapshot")
+	is.NoError(coll.FindOne(ctx, bson.M{"n": bson.M{"$type": "long"}}).Err(), "BSON types should be preserved")
+}
+
+func TestFixtureImageHash(t *testing.T) {
+	is := assert.New(t)
+	fsys := fstest.MapFS{
+		"fixtures/app/users.json": {Data: []byte(`[{"name": "alice"}]`)},
+		"fixtures/app/pets.json":  {Data: []byte(`[{"name": "rex"}]`)},
+	}
+	fi := FixtureImage{FS: fsys, Root: "fixtures"}
+	first, err := fixtureHash(fi, "mongo:6.0", "sha256:abc")
+	is.NoError(err)
+	second, err := fixtureHash(fi, "mongo:6.0", "sha256:abc")
+	is.NoError(err)
+	is.Equal(first, second, "The hash should be deterministic")
+
+	otherImage, err := fixtureHash(fi, "mongo:6.0", "sha256:def")
+	is.NoError(err)
+	is.NotEqual(first, otherImage, "A different base image should change the hash")
+
+	fi.Version = "2"
+	bumped, err := fixtureHash(fi, "mongo:6.0", "sha256:abc")
+	is.NoError(err)
+	is.NotEqual(first, bumped, "Bumping the version should change the hash")
+
+	fi.Version = ""
+	fsys["fixtures/app/pets.json"] = &fstest.MapFile{Data: []byte(`[{"name": "fido"}]`)}
+	changed, err := fixtureHash(fi, "mongo:6.0", "sha256:abc")
+	is.NoError(err)
+	is.NotEqual(first, changed, "Changing a fixture should change the hash")
+}
+
+func TestDatabaseExporterOutputs(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	coll := conn.MongoDriverClient().Database("exports").Collection("things")
+	_, err := coll.InsertMany(ctx, []interface{}{
+		bson.D{{Key: "name", Value: "first"}, {Key: "n", Value: int64(1)}},
+		bson.D{{Key: "name", Value: "second"}, {Key: "n", Value: int64(2)}},
+	})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+
+	out, err := conn.DatabaseExporter("exports", "things").Sort(`{"n": 1}`).String()
+	is.NoError(err, "Could not export to a string")
+	is.Equal(2, strings.Count(strings.TrimSpace(out), "\n")+1, "There should be one line per document")
+	is.Contains(out, `"first"`)
+
+	raw, err := conn.DatabaseExporter("exports", "things").JSONArray().Bytes()
+	is.NoError(err, "Could not export to bytes")
+	docs, err := decodeExtJSONArray(bytes.TrimSpace(raw))
+	is.NoError(err, "A JSON array export should be a valid JSON array")
+	is.Len(docs, 2)
+
+	var buf bytes.Buffer
+	numDocs, err := conn.DatabaseExporter("exports", "things").Query(`{"n": 2}`).ToWriter(&buf)
+	is.NoError(err, "Could not export to a writer")
+	is.Equal(int64(1), numDocs)
+	is.Contains(buf.String(), `"second"`)
+
+	it, err := conn.DatabaseExporter("exports", "things").JSONArray().Pretty().Sort(`{"n": 1}`).Iterate()
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	names := []interface{}{}
+	for it.Next() {
+		names = append(names, it.Document().Map()["name"])
+	}
+	is.NoError(it.Err())
+	is.NoError(it.Close())
+	is.Equal([]interface{}{"first", "second"}, names, "The iterator should yield every document in order")
+
+	it, err = conn.DatabaseExporter("exports", "things").CSV().Fields("name", "n").Sort(`{"n": 1}`).Iterate()
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	defer it.Close()
+	is.True(it.Next(), "The CSV iterator should yield rows")
+	is.Equal(bson.D{{Key: "name", Value: "first"}, {Key: "n", Value: "1"}}, it.Document())
+}
+
+func TestExportFileWriting(t *testing.T) {
+	is := assert.New(t)
+	is.Equal("mongoexport-db-coll-*.json", exportFilePattern("db", "coll", "json", false))
+	is.Equal("mongoexport-db-coll-*.csv.gz", exportFilePattern("db", "coll", "csv", true))
+
+	contents := strings.Repeat(`{"n": 1}`+"\n", 1000)
+	fpath := filepath.Join(t.TempDir(), "export.json.gz")
+	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	err = writeExportFile(file, true, func(w io.Writer) error {
+		_, err := io.WriteString(w, contents)
+		return err
+	})
+	is.NoError(err)
+	f, err := os.Open(fpath)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	defer f.Close()
+	gzReader, err := gzip.NewReader(f)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	decompressed, err := io.ReadAll(gzReader)
+	is.NoError(err, "The gzip archive should not be truncated")
+	is.Equal(contents, string(decompressed))
+
+	exportErr := errors.New("export failed")
+	file, err = os.CreateTemp(t.TempDir(), "export")
+	is.NoError(err)
+	is.ErrorIs(writeExportFile(file, false, func(w io.Writer) error { return exportErr }), exportErr)
+}
+
+func TestDatabaseExporterFileRoundTrip(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("roundtrip")
+	_, err := db.Collection("source").InsertMany(ctx, []interface{}{
+		bson.M{"name": "first", "n": int64(1)}, bson.M{"name": "second", "n": int64(2)},
+	})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+
+	fpath, err := conn.DatabaseExporter("roundtrip", "source").CompressToGZIP().ToJSONFile(false, false, false, false)
+	if !is.NoError(err, "Could not export to a gzip file") {
+		t.FailNow()
+	}
+	defer os.Remove(fpath)
+	is.True(strings.HasSuffix(fpath, ".json.gz"), "Temp files should keep their extension")
+	result, err := conn.DatabaseImporter("roundtrip", "fromJSON").FromFile(fpath)
+	is.NoError(err, "Could not import the gzip JSON export")
+	is.Equal(uint64(2), result.Imported)
+	is.NoError(db.Collection("fromJSON").FindOne(ctx, bson.M{"n": bson.M{"$type": "long"}}).Err(),
+		"Canonical JSON should preserve BSON types")
+
+	// Exporting to an existing file should truncate it
+	csvPath := filepath.Join(t.TempDir(), "export.csv.gz")
+	is.NoError(os.WriteFile(csvPath, bytes.Repeat([]byte("stale"), 1000), 0644))
+	_, err = conn.DatabaseExporter("roundtrip", "source").Filepath(csvPath).CompressToGZIP().Fields("name", "n").CSVFile()
+	if !is.NoError(err, "Could not export to a gzip CSV file") {
+		t.FailNow()
+	}
+	result, err = conn.DatabaseImporter("roundtrip", "fromCSV").HeaderLine().FromFile(csvPath)
+	is.NoError(err, "Could not import the gzip CSV export")
+	is.Equal(uint64(2), result.Imported)
+
+	// Pretty, uncompressed exports should import too
+	fpath, err = conn.DatabaseExporter("roundtrip", "source").ToJSONFile(true, false, false, false)
+	if !is.NoError(err, "Could not export to a pretty JSON file") {
+		t.FailNow()
+	}
+	defer os.Remove(fpath)
+	is.True(strings.HasSuffix(fpath, ".json"))
+	result, err = conn.DatabaseImporter("roundtrip", "fromPlain").FromFile(fpath)
+	is.NoError(err, "Could not import the pretty JSON export")
+	is.Equal(uint64(2), result.Imported)
+
+	// Compression can also be requested through ToJSONFile itself
+	fpath, err = conn.DatabaseExporter("roundtrip", "source").ToJSONFile(true, true, false, true)
+	if !is.NoError(err, "Could not export to a pretty gzip JSON array") {
+		t.FailNow()
+	}
+	defer os.Remove(fpath)
+	is.True(strings.HasSuffix(fpath, ".json.gz"))
+	result, err = conn.DatabaseImporter("roundtrip", "fromPretty").JSONArray().FromFile(fpath)
+	is.NoError(err, "Could not import the pretty gzip JSON export")
+	is.Equal(uint64(2), result.Imported)
+
+	// A failed export should leave the caller's file in place
+	keepPath := filepath.Join(t.TempDir(), "keep.json")
+	is.NoError(os.WriteFile(keepPath, []byte("{}"), 0644))
+	_, err = conn.DatabaseExporter("roundtrip", "source").Filepath(keepPath).Query("{not json").ToFile()
+	is.Error(err, "An invalid query should fail the export")
+	is.FileExists(keepPath, "Files passed to Filepath should never be removed")
+}
+
+func TestExportHelpers(t *testing.T) {
+	is := assert.New(t)
+	fields := []string{"zeta", "tags.10", "_id", "tags.2", "alpha.b", "alpha", "_id.x"}
+	sortFieldPaths(fields)
+	is.Equal([]string{"_id", "_id.x", "alpha", "alpha.b", "tags.2", "tags.10", "zeta"}, fields,
+		"_id should always come first and array indexes should sort numerically")
+	is.Equal([]string{"name", "address.city", "address.zip", "missing"},
+		expandFieldPaths([]string{"name", "address", "missing"}, []string{"_id", "address.city", "address.zip", "name"}))
+
+	seen := map[string]bool{}
+	raw, err := bson.Marshal(bson.D{
+		{Key: "a", Value: bson.D{{Key: "b", Value: 1}, {Key: "empty", Value: bson.D{}}}},
+		{Key: "tags", Value: bson.A{"x", bson.D{{Key: "y", Value: true}}}},
+	})
+	is.NoError(err)
+	is.NoError(addLeafPaths(seen, "", raw))
+	is.Equal(map[string]bool{"a.b": true, "tags.0": true, "tags.1.y": true}, seen)
+
+	out, err := marshalExtJSONArray([]bson.D{
+		{{Key: "key", Value: bson.D{{Key: "name", Value: int32(1)}}}, {Key: "name", Value: "name_1"}},
+	}, true)
+	is.NoError(err)
+	specs, err := decodeExtJSONArray(bytes.TrimSpace(out))
+	is.NoError(err, "Index sidecars should be readable by the fixture loader")
+	is.Len(specs, 1)
+}
+
+func TestExportDatabase(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("exportall")
+	is.NoError(db.CreateCollection(ctx, "capped", options.CreateCollection().SetCapped(true).SetSizeInBytes(4096)))
+	_, err := db.Collection("users").InsertMany(ctx, []interface{}{
+		bson.M{"name": "alice", "age": int64(30)}, bson.M{"name": "bob"},
+	})
+	is.NoError(err)
+	_, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	is.NoError(err)
+
+	dir := t.TempDir()
+	if !is.NoError(conn.ExportAll(dir), "Could not export every database") {
+		t.FailNow()
+	}
+	for _, fname := range []string{"users.json", "users.indexes.json", "capped.options.json"} {
+		_, err = os.Stat(filepath.Join(dir, "exportall", fname))
+		is.NoError(err, "%s should have been exported", fname)
+	}
+	_, err = os.Stat(filepath.Join(dir, "admin"))
+	is.True(os.IsNotExist(err), "Internal databases should not be exported")
+
+	csvDir := t.TempDir()
+	is.NoError(conn.ExportDatabase("exportall", csvDir, ExportCSV))
+	csvOut, err := os.ReadFile(filepath.Join(csvDir, "exportall", "users.csv"))
+	is.NoError(err)
+	is.True(strings.HasPrefix(string(csvOut), "_id,age,name"), "The CSV header should cover every field")
+
+	// The export should load straight back in as fixtures
+	is.NoError(db.Drop(ctx))
+	is.NoError(conn.LoadFixtures(os.DirFS(dir), "."), "Could not load the export as fixtures")
+	count, err := db.Collection("users").CountDocuments(ctx, bson.M{})
+	is.NoError(err)
+	is.Equal(int64(2), count)
+	_, err = db.Collection("users").InsertOne(ctx, bson.M{"name": "alice"})
+	is.True(mongo.IsDuplicateKeyError(err), "The unique index should have been restored")
+	var stats struct {
+		Capped bool `bson:"capped"`
+	}
+	is.NoError(db.RunCommand(ctx, bson.D{{Key: "collStats", Value: "capped"}}).Decode(&stats))
+	is.True(stats.Capped, "Collection options should have been restored")
+	is.NoError(db.Collection("users").FindOne(ctx, bson.M{"_id": bson.M{"$type": "objectId"}, "age": int64(30)}).Err(),
+		"JSON exports should keep their BSON types")
+
+	// CSV has no types, so ObjectIDs come back as strings
+	is.NoError(db.Drop(ctx))
+	is.NoError(conn.LoadFixtures(os.DirFS(csvDir), "."), "Could not load the CSV export as fixtures")
+	var user bson.M
+	is.NoError(db.Collection("users").FindOne(ctx, bson.M{"name": "alice"}).Decode(&user))
+	is.IsType("", user["_id"], "CSV exports should not be expected to keep BSON types")
+}
+
+func TestDocumentEncoders(t *testing.T) {
+	is := assert.New(t)
+	oid := primitive.NewObjectID()
+	docs := []bson.D{
+		{{Key: "_id", Value: oid}, {Key: "name", Value: "alice"}, {Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}}}},
+		{{Key: "_id", Value: int32(2)}, {Key: "n", Value: int64(7)}},
+	}
+	encode := func(format ExportFormat, fields []string) string {
+		var sb strings.Builder
+		encoder := newDocumentEncoder(&sb, format, fields, jsonStyle{})
+		for _, doc := range docs {
+			raw, err := bson.Marshal(doc)
+			is.NoError(err)
+			is.NoError(encoder.Encode(raw))
+		}
+		is.NoError(encoder.Close())
+		return sb.String()
+	}
+
+	lines, err := decodeNDJSONFixture([]byte(encode(ExportJSON, nil)))
+	is.NoError(err, "JSON output should be readable by the fixture loader")
+	is.Len(lines, 2)
+	is.Equal(docs[1], lines[1], "Canonical JSON should preserve BSON types")
+
+	array, err := decodeExtJSONArray([]byte(strings.TrimSpace(encode(ExportJSONArray, nil))))
+	is.NoError(err, "JSON array output should be a valid JSON array")
+	is.Len(array, 2)
+	var empty strings.Builder
+	is.NoError(newDocumentEncoder(&empty, ExportJSONArray, nil, jsonStyle{}).Close())
+	is.Equal("[]\n", empty.String())
+
+	csvOut := encode(ExportCSV, []string{"_id", "address.city", "n"})
+	is.Equal("_id,address.city,n\nObjectId("+oid.Hex()+"),Paris,\n2,,7\n", csvOut)
+}
+
+func TestReplicaSetContainer(t *testing.T) {
+	is := assert.New(t)
+	// Any name other than the one passed to --replSet used to fail initiation
+	conn, err := NewReplicaSetContainer("rs1", WithLogger(NewTestingLogger(t)))
+	if !is.NoError(err, "Could not start a replica set") {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = conn.KillMongoContainer()
+	})
+	ctx := context.Background()
+	admin := conn.MongoDriverClient().Database("admin")
+	var status struct {
+		Set string `bson:"set"`
+	}
+	is.NoError(admin.RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).Decode(&status))
+	is.Equal("rs1", status.Set, "The replica set should be initiated under its own name")
+
+	// The member must already be primary, so writes work straight away
+	_, err = conn.MongoDriverClient().Database("rs").Collection("writes").InsertOne(ctx, bson.M{"n": 1})
+	is.NoError(err, "The replica set should accept writes as soon as it is returned")
+
+	// Initiating twice is not an error
+	is.NoError(conn.initiateReplicaSet("rs1"))
+}
+
+func TestExportConsistent(t *testing.T) {
+	is := assert.New(t)
+	conn, err := NewReplicaSetContainer("rs0", WithMongoVersion("6.0"), WithLogger(NewTestingLogger(t)))
+	if !is.NoError(err, "Could not start a replica set") {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		_ = conn.KillMongoContainer()
+	})
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("consistent")
+	for _, collName := range []string{"orders", "invoices"} {
+		_, err = db.Collection(collName).InsertOne(ctx, bson.M{"n": 1})
+		is.NoError(err)
+	}
+
+	// Keep writing while the export runs - every collection should still see the same moment
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _ = db.Collection("orders").InsertOne(ctx, bson.M{"n": i})
+			_, _ = db.Collection("invoices").InsertOne(ctx, bson.M{"n": i})
+		}
+	}()
+	dir := t.TempDir()
+	err = conn.ExportConsistent(ctx, dir, ExportJSON, "consistent.orders", "consistent.invoices")
+	close(stop)
+	<-done
+	if !is.NoError(err, "Could not export a consistent snapshot") {
+		t.FailNow()
+	}
+	orders, err := os.ReadFile(filepath.Join(dir, "consistent", "orders.json"))
+	is.NoError(err)
+	invoices, err := os.ReadFile(filepath.Join(dir, "consistent", "invoices.json"))
+	is.NoError(err)
+	orderDocs, err := decodeNDJSONFixture(orders)
+	is.NoError(err)
+	invoiceDocs, err := decodeNDJSONFixture(invoices)
+	is.NoError(err)
+	// Each order is inserted just before its invoice, so there is at most one extra order
+	is.GreaterOrEqual(len(orderDocs), len(invoiceDocs), "Both collections should be read at the same point in time")
+	is.LessOrEqual(len(orderDocs), len(invoiceDocs)+1, "Both collections should be read at the same point in time")
+}
+
+func TestCSVFlattening(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("flatten")
+	_, err := db.Collection("people").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "alice"},
+			{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}, {Key: "zip", Value: "75001"}}},
+			{Key: "tags", Value: bson.A{"a", "b"}}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "name", Value: "bob"}},
+	})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+
+	out, err := conn.DatabaseExporter("flatten", "people").CSV().FlattenNested().Sort(`{"_id": 1}`).String()
+	is.NoError(err, "Could not export flattened CSV")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	is.Equal("_id,address.city,address.zip,name,tags.0,tags.1", lines[0], "Columns should be flattened in a deterministic order")
+	is.Len(lines, 3)
+
+	out, err = conn.DatabaseExporter("flatten", "people").CSV().Fields("name", "address").FlattenNested().String()
+	is.NoError(err)
+	is.True(strings.HasPrefix(out, "name,address.city,address.zip"), "Requested nested fields should be expanded")
+
+	// The flattened CSV should import back into nested documents
+	result, err := conn.DatabaseImporter("flatten", "imported").CSV().HeaderLine().UseArrayIndexFields().
+		FromReader(strings.NewReader(strings.Join(lines, "\n")))
+	is.NoError(err, "Could not import flattened CSV")
+	is.Equal(uint64(2), result.Imported)
+	var alice struct {
+		Address struct {
+			City string `bson:"city"`
+		} `bson:"address"`
+		Tags []string `bson:"tags"`
+	}
+	is.NoError(db.Collection("imported").FindOne(ctx, bson.M{"name": "alice"}).Decode(&alice))
+	is.Equal("Paris", alice.Address.City)
+	is.Equal([]string{"a", "b"}, alice.Tags)
+}
+
+func TestTransform(t *testing.T) {
+	is := assert.New(t)
+	transform, err := ParseTransform([]byte(`
+salt: test
+rules:
+  - collection: users
+    field: email
+    action: fake
+    fake: email
+  - field: ssn
+    action: mask
+    keepLast: 4
+  - field: password
+    action: drop
+  - field: contacts.phone
+    action: hash
+  - collection: users
+    action: keep
+    filter: {active: true}
+`))
+	if !is.NoError(err, "Could not parse the transform rules") {
+		t.FailNow()
+	}
+	is.Equal(bson.D{{Key: "active", Value: true}}, transform.keepFilter("users"))
+	is.Nil(transform.keepFilter("orders"), "Keep rules should be scoped to their collection")
+	is.Equal(bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "n", Value: 1}}, bson.D{{Key: "active", Value: true}}}}},
+		transform.withKeepFilter("users", bson.D{{Key: "n", Value: 1}}))
+
+	doc := bson.D{
+		{Key: "email", Value: "alice@corp.com"},
+		{Key: "ssn", Value: "123-45-6789"},
+		{Key: "password", Value: "hunter2"},
+		{Key: "contacts", Value: bson.A{
+			bson.D{{Key: "phone", Value: "555-0100"}},
+			bson.D{{Key: "phone", Value: "555-0100"}},
+		}},
+	}
+	out, err := transform.apply("users", doc)
+	is.NoError(err)
+	m := out.Map()
+	is.NotEqual("alice@corp.com", m["email"])
+	is.Contains(m["email"], "@example.")
+	is.Equal("*******6789", m["ssn"])
+	is.NotContains(m, "password", "Dropped fields should be removed")
+	contacts := m["contacts"].(bson.A)
+	first := contacts[0].(bson.D).Map()["phone"]
+	is.Len(first, 64, "Hashed values should be hex encoded SHA-256")
+	is.Equal(first, contacts[1].(bson.D).Map()["phone"], "Equal values should hash equally")
+
+	again, err := transform.apply("users", doc)
+	is.NoError(err)
+	is.Equal(out, again, "Transforms should be deterministic")
+	orders, err := transform.apply("orders", doc)
+	is.NoError(err)
+	is.Equal("alice@corp.com", orders.Map()["email"], "Collection scoped rules should not apply elsewhere")
+
+	indexed, err := transformPath(bson.D{{Key: "tags", Value: bson.A{"a", "b"}}}, []string{"tags", "1"},
+		func(value interface{}) (interface{}, bool, error) { return nil, false, nil })
+	is.NoError(err)
+	is.Equal(bson.D{{Key: "tags", Value: bson.A{"a"}}}, indexed, "Array indexes should select a single element")
+
+	_, err = ParseTransform([]byte("rules:\n  - field: name\n    action: fake\n    fake: nope\n"))
+	is.Error(err, "Unknown fake kinds should be rejected")
+	_, err = ParseTransform([]byte("rules:\n  - action: keep\n"))
+	is.Error(err, "Keep rules without a filter should be rejected")
+	_, err = ParseTransform([]byte("rules:\n  - field: ssn\n    action: mask\n    keepLast: -2\n"))
+	is.Error(err, "Negative keepLast values should be rejected")
+	masked, _, err := transform.transformValue(TransformRule{Action: TransformMask, KeepLast: 20}, "1234")
+	is.NoError(err)
+	is.Equal("1234", masked, "Short values should be kept whole")
+
+	is.Equal([]string{"email", "ssn", "password"}, transform.collidingFields("users"))
+	index := bson.D{{Key: "key", Value: bson.D{{Key: "email", Value: 1}}}, {Key: "name", Value: "email_1"}, {Key: "unique", Value: true}}
+	relaxed, ok := withoutUnique(index, transform.collidingFields("users"))
+	is.True(ok)
+	is.Equal(index[:2], relaxed, "Unique indexes on faked fields should lose the unique option")
+	_, ok = withoutUnique(index, transform.collidingFields("orders"))
+	is.False(ok, "Indexes on untouched fields should be kept")
+	prefix, err := tempDBPrefix(transformedDBPrefix)
+	is.NoError(err)
+	other, _ := tempDBPrefix(transformedDBPrefix)
+	is.NotEqual(prefix, other, "Temporary database names should be unique")
+	is.NotContains(strings.TrimPrefix(strings.TrimSuffix(prefix, "_"), transformedDBPrefix), "_")
+
+	for _, kind := range FakeKinds() {
+		a, err := fakeValue(kind, []byte("seed"))
+		is.NoError(err)
+		b, _ := fakeValue(kind, []byte("seed"))
+		is.Equal(a, b, "Fake %s values should be deterministic", kind)
+		is.NotEmpty(a)
+	}
+}
+
+func TestTransformedExports(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("redact")
+	_, err := db.Collection("users").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "email", Value: "alice@corp.com"}, {Key: "password", Value: "x"}, {Key: "active", Value: true}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "email", Value: "bob@corp.com"}, {Key: "password", Value: "y"}, {Key: "active", Value: false}},
+	})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	transform := &Transform{Rules: []TransformRule{
+		{Field: "email", Action: TransformFake, Fake: FakeEmail},
+		{Field: "password", Action: TransformDrop},
+		{Action: TransformKeep, Filter: bson.D{{Key: "active", Value: true}}},
+	}}
+
+	out, err := conn.DatabaseExporter("redact", "users").Transform(transform).String()
+	is.NoError(err, "Could not export transformed JSON")
+	is.NotContains(out, "corp.com")
+	is.NotContains(out, "password")
+	is.Equal(1, strings.Count(strings.TrimSpace(out), "\n")+1, "Only kept documents should be exported")
+
+	out, err = conn.DatabaseExporter("redact", "users").CSV().Transform(transform).String()
+	is.NoError(err, "Could not export transformed CSV")
+	is.True(strings.HasPrefix(out, "_id,active,email\n"), "Dropped fields should not become columns")
+	is.NotContains(out, "corp.com")
+
+	_, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	is.NoError(err)
+	snapshot, err := conn.Dump(ctx, DumpOptions{Database: "redact", Transform: transform})
+	if !is.NoError(err, "Could not dump a transformed snapshot") {
+		t.FailNow()
+	}
+	names, err := conn.MongoDriverClient().ListDatabaseNames(ctx, bson.D{})
+	is.NoError(err)
+	for _, name := range names {
+		is.False(strings.HasPrefix(name, transformedDBPrefix), "The temporary database %s should be dropped", name)
+	}
+	is.NoError(conn.Restore(ctx, snapshot), "Could not restore the transformed snapshot")
+	count, err := db.Collection("users").CountDocuments(ctx, bson.M{})
+	is.NoError(err)
+	is.Equal(int64(1), count, "The restored snapshot should only contain kept documents")
+	is.Error(db.Collection("users").FindOne(ctx, bson.M{"email": "alice@corp.com"}).Err(), "Emails should have been faked")
+	specs, err := db.Collection("users").Indexes().ListSpecifications(ctx)
+	is.NoError(err)
+	for _, spec := range specs {
+		if spec.Name == "email_1" {
+			is.True(spec.Unique == nil || !*spec.Unique, "Faked fields should lose their unique index")
+		}
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	is := assert.New(t)
+	anonymizer := &Anonymizer{Salt: "test", Rules: []AnonymizeRule{
+		{Collection: "users", Field: "_id"},
+		{Collection: "orders", Field: "userID"},
+		{Field: "email", Fake: FakeEmail},
+		{Field: "profile"},
+	}}
+	is.NoError(anonymizer.Validate())
+	userID := primitive.NewObjectID()
+	born := primitive.NewDateTimeFromTime(time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC))
+	user := bson.D{
+		{Key: "_id", Value: userID},
+		{Key: "email", Value: "alice@corp.com"},
+		{Key: "active", Value: true},
+		{Key: "profile", Value: bson.D{
+			{Key: "name", Value: "Alice Smith"},
+			{Key: "age", Value: int32(34)},
+			{Key: "visits", Value: int64(1200)},
+			{Key: "born", Value: born},
+			{Key: "avatar", Value: primitive.Binary{Subtype: 0x80, Data: []byte{1, 2, 3}}},
+			{Key: "verified", Value: true},
+		}},
+	}
+	report := newAnonymizeReport()
+	out, err := anonymizer.anonymize("app", "users", user, report)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	m := out.Map()
+	is.IsType(primitive.ObjectID{}, m["_id"])
+	is.NotEqual(userID, m["_id"])
+	is.Contains(m["email"], "@example.")
+	is.Equal(true, m["active"], "Fields without a rule should be left alone")
+	profile := m["profile"].(bson.D).Map()
+	is.Len(profile["name"], len("Alice Smith"))
+	is.Equal(" ", profile["name"].(string)[5:6], "Punctuation should be kept")
+	age := profile["age"].(int32)
+	is.True(age >= 10 && age < 100, "Numbers should keep their number of digits")
+	visits := profile["visits"].(int64)
+	is.True(visits >= 1000 && visits < 10000, "Numbers should keep their number of digits")
+	is.NotEqual(born, profile["born"])
+	is.InDelta(0, profile["born"].(primitive.DateTime).Time().Sub(born.Time()), float64(anonymizeMaxDateShift))
+	avatar := profile["avatar"].(primitive.Binary)
+	is.Equal(byte(0x80), avatar.Subtype)
+	is.Len(avatar.Data, 3)
+	is.Equal(true, profile["verified"], "Booleans should be left alone")
+
+	order, err := anonymizer.anonymize("app", "orders", bson.D{{Key: "_id", Value: 1}, {Key: "userID", Value: userID}}, report)
+	is.NoError(err)
+	is.Equal(m["_id"], order.Map()["userID"], "References should be anonymized consistently")
+	is.Equal(1, order.Map()["_id"], "Collection scoped rules should not apply elsewhere")
+
+	is.Equal(int64(2), report.Documents)
+	is.Equal(map[string]int64{
+		"app.users._id":     1,
+		"app.users.email":   1,
+		"app.users.profile": 5,
+		"app.orders.userID": 1,
+	}, report.Fields)
+	is.Contains(report.String(), "app.users.profile: 5 values")
+
+	again, err := anonymizer.anonymize("app", "users", user, newAnonymizeReport())
+	is.NoError(err)
+	is.Equal(out, again, "Anonymizing should be deterministic")
+	salted, err := (&Anonymizer{Salt: "other", Rules: anonymizer.Rules}).anonymize("app", "users", user, newAnonymizeReport())
+	is.NoError(err)
+	is.NotEqual(out.Map()["_id"], salted.Map()["_id"], "The salt should change the fake values")
+
+	is.Error((&Anonymizer{Rules: []AnonymizeRule{{Field: "name", Fake: "nope"}}}).Validate())
+	is.Error((&Anonymizer{Rules: []AnonymizeRule{{Fake: FakeName}}}).Validate())
+}
+
+func TestAnonymizedImports(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	anonymizer := &Anonymizer{Salt: "test", Rules: []AnonymizeRule{{Field: "email", Fake: FakeEmail}}}
+	input := `{"_id": 1, "email": "alice@corp.com", "n": {"$numberLong": "5"}}
+{"_id": 2, "email": "bob@corp.com", "n": {"$numberLong": "6"}}
+`
+	result, err := conn.DatabaseImporter("anon", "users").Anonymize(anonymizer).FromReader(strings.NewReader(input))
+	if !is.NoError(err, "Could not import anonymized documents") {
+		t.FailNow()
+	}
+	is.Equal(uint64(2), result.Imported)
+	if is.NotNil(result.Anonymized) {
+		is.Equal(int64(2), result.Anonymized.Fields["anon.users.email"])
+	}
+	coll := conn.MongoDriverClient().Database("anon").Collection("users")
+	is.Error(coll.FindOne(ctx, bson.M{"email": "alice@corp.com"}).Err(), "Emails should have been anonymized")
+	var doc bson.D
+	is.NoError(coll.FindOne(ctx, bson.M{"_id": 1}).Decode(&doc))
+	is.Equal(int64(5), doc.Map()["n"], "Types should be preserved")
+	stagingNames := func() []string {
+		names, err := conn.MongoDriverClient().ListDatabaseNames(ctx, bson.D{})
+		is.NoError(err)
+		var staging []string
+		for _, name := range names {
+			if strings.HasPrefix(name, anonymizeDBPrefix) {
+				staging = append(staging, name)
+			}
+		}
+		return staging
+	}
+	is.Empty(stagingNames(), "The staging database should be dropped")
+
+	snapshot, err := conn.Dump(ctx, DumpOptions{Database: "anon"})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	_, err = coll.InsertOne(ctx, bson.D{{Key: "_id", Value: 3}, {Key: "email", Value: "carol@corp.com"}})
+	is.NoError(err)
+	// A staging database left behind by a crashed run must not be restored
+	leftover := conn.MongoDriverClient().Database(anonymizeDBPrefix + "other")
+	_, err = leftover.Collection("users").InsertOne(ctx, bson.D{{Key: "email", Value: "dave@corp.com"}})
+	is.NoError(err)
+	report, err := conn.RestoreAnonymized(ctx, snapshot, &Anonymizer{Salt: "again", Rules: anonymizer.Rules})
+	if !is.NoError(err, "Could not restore an anonymized snapshot") {
+		t.FailNow()
+	}
+	is.Equal(int64(2), report.Documents)
+	is.Equal([]string{anonymizeDBPrefix + "other"}, stagingNames(), "Only this restore's staging databases should be used and dropped")
+	count, err := conn.MongoDriverClient().Database("other").Collection("users").CountDocuments(ctx, bson.M{})
+	is.NoError(err)
+	is.Zero(count, "Unrelated staging databases should not be restored")
+	count, err = coll.CountDocuments(ctx, bson.M{})
+	is.NoError(err)
+	is.Equal(int64(2), count, "Restoring should replace the existing collection")
+	var restored bson.D
+	is.NoError(coll.FindOne(ctx, bson.M{"_id": 1}).Decode(&restored))
+	is.NotEqual(doc.Map()["email"], restored.Map()["email"], "The restored data should be anonymized with the new salt")
+}
+
+func TestGoldenNormalization(t *testing.T) {
+	is := assert.New(t)
+	is.Nil(flag.Lookup("update"), "Importing mongotest should not register an -update flag")
+	t.Setenv(goldenUpdateEnv, "1")
+	is.True((&goldenConfig{}).goldenUpdateRequested())
+	optionConfig := &goldenConfig{}
+	GoldenUpdate(false)(optionConfig)
+	is.False(optionConfig.goldenUpdateRequested(), "GoldenUpdate should override the environment")
+	t.Setenv(goldenUpdateEnv, "")
+	is.False((&goldenConfig{}).goldenUpdateRequested())
+
+	fs := flag.NewFlagSet("golden", flag.ContinueOnError)
+	is.False(goldenUpdateFlagSet(fs), "A missing -update flag should not rewrite golden files")
+	fs.Bool("update", false, "rewrite golden files")
+	is.False(goldenUpdateFlagSet(fs))
+	is.NoError(fs.Parse([]string{"-update"}))
+	is.True(goldenUpdateFlagSet(fs), "The test package's own -update flag should be honoured")
+
+	userID := primitive.NewObjectID()
+	normalizer := &goldenNormalizer{
+		config:    &goldenConfig{ignorePaths: []string{"items.etag"}},
+		objectIDs: map[primitive.ObjectID]int{},
+	}
+	doc, err := normalizer.normalize(bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "user", Value: userID},
+		{Key: "created", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "items", Value: bson.A{bson.D{{Key: "etag", Value: "abc"}, {Key: "owner", Value: userID}}}},
+	})
+	is.NoError(err)
+	is.Equal(bson.D{
+		{Key: "_id", Value: "<ObjectID 1>"},
+		{Key: "user", Value: "<ObjectID 2>"},
+		{Key: "created", Value: "<Date>"},
+		{Key: "items", Value: bson.A{bson.D{{Key: "etag", Value: "<ignored>"}, {Key: "owner", Value: "<ObjectID 2>"}}}},
+	}, doc, "Repeated ObjectIDs should share a placeholder")
+
+	diff := lineDiff("a\nb\nc\nd\ne\nf\ng\nh\ni\n", "a\nb\nc\nd\ne\nf\nG\nh\ni\n")
+	is.Equal("--- want\n+++ got\n  ...\n  d\n  e\n  f\n- g\n+ G\n  h\n  i\n", diff)
+	is.Equal("--- want\n+++ got\n+ x\n", lineDiff("", "x\n"))
+
+	// Large files shouldn't need a table covering every pair of lines
+	var want, got strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&want, "line %d\n", i)
+		if i == 25000 {
+			got.WriteString("changed\n")
+		} else {
+			fmt.Fprintf(&got, "line %d\n", i)
+		}
+	}
+	is.Equal("--- want\n+++ got\n  ...\n  line 24997\n  line 24998\n  line 24999\n- line 25000\n+ changed\n  line 25001\n  line 25002\n  line 25003\n  ...\n",
+		lineDiff(want.String(), got.String()), "Common prefixes and suffixes should be skipped")
+	diff = lineDiff(strings.Repeat("a\nb\n", 5000), strings.Repeat("b\nc\n", 5000))
+	is.True(strings.HasPrefix(diff, "--- want\n+++ got\n- a\n- b\n"), "Huge diffs should fall back to removed then added lines")
+	is.Equal(10000, strings.Count(diff, "\n- "))
+	is.Equal(10000, strings.Count(diff, "\n+ "))
+}
+
+func TestAssertCollectionGolden(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	_, err := conn.MongoDriverClient().Database("golden").Collection("orders").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "number", Value: 2}, {Key: "at", Value: primitive.NewDateTimeFromTime(time.Now())}},
+		bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "number", Value: 1}, {Key: "at", Value: primitive.NewDateTimeFromTime(time.Now())}},
+	})
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	goldenPath := filepath.Join(t.TempDir(), "golden", "orders.json")
+	t.Setenv(goldenUpdateEnv, "1")
+	is.True(AssertCollectionGolden(t, conn, "golden", "orders", goldenPath, GoldenSortBy("number")), "The golden file should be written when updating")
+	t.Setenv(goldenUpdateEnv, "")
+	written, err := os.ReadFile(goldenPath)
+	is.NoError(err)
+	is.Equal(`[
+  {
+    "_id": "<ObjectID 1>",
+    "number": 1,
+    "at": "<Date>"
+  },
+  {
+    "_id": "<ObjectID 2>",
+    "number": 2,
+    "at": "<Date>"
+  }
+]
+`, string(written))
+	is.True(AssertCollectionGolden(t, conn, "golden", "orders", goldenPath, GoldenSortBy("number")))
+
+	_, err = conn.MongoDriverClient().Database("golden").Collection("orders").UpdateOne(ctx, bson.M{"number": 2}, bson.M{"$set": bson.M{"number": 3}})
+	is.NoError(err)
+	recorder := &recordingTB{TB: t}
+	is.False(AssertCollectionGolden(recorder, conn, "golden", "orders", goldenPath, GoldenSortBy("number")), "Changes should fail the assertion")
+	if is.Len(recorder.errors, 1) {
+		is.Contains(recorder.errors[0], "-     \"number\": 2,")
+		is.Contains(recorder.errors[0], "+     \"number\": 3,")
+	}
+	is.False(AssertCollectionGolden(recorder, conn, "golden", "orders", goldenPath+".missing"), "Missing golden files should fail the assertion")
+	is.True(AssertCollectionGolden(t, conn, "golden", "orders", goldenPath+".option", GoldenUpdate(true)), "GoldenUpdate should write the golden file")
+	is.FileExists(goldenPath + ".option")
+}
+
+// recordingTB captures the errors reported by assertions which are expected to fail
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestDiffDocuments(t *testing.T) {
+	is := assert.New(t)
+	marshal := func(doc bson.D) bson.Raw {
+		raw, err := bson.Marshal(doc)
+		is.NoError(err)
+		return raw
+	}
+	dc := &diffConfig{}
+	DiffIgnorePaths("updatedAt", "items.etag")(dc)
+	var fields []FieldDiff
+	err := diffDocuments(marshal(bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "n", Value: int32(5)},
+		{Key: "old", Value: "x"},
+		{Key: "updatedAt", Value: 1},
+		{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "a"}, {Key: "etag", Value: "1"}}}},
+	}), marshal(bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "n", Value: int64(5)},
+		{Key: "updatedAt", Value: 2},
+		{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "b"}, {Key: "etag", Value: "2"}}, "extra"}},
+		{Key: "new", Value: true},
+	}), nil, dc, &fields)
+	is.NoError(err)
+	paths := map[string]ChangeKind{}
+	for _, field := range fields {
+		paths[field.Path] = field.Kind
+	}
+	is.Equal(map[string]ChangeKind{
+		"n":           ChangeModified,
+		"old":         ChangeRemoved,
+		"items.0.sku": ChangeModified,
+		"items.1":     ChangeAdded,
+		"new":         ChangeAdded,
+	}, paths, "Type changes should count, and ignored paths should be skipped")
+
+	diff := &Diff{A: "a.c", B: "b.c", Key: "_id", Documents: []DocumentDiff{
+		{Collection: "c", Key: bson.RawValue{Type: bsontype.Int32, Value: []byte{1, 0, 0, 0}}, Kind: ChangeModified, Fields: fields[:1]},
+	}}
+	is.Equal("a.c vs b.c: 0 added, 0 removed, 1 changed\n~ c {\"$numberInt\":\"1\"}\n    n: {\"$numberInt\":\"5\"} -> {\"$numberLong\":\"5\"}", diff.String())
+	out, err := diff.JSON()
+	is.NoError(err)
+	is.Contains(string(out), `"oldType": "32-bit integer"`)
+	is.Contains(string(out), `"newType": "64-bit integer"`)
+
+	key := func(v interface{}) bson.RawValue {
+		raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+		is.NoError(err)
+		return bson.Raw(raw).Lookup("v")
+	}
+	older, newer := primitive.NewObjectIDFromTimestamp(time.Unix(1, 0)), primitive.NewObjectIDFromTimestamp(time.Unix(2, 0))
+	is.Equal(-1, compareDiffKeys(key(int32(2)), key(int64(10))), "Numbers should be compared by value")
+	is.Equal(0, compareDiffKeys(key(int32(2)), key(2.0)))
+	is.Equal(1, compareDiffKeys(key("b"), key("a")))
+	is.Equal(-1, compareDiffKeys(key(100), key("a")), "Numbers sort before strings")
+	is.Equal(-1, compareDiffKeys(key(older), key(newer)))
+	is.Equal(-1, compareDiffKeys(key(primitive.Timestamp{T: 1, I: 9}), key(primitive.Timestamp{T: 2, I: 1})))
+
+	is.True(matchDiffPath([]string{"items", "etag"}, []string{"items", "3", "etag"}))
+	is.False(matchDiffPath([]string{"items", "etag"}, []string{"items", "sku"}))
+}
+
+func TestDiffCollections(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	client := conn.MongoDriverClient()
+	_, err := client.Database("before").Collection("users").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "age", Value: int32(34)}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "age", Value: int32(40)}},
+	})
+	is.NoError(err)
+	_, err = client.Database("after").Collection("users").InsertMany(ctx, []interface{}{
+		bson.D{{Key: "_id", Value: 1}, {Key: "age", Value: int64(34)}},
+		bson.D{{Key: "_id", Value: 0}, {Key: "age", Value: int32(21)}},
+	})
+	is.NoError(err)
+	_, err = client.Database("after").Collection("audit").InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	is.NoError(err)
+
+	diff, err := DiffCollections(ctx, conn.Namespace("before", "users"), conn.Namespace("after", "users"), "")
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	added, removed, changed := diff.Counts()
+	is.Equal([]int{1, 1, 1}, []int{added, removed, changed}, diff.String())
+	var kinds []ChangeKind
+	for _, doc := range diff.Documents {
+		kinds = append(kinds, doc.Kind)
+	}
+	is.Equal([]ChangeKind{ChangeAdded, ChangeModified, ChangeRemoved}, kinds, "Differences should be in key order")
+
+	diff, err = DiffCollections(ctx, conn.Namespace("before", "users"), conn.Namespace("after", "users"), "", DiffIgnorePaths("age"))
+	is.NoError(err)
+	_, _, changed = diff.Counts()
+	is.Equal(0, changed, "Ignored paths should not count as changes")
+
+	diff, err = DiffCollections(ctx, conn.Namespace("before", ""), conn.Namespace("after", ""), "_id")
+	is.NoError(err)
+	added, _, _ = diff.Counts()
+	is.Equal(2, added, "Collections only in one database should be compared too")
+
+	_, err = DiffCollections(ctx, conn.Namespace("before", ""), conn.Namespace("after", "users"), "_id")
+	is.Error(err, "Collections can't be compared with databases")
+	diff, err = DiffCollections(ctx, conn.Namespace("before", "users"), conn.Namespace("before", "users"), "age")
+	is.NoError(err)
+	is.True(diff.Empty())
+}
+
+func TestResetData(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	client := conn.MongoDriverClient()
+	db := client.Database("reset")
+	validator := bson.D{{Key: "$jsonSchema", Value: bson.D{{Key: "required", Value: bson.A{"n"}}}}}
+	is.NoError(db.CreateCollection(ctx, "validated", options.CreateCollection().SetValidator(validator)))
+	is.NoError(db.CreateCollection(ctx, "capped", options.CreateCollection().SetCapped(true).SetSizeInBytes(4096)))
+	_, err := db.Collection("validated").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "n", Value: 1}}})
+	is.NoError(err)
+	seed := func() {
+		for _, collName := range []string{"validated", "capped"} {
+			_, err := db.Collection(collName).InsertMany(ctx, []interface{}{bson.D{{Key: "n", Value: 1}}, bson.D{{Key: "n", Value: 2}}})
+			is.NoError(err)
+		}
+	}
+	seed()
+
+	report, err := conn.ResetData(ResetTruncate())
+	if !is.NoError(err, "Could not truncate") {
+		t.FailNow()
+	}
+	is.Equal(2, report.Collections)
+	is.Equal(int64(4), report.Documents)
+	is.Contains(report.Timings, "reset")
+	for _, collName := range []string{"validated", "capped"} {
+		count, err := db.Collection(collName).CountDocuments(ctx, bson.D{})
+		is.NoError(err)
+		is.Zero(count, "%s should be empty", collName)
+	}
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{})
+	is.NoError(err)
+	for _, spec := range specs {
+		if spec.Name == "validated" {
+			is.NotEmpty(spec.Options.Lookup("validator"), "Validators should be kept")
+		} else {
+			is.Equal(true, spec.Options.Lookup("capped").Boolean(), "Capped collections should stay capped")
+		}
+	}
+	indexes, err := db.Collection("validated").Indexes().ListSpecifications(ctx)
+	is.NoError(err)
+	is.Len(indexes, 2, "Indexes should be kept")
+
+	seed()
+	snapshot, err := conn.Dump(ctx, DumpOptions{Database: "reset"})
+	is.NoError(err)
+	_, err = client.Database("other").Collection("c").InsertOne(ctx, bson.D{{Key: "n", Value: 1}})
+	is.NoError(err)
+	report, err = conn.ResetData(ResetToSnapshot(snapshot))
+	is.NoError(err, "Could not reset to the snapshot")
+	is.ElementsMatch([]string{"reset", "other"}, report.Databases)
+	is.Contains(report.Timings, "restore")
+	count, err := db.Collection("validated").CountDocuments(ctx, bson.D{})
+	is.NoError(err)
+	is.Equal(int64(2), count, "The snapshot should be restored")
+
+	is.NoError(conn.DropAllDatabases())
+	names, err := client.ListDatabaseNames(ctx, bson.D{})
+	is.NoError(err)
+	for _, name := range names {
+		is.True(internalDatabases[name], "Only internal databases should remain, found %s", name)
+	}
+	is.Contains(names, "admin")
+
+	_, err = conn.ResetData(ResetToSnapshot(nil))
+	is.ErrorIs(err, ErrReset)
+}
+
+func TestParseSchema(t *testing.T) {
+	is := assert.New(t)
+	schema, err := ParseSchema([]byte(`
+databases:
+  shop:
+    orders:
+      validator:
+        $jsonSchema:
+          required: [status]
+      validationLevel: moderate
+      collation: {locale: en, strength: 2}
+      indexes:
+        - keys: {lastName: 1, firstName: -1}
+          unique: true
+        - keys: {createdAt: 1}
+          expireAfterSeconds: 3600
+        - keys: {status: 1}
+          partialFilterExpression: {status: {$exists: true}}
+    events:
+      capped: true
+      size: 4096
+  metrics:
+    readings:
+      timeseries: {timeField: ts, metaField: sensor}
+      expireAfterSeconds: 60
+`))
+	if !is.NoError(err, "Could not parse the schema") {
+		t.FailNow()
+	}
+	if !is.Len(schema.Databases, 2) {
+		t.FailNow()
+	}
+	is.Equal("metrics", schema.Databases[0].Name, "Databases should be sorted")
+	shop := schema.Databases[1]
+	is.Equal([]string{"events", "orders"}, []string{shop.Collections[0].Name, shop.Collections[1].Name})
+	orders := shop.Collections[1]
+	is.Equal(bson.D{{Key: "$jsonSchema", Value: bson.D{{Key: "required", Value: bson.A{"status"}}}}}, orders.Validator)
+	is.Equal(bson.D{{Key: "lastName", Value: int32(1)}, {Key: "firstName", Value: int32(-1)}}, orders.Indexes[0].Keys, "Key order should be kept")
+	is.Equal("lastName_1_firstName_-1", orders.Indexes[0].name())
+	is.Equal(int64(3600), *orders.Indexes[1].ExpireAfterSeconds)
+	is.Equal(bson.D{
+		{Key: "validator", Value: orders.Validator},
+		{Key: "validationLevel", Value: "moderate"},
+		{Key: "collation", Value: bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int32(2)}}},
+	}, orders.createOptions())
+	is.Equal(bson.D{
+		{Key: "expireAfterSeconds", Value: int64(60)},
+		{Key: "timeseries", Value: bson.D{{Key: "timeField", Value: "ts"}, {Key: "metaField", Value: "sensor"}}},
+	}, schema.Databases[0].Collections[0].createOptions())
+
+	_, err = ParseSchema([]byte("databases: {shop: {events: {capped: true}}}"))
+	is.Error(err, "Capped collections without a size should be rejected")
+	_, err = ParseSchema([]byte("databases: {shop: {orders: {indexes: [{unique: true}]}}}"))
+	is.Error(err, "Indexes without keys should be rejected")
+
+	collation, _ := bson.Marshal(bson.D{{Key: "locale", Value: "en"}, {Key: "strength", Value: int64(2)}, {Key: "caseLevel", Value: false}})
+	liveCollation := bson.RawValue{Type: bsontype.EmbeddedDocument, Value: collation}
+	is.True(schemaValuesMatch(bson.D{{Key: "strength", Value: 2}, {Key: "locale", Value: "en"}}, liveCollation, true),
+		"Subsets should match regardless of number types")
+	is.False(schemaValuesMatch(bson.D{{Key: "locale", Value: "en"}}, liveCollation, false))
+}
+
+func TestApplySchema(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	schema, err := ParseSchema([]byte(`
+databases:
+  shop:
+    orders:
+      validator: {$jsonSchema: {required: [status]}}
+      indexes:
+        - keys: {email: 1}
+          unique: true
+        - keys: {createdAt: 1}
+          expireAfterSeconds: 3600
+    events:
+      capped: true
+      size: 4096
+  telemetry:
+    metrics:
+      timeseries: {timeField: ts, metaField: sensor, granularity: minutes}
+      expireAfterSeconds: 86400
+`))
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	drifts, err := conn.CheckSchema(schema)
+	is.NoError(err)
+	is.NotEmpty(drifts, "Missing collections should be reported")
+	if !is.NoError(conn.ApplySchema(schema), "Could not apply the schema") {
+		t.FailNow()
+	}
+	drifts, err = conn.CheckSchema(schema)
+	is.NoError(err)
+	// Recent servers also index the metaField and timeField of the time series collection
+	is.Empty(drifts, "The applied schema should not drift")
+
+	db := conn.MongoDriverClient().Database("shop")
+	_, err = db.Collection("orders").Indexes().DropOne(ctx, "email_1")
+	is.NoError(err)
+	_, err = db.Collection("orders").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "email", Value: 1}}})
+	is.NoError(err)
+	_, err = db.Collection("orders").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "extra", Value: 1}}})
+	is.NoError(err)
+	is.NoError(db.RunCommand(ctx, bson.D{{Key: "collMod", Value: "orders"}, {Key: "validator", Value: bson.D{}}}).Err())
+	drifts, err = conn.CheckSchema(schema)
+	is.NoError(err)
+	var problems []string
+	for _, drift := range drifts {
+		problems = append(problems, drift.String())
+	}
+	is.Len(drifts, 3, strings.Join(problems, "\n"))
+	is.Contains(problems, "shop.orders index email_1: expected unique true, found nothing")
+	is.Contains(problems, "shop.orders index extra_1: index is not in the schema")
+
+	is.NoError(conn.ApplySchema(schema), "Could not fix the drifted schema")
+	drifts, err = conn.CheckSchema(schema)
+	is.NoError(err)
+	is.Len(drifts, 1, "Only the unexpected index should remain")
+
+	schema.Databases[0].Collections[0].Size = 1 << 20
+	err = conn.ApplySchema(schema)
+	is.Error(err, "Capped sizes can't be changed in place")
+}
+
+type modelAddress struct {
+	City    string `bson:"city" mongotest:"index"`
+	Country string `bson:"country,omitempty"`
+}
+
+// TenantModel is exported as the driver skips unexported embedded structs
+type TenantModel struct {
+	TenantID string `bson:"tenantId" mongotest:"index=byTenant"`
+}
+
+type modelUser struct {
+	TenantModel `bson:",inline"`
+	ID          primitive.ObjectID `bson:"_id"`
+	Email       string             `bson:"email" mongotest:"index,unique"`
+	LastName    string             `bson:"lastName" mongotest:"index=byName;index=byTenant"`
+	FirstName   string             `bson:"firstName" mongotest:"index=byName,desc"`
+	Age         int                `bson:"age"`
+	Score       *float64           `bson:"score"`
+	Tags        []string           `bson:"tags,omitempty"`
+	Addresses   []modelAddress     `bson:"addresses"`
+	CreatedAt   time.Time          `bson:"createdAt" mongotest:"index,ttl=3600"`
+	Ignored     string             `bson:"-" mongotest:"index"`
+	Nickname    string
+}
+
+func TestSchemaForModel(t *testing.T) {
+	is := assert.New(t)
+	collSchema, err := SchemaForModel[modelUser]("users", WithModelValidator())
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	var indexes []string
+	for _, index := range collSchema.Indexes {
+		indexes = append(indexes, fmt.Sprintf("%s %v unique=%v", index.name(), index.Keys, index.Unique))
+	}
+	is.Equal([]string{
+		"byTenant [{tenantId 1} {lastName 1}] unique=false",
+		"email_1 [{email 1}] unique=true",
+		"byName [{lastName 1} {firstName -1}] unique=false",
+		"addresses.city_1 [{addresses.city 1}] unique=false",
+		"createdAt_1 [{createdAt 1}] unique=false",
+	}, indexes)
+	if is.Len(collSchema.Indexes, 5) && is.NotNil(collSchema.Indexes[4].ExpireAfterSeconds) {
+		is.EqualValues(3600, *collSchema.Indexes[4].ExpireAfterSeconds)
+	}
+
+	jsonSchema, ok := collSchema.Validator.Map()["$jsonSchema"].(bson.D)
+	if !is.True(ok, "A $jsonSchema validator should be generated") {
+		t.FailNow()
+	}
+	is.Equal(bson.A{"tenantId", "_id", "email", "lastName", "firstName", "age", "addresses", "createdAt", "nickname"},
+		jsonSchema.Map()["required"])
+	properties := jsonSchema.Map()["properties"].(bson.D).Map()
+	is.Equal(bson.D{{Key: "bsonType", Value: "objectId"}}, properties["_id"])
+	is.Equal(bson.D{{Key: "bsonType", Value: bson.A{"int", "long"}}}, properties["age"])
+	is.Equal(bson.D{{Key: "bsonType", Value: bson.A{"double", "null"}}}, properties["score"])
+	is.Equal(bson.D{{Key: "bsonType", Value: "date"}}, properties["createdAt"])
+	is.Equal(bson.D{
+		{Key: "bsonType", Value: bson.A{"array", "null"}},
+		{Key: "items", Value: bson.D{
+			{Key: "bsonType", Value: "object"},
+			{Key: "required", Value: bson.A{"city"}},
+			{Key: "properties", Value: bson.D{
+				{Key: "city", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+				{Key: "country", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+			}},
+		}},
+	}, properties["addresses"])
+	is.NotContains(properties, "Ignored")
+
+	type badTag struct {
+		Name string `bson:"name" mongotest:"index,clustered"`
+	}
+	_, err = SchemaForModel[badTag]("bad")
+	is.Error(err, "Unknown index options should be rejected")
+	type compoundTTL struct {
+		Tenant  string    `bson:"tenant" mongotest:"index=expiry"`
+		Created time.Time `bson:"created" mongotest:"index=expiry,ttl=60"`
+	}
+	_, err = SchemaForModel[compoundTTL]("bad")
+	is.Error(err, "TTLs on compound indexes should be rejected")
+	type taggedInline struct {
+		Tenant struct {
+			ID string `bson:"id"`
+		} `bson:",inline" mongotest:"index"`
+	}
+	_, err = SchemaForModel[taggedInline]("bad")
+	is.Error(err, "Inline fields have no key to index")
+	_, err = SchemaForModel[string]("bad")
+	is.Error(err, "Only structs can be models")
+}
+
+func TestEnsureModel(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	if !is.NoError(EnsureModel[modelUser](conn, "app", "users", WithModelValidator())) {
+		t.FailNow()
+	}
+	coll := conn.MongoDriverClient().Database("app").Collection("users")
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	is.NoError(err)
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	is.ElementsMatch([]string{"_id_", "byTenant", "email_1", "byName", "addresses.city_1", "createdAt_1"}, names)
+
+	_, err = coll.InsertOne(ctx, modelUser{ID: primitive.NewObjectID(), Email: "a@example.com", CreatedAt: time.Now()})
+	is.NoError(err, "Documents encoded from the model should pass its validator")
+	_, err = coll.InsertOne(ctx, bson.D{{Key: "email", Value: 42}})
+	is.Error(err, "Documents which don't match the model should be rejected")
+	is.NoError(EnsureModel[modelUser](conn, "app", "users", WithModelValidator()), "EnsureModel should be idempotent")
+}
+
+type generatedAddress struct {
+	Street string `bson:"street" faker:"address"`
+	City   string `bson:"city"`
+}
+
+type generatedUser struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Email     string             `bson:"email"`
+	FirstName string             `bson:"first_name"`
+	Handle    string             `bson:"handle" faker:"username"`
+	Plan      string             `bson:"plan" faker:"oneof: free, pro, team"`
+	Age       int                `bson:"age" faker:"boundary_start=18, boundary_end=90"`
+	Balance   float64            `bson:"balance"`
+	Tags      []string           `bson:"tags" faker:"len=3"`
+	Address   *generatedAddress  `bson:"address"`
+	Previous  []generatedAddress `bson:"previous"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	Secret    string             `bson:"secret" faker:"-"`
+	Tenant    string             `bson:"tenant"`
+	Level     uint8              `bson:"level"`
+}
+
+func TestGenerate(t *testing.T) {
+	is := assert.New(t)
+	users, err := Generate[generatedUser](42, 50)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	again, err := Generate[generatedUser](42, 50)
+	is.NoError(err)
+	is.Equal(users, again, "The same seed should generate the same documents")
+	other, err := Generate[generatedUser](43, 50)
+	is.NoError(err)
+	is.NotEqual(users, other, "Different seeds should generate different documents")
+
+	ids := map[primitive.ObjectID]bool{}
+	for _, user := range users {
+		ids[user.ID] = true
+		is.Contains(user.Email, "@", "Email fields should get email addresses")
+		is.Contains(fakeFirstNames, user.FirstName, "Name fields should get names")
+		is.Contains([]string{"free", "pro", "team"}, user.Plan)
+		is.GreaterOrEqual(user.Age, 18)
+		is.LessOrEqual(user.Age, 90)
+		is.Len(user.Tags, 3)
+		if is.NotNil(user.Address) {
+			is.Contains(fakeCities, user.Address.City)
+			is.NotEmpty(user.Address.Street)
+		}
+		is.NotEmpty(user.Previous)
+		is.True(user.CreatedAt.Before(generateEpoch) || user.CreatedAt.Equal(generateEpoch))
+		is.Equal(user.CreatedAt, user.CreatedAt.Truncate(time.Millisecond))
+		is.Empty(user.Secret, "Fields tagged with '-' should be left empty")
+	}
+	is.Len(ids, 50, "Generated ObjectIDs should be unique")
+
+	users, err = Generate[generatedUser](42, 4,
+		WithFieldSequence("handle", "user%d"),
+		WithFieldValues("tenant", "acme", "globex"),
+		WithFieldGenerator("address.city", func(i int, rnd *rand.Rand) interface{} { return "Gotham" }),
+		WithFieldGenerator("level", func(i int, rnd *rand.Rand) interface{} { return i * 2 }),
+	)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	for i, user := range users {
+		is.Equal(fmt.Sprintf("user%d", i+1), user.Handle)
+		is.Equal([]string{"acme", "globex"}[i%2], user.Tenant)
+		is.Equal("Gotham", user.Address.City)
+		is.EqualValues(i*2, user.Level)
+		is.Equal(again[i].Email, user.Email, "Overrides should not change the other fields")
+	}
+
+	_, err = Generate[generatedUser](42, 1, WithFieldGenerator("age", func(int, *rand.Rand) interface{} { return "old" }))
+	is.Error(err, "Overrides of the wrong type should be rejected")
+	_, err = Generate[generatedUser](42, 1, WithFieldGenerator("email", func(int, *rand.Rand) interface{} { return 65 }))
+	is.Error(err, "Numbers should not be converted to strings")
+	_, err = Generate[generatedUser](42, 1, WithFieldGenerator("age", func(int, *rand.Rand) interface{} { return 1.5 }))
+	is.Error(err, "Numbers should not be truncated")
+	_, err = Generate[generatedUser](42, 1, WithFieldGenerator("level", func(int, *rand.Rand) interface{} { return 300 }))
+	is.Error(err, "Numbers should not overflow")
+	_, err = Generate[generatedUser](42, 1, WithFieldValues("tenant"))
+	is.Error(err, "There should be values to cycle through")
+	type plan string
+	type planned struct {
+		Plan    plan    `bson:"plan"`
+		Balance float64 `bson:"balance"`
+	}
+	plans, err := Generate[planned](42, 1,
+		WithFieldValues("plan", "pro"),
+		WithFieldGenerator("balance", func(int, *rand.Rand) interface{} { return 12 }))
+	if is.NoError(err, "Values of the same kind and numbers which fit should be converted") {
+		is.Equal(planned{Plan: "pro", Balance: 12}, plans[0])
+	}
+
+	type employee struct {
+		Name    string      `bson:"name"`
+		Manager *employee   `bson:"manager"`
+		Reports []employee  `bson:"reports"`
+		Peers   []*employee `bson:"peers"`
+		ByName  map[string]employee
+	}
+	employees, err := Generate[employee](42, 2)
+	if is.NoError(err, "Recursive types should be generated") {
+		is.NotEmpty(employees[0].Name)
+		is.Nil(employees[0].Manager, "Recursive pointers should be left nil")
+		is.Empty(employees[0].Reports, "Recursive slices should be left empty")
+		is.Empty(employees[0].Peers)
+		is.Empty(employees[0].ByName)
+	}
+	type badBoundary struct {
+		Age int `faker:"boundary_start=9, boundary_end=1"`
+	}
+	_, err = Generate[badBoundary](42, 1)
+	is.Error(err, "Invalid boundaries should be rejected")
+	_, err = Generate[int](42, 1)
+	is.Error(err, "Only structs can be generated")
+}
+
+func TestInsertGenerated(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	users, err := InsertGenerated[generatedUser](conn, "app", "users", 7, 2500)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	coll := conn.MongoDriverClient().Database("app").Collection("users")
+	count, err := coll.CountDocuments(context.Background(), bson.D{})
+	is.NoError(err)
+	is.EqualValues(2500, count)
+	var found generatedUser
+	is.NoError(coll.FindOne(context.Background(), bson.D{{Key: "_id", Value: users[1234].ID}}).Decode(&found))
+	is.Equal(users[1234], found, "Generated documents should round trip")
+}
+
+// ordersJSONSchema is the $jsonSchema used to test generating documents from validators
+var ordersJSONSchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"_id", "status", "total", "sku", "customer", "items"}},
+	{Key: "additionalProperties", Value: false},
+	{Key: "properties", Value: bson.D{
+		{Key: "_id", Value: bson.D{{Key: "bsonType", Value: "objectId"}}},
+		{Key: "status", Value: bson.D{{Key: "enum", Value: bson.A{"new", "paid", "shipped"}}}},
+		{Key: "total", Value: bson.D{{Key: "bsonType", Value: "double"}, {Key: "minimum", Value: 1}, {Key: "maximum", Value: 50}}},
+		{Key: "quantity", Value: bson.D{{Key: "bsonType", Value: "int"}, {Key: "minimum", Value: 1}, {Key: "exclusiveMaximum", Value: true}, {Key: "maximum", Value: 10}}},
+		{Key: "sku", Value: bson.D{{Key: "bsonType", Value: "string"}, {Key: "pattern", Value: `^[A-Z]{3}-\d{4}$`}}},
+		{Key: "note", Value: bson.D{{Key: "bsonType", Value: bson.A{"string", "null"}}, {Key: "minLength", Value: 12}, {Key: "maxLength", Value: 20}}},
+		{Key: "customer", Value: bson.D{
+			{Key: "bsonType", Value: "object"},
+			{Key: "required", Value: bson.A{"email"}},
+			{Key: "properties", Value: bson.D{
+				{Key: "email", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+				{Key: "since", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+			}},
+		}},
+		{Key: "items", Value: bson.D{
+			{Key: "bsonType", Value: "array"},
+			{Key: "minItems", Value: 2},
+			{Key: "maxItems", Value: 4},
+			{Key: "uniqueItems", Value: true},
+			{Key: "items", Value: bson.D{{Key: "bsonType", Value: "string"}, {Key: "enum", Value: bson.A{"a", "b", "c", "d", "e"}}}},
+		}},
+	}},
+}
+
+func TestGenerateFromJSONSchema(t *testing.T) {
+	is := assert.New(t)
+	rawSchema, err := bson.Marshal(ordersJSONSchema)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	gc := &generateConfig{fields: map[string]FieldGenerator{}, violations: 300}
+	docs, err := generateFromJSONSchema(rawSchema, 50, 42, gc)
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	again, err := generateFromJSONSchema(rawSchema, 50, 42, gc)
+	is.NoError(err)
+	is.Equal(docs, again, "The same seed should generate the same documents")
+
+	is.Len(docs.Valid, 50)
+	for _, doc := range docs.Valid {
+		m := doc.Map()
+		is.IsType(primitive.ObjectID{}, m["_id"])
+		is.Contains([]interface{}{"new", "paid", "shipped"}, m["status"])
+		total, ok := m["total"].(float64)
+		is.True(ok && total >= 1 && total <= 50, "total %v should be in [1, 50]", m["total"])
+		if quantity, ok := m["quantity"]; ok {
+			n, isInt := quantity.(int32)
+			is.True(isInt && n >= 1 && n < 10, "quantity %v should be in [1, 10)", quantity)
+		}
+		is.Regexp(`^[A-Z]{3}-\d{4}$`, m["sku"])
+		if note, ok := m["note"].(string); ok {
+			is.True(len(note) >= 12 && len(note) <= 20, "note '%s' should have 12-20 characters", note)
+		}
+		customer := m["customer"].(bson.D).Map()
+		is.Contains(customer["email"], "@", "Email fields should get email addresses")
+		items := m["items"].(bson.A)
+		is.True(len(items) >= 2 && len(items) <= 4, "%d items", len(items))
+		seen := map[interface{}]bool{}
+		for _, item := range items {
+			is.False(seen[item], "Items should be unique")
+			seen[item] = true
+		}
+	}
+
+	is.Len(docs.Invalid, 300)
+	violations := map[string]bool{}
+	for _, invalid := range docs.Invalid {
+		violations[invalid.Violation] = true
+	}
+	for _, expected := range []string{
+		"status: not one of the enum values",
+		"total: below the minimum of 1",
+		"sku: does not match the pattern " + `^[A-Z]{3}-\d{4}$`,
+		"customer.email: missing the required field",
+		"items: fewer than the minItems of 2",
+	} {
+		is.Contains(violations, expected)
+	}
+	is.NotContains(violations, "_id: missing the required field", "The driver adds an _id to documents without one")
+	for _, invalid := range docs.Invalid {
+		if invalid.Violation == "customer.email: missing the required field" {
+			is.NotContains(invalid.Document.Map()["customer"].(bson.D).Map(), "email")
+		}
+	}
+
+	gc = &generateConfig{fields: map[string]FieldGenerator{}}
+	WithFieldSequence("sku", "ABC-%04d")(gc)
+	docs, err = generateFromJSONSchema(rawSchema, 3, 42, gc)
+	is.NoError(err)
+	is.Equal("ABC-0002", docs.Valid[1].Map()["sku"], "Overrides should apply to generated documents")
+
+	// Overrides can produce values which already break the length rules
+	gc = &generateConfig{fields: map[string]FieldGenerator{}, violations: 50}
+	WithFieldValues("note", "short")(gc)
+	WithFieldValues("items", bson.A{"a"})(gc)
+	_, err = generateFromJSONSchema(rawSchema, 3, 42, gc)
+	is.NoError(err, "Values shorter than minLength or minItems should not break the violations")
+	gc = &generateConfig{fields: map[string]FieldGenerator{}}
+	WithFieldValues("status")(gc)
+	_, err = generateFromJSONSchema(rawSchema, 1, 42, gc)
+	is.Error(err, "There should be values to cycle through")
+
+	pairSchema := bson.D{{Key: "bsonType", Value: "array"}, {Key: "minItems", Value: 2}, {Key: "items", Value: bson.A{bson.D{{Key: "bsonType", Value: "string"}}}}}
+	rawSchema, err = bson.Marshal(bson.D{
+		{Key: "bsonType", Value: "object"},
+		{Key: "required", Value: bson.A{"ratio", "pair", "tagged"}},
+		{Key: "properties", Value: bson.D{
+			{Key: "ratio", Value: bson.D{{Key: "bsonType", Value: "number"}, {Key: "minimum", Value: 0.1}, {Key: "maximum", Value: 0.9}}},
+			{Key: "pair", Value: append(pairSchema, bson.E{Key: "additionalItems", Value: bson.D{{Key: "bsonType", Value: "int"}}})},
+			{Key: "tagged", Value: pairSchema},
+		}},
+	})
+	is.NoError(err)
+	docs, err = generateFromJSONSchema(rawSchema, 10, 42, &generateConfig{fields: map[string]FieldGenerator{}, violations: 20})
+	if !is.NoError(err, "Fractional bounds on a number should generate doubles") {
+		t.FailNow()
+	}
+	for _, doc := range docs.Valid {
+		m := doc.Map()
+		ratio, ok := m["ratio"].(float64)
+		is.True(ok && ratio >= 0.1 && ratio <= 0.9, "ratio %v should be in [0.1, 0.9]", m["ratio"])
+		pair := m["pair"].(bson.A)
+		if is.Len(pair, 2, "Tuples should be padded up to minItems") {
+			is.IsType("", pair[0])
+			is.IsType(int32(0), pair[1], "Padding should follow additionalItems")
+		}
+		is.Len(m["tagged"], 2)
+	}
+	rawSchema, err = bson.Marshal(bson.D{
+		{Key: "bsonType", Value: "object"},
+		{Key: "required", Value: bson.A{"pair"}},
+		{Key: "properties", Value: bson.D{{Key: "pair", Value: append(pairSchema, bson.E{Key: "additionalItems", Value: false})}}},
+	})
+	is.NoError(err)
+	_, err = generateFromJSONSchema(rawSchema, 1, 42, &generateConfig{fields: map[string]FieldGenerator{}})
+	is.Error(err, "minItems can't be met without additionalItems")
+}
+
+func TestGenerateFromValidator(t *testing.T) {
+	is := assert.New(t)
+	conn := NewTestConnectionT(t)
+	ctx := context.Background()
+	db := conn.MongoDriverClient().Database("shop")
+	err := db.CreateCollection(ctx, "orders", options.CreateCollection().
+		SetValidator(bson.D{{Key: "$jsonSchema", Value: ordersJSONSchema}}))
+	if !is.NoError(err) {
+		t.FailNow()
+	}
+	docs, err := conn.GenerateFromValidator("shop", "orders", 200, 42, WithViolations(25))
+	if !is.NoError(err, "The generated documents should pass the validator") {
+		t.FailNow()
+	}
+	count, err := db.Collection("orders").CountDocuments(ctx, bson.D{})
+	is.NoError(err)
+	is.EqualValues(200, count)
+	for _, invalid := range docs.Invalid {
+		_, err = db.Collection("orders").InsertOne(ctx, invalid.Document)
+		is.Error(err, invalid.Violation)
+	}
+
+	is.NoError(db.CreateCollection(ctx, "unvalidated"))
+	_, err = conn.GenerateFromValidator("shop", "unvalidated", 1, 42)
+	is.Error(err, "Collections without a $jsonSchema can't be generated")
+}
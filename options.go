@@ -0,0 +1,45 @@
+package mongotest
+
+// Option configures a TestConnection as it is being created
+type Option func(tc *TestConnection)
+
+// WithLogger routes all logging for the TestConnection to the provided Logger.
+// If this option isn't provided, the logger set using SetDefaultLogger is used.
+func WithLogger(l Logger) Option {
+	return func(tc *TestConnection) {
+		if l == nil {
+			l = NopLogger()
+		}
+		tc.logger = l
+	}
+}
+
+// WithFailureLogLines sets how many mongod log lines NewTestConnectionT writes to the test log
+// when a test fails. Defaults to 50 - pass a negative number to disable.
+func WithFailureLogLines(n int) Option {
+	return func(tc *TestConnection) {
+		tc.failureLogLines = n
+	}
+}
+
+// WithMongoVersion sets the tag of the official mongo docker image to run (e.g. "6.0").
+// Defaults to "latest".
+func WithMongoVersion(version string) Option {
+	return func(tc *TestConnection) {
+		tc.mongoVersion = version
+	}
+}
+
+// withImage runs the provided docker image instead of the official mongo image
+func withImage(imageRef string) Option {
+	return func(tc *TestConnection) {
+		tc.imageOverride = imageRef
+	}
+}
+
+// withDBPath starts mongod with a custom --dbpath
+func withDBPath(dbPath string) Option {
+	return func(tc *TestConnection) {
+		tc.dbPath = dbPath
+	}
+}
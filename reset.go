@@ -0,0 +1,182 @@
+package mongotest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ResetStrategy determines how ResetData clears the data written by a test
+type ResetStrategy struct {
+	name     string
+	snapshot *Snapshot
+}
+
+// String returns the name of the strategy
+func (rs ResetStrategy) String() string {
+	return rs.name
+}
+
+// ResetDrop drops every database except admin, config and local. This is the most thorough
+// reset, but indexes, validators and collection options are dropped too.
+func ResetDrop() ResetStrategy {
+	return ResetStrategy{name: "drop"}
+}
+
+// ResetTruncate deletes every document, keeping collections along with their indexes, validators
+// and options. Views are left alone. Capped and time series collections can't always be
+// truncated, so they're dropped and recreated with the same options and indexes instead.
+// This is usually the cheapest reset when tests share a schema.
+func ResetTruncate() ResetStrategy {
+	return ResetStrategy{name: "truncate"}
+}
+
+// ResetToSnapshot drops every database except admin, config and local, then restores snapshot
+// (see Dump). Use this to return a shared container to a known set of seed data.
+func ResetToSnapshot(snapshot *Snapshot) ResetStrategy {
+	return ResetStrategy{name: "snapshot", snapshot: snapshot}
+}
+
+// ResetReport describes the work done by ResetData and how long it took
+type ResetReport struct {
+	// Strategy is the name of the strategy used
+	Strategy string
+	// Databases are the user databases which were reset
+	Databases []string
+	// Collections is the number of collections truncated (ResetTruncate only)
+	Collections int
+	// Documents is the number of documents deleted (ResetTruncate only)
+	Documents int64
+	// Timings is how long each step took, keyed by database name (or "restore" when restoring
+	// a snapshot)
+	Timings map[string]time.Duration
+	// Duration is how long the whole reset took
+	Duration time.Duration
+}
+
+// DropAllDatabases drops every database except admin, config and local
+func (tc *TestConnection) DropAllDatabases() error {
+	_, err := tc.ResetData(ResetDrop())
+	return err
+}
+
+// ResetData clears the data written by previous tests using strategy, so a long-lived shared
+// container can be reused cheaply:
+//
+//	report, err := conn.ResetData(mongotest.ResetTruncate())
+//	...
+//	t.Logf("Reset %d collections in %s", report.Collections, report.Duration)
+func (tc *TestConnection) ResetData(strategy ResetStrategy) (*ResetReport, error) {
+	ctx := context.Background()
+	start := time.Now()
+	report := &ResetReport{Strategy: strategy.name, Timings: map[string]time.Duration{}}
+	if len(strategy.name) == 0 {
+		return report, tc.newError(PhaseReset, fmt.Errorf("no reset strategy was provided"))
+	}
+	if strategy.name == "snapshot" && strategy.snapshot == nil {
+		return report, tc.newError(PhaseReset, fmt.Errorf("no snapshot was provided"))
+	}
+	client := tc.MongoDriverClient()
+	dbNames, err := client.ListDatabaseNames(ctx, bson.D{})
+	if err != nil {
+		return report, tc.newError(PhaseReset, fmt.Errorf("could not list databases: %w", err))
+	}
+	for _, dbName := range dbNames {
+		if internalDatabases[dbName] {
+			continue
+		}
+		dbStart := time.Now()
+		if strategy.name == "truncate" {
+			err = tc.truncateDatabase(ctx, client.Database(dbName), report)
+		} else {
+			err = client.Database(dbName).Drop(ctx)
+		}
+		if err != nil {
+			return report, tc.newError(PhaseReset, fmt.Errorf("could not reset '%s': %w", dbName, err))
+		}
+		report.Databases = append(report.Databases, dbName)
+		report.Timings[dbName] = time.Since(dbStart)
+	}
+	if strategy.snapshot != nil {
+		restoreStart := time.Now()
+		if err = tc.Restore(ctx, strategy.snapshot); err != nil {
+			return report, err
+		}
+		report.Timings["restore"] = time.Since(restoreStart)
+	}
+	report.Duration = time.Since(start)
+	tc.logger.Debug("Reset data", Fields{
+		"strategy":    report.Strategy,
+		"databases":   len(report.Databases),
+		"collections": report.Collections,
+		"documents":   report.Documents,
+		"duration":    report.Duration,
+	})
+	return report, nil
+}
+
+// truncateDatabase deletes every document in db, keeping its collections
+func (tc *TestConnection) truncateDatabase(ctx context.Context, db *mongo.Database, report *ResetReport) error {
+	cursor, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	var specs []collectionSpec
+	if err = cursor.All(ctx, &specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if strings.HasPrefix(spec.Name, "system.") || spec.Type == "view" {
+			continue
+		}
+		coll := db.Collection(spec.Name)
+		if capped, _ := spec.Options.Lookup("capped").BooleanOK(); capped || spec.Type == "timeseries" {
+			count, err := coll.EstimatedDocumentCount(ctx)
+			if err != nil {
+				return err
+			}
+			if err = recreateCollection(ctx, db, spec); err != nil {
+				return fmt.Errorf("could not recreate %s: %w", spec.Name, err)
+			}
+			report.Documents += count
+		} else {
+			res, err := coll.DeleteMany(ctx, bson.D{})
+			if err != nil {
+				return fmt.Errorf("could not truncate %s: %w", spec.Name, err)
+			}
+			report.Documents += res.DeletedCount
+		}
+		report.Collections++
+	}
+	return nil
+}
+
+// recreateCollection drops the collection described by spec and creates it again, empty, with
+// the same options and indexes
+func recreateCollection(ctx context.Context, db *mongo.Database, spec collectionSpec) error {
+	cursor, err := db.Collection(spec.Name).Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var indexes []bson.D
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return err
+	}
+	var collOpts bson.D
+	if len(spec.Options) != 0 {
+		if err = bson.Unmarshal(spec.Options, &collOpts); err != nil {
+			return err
+		}
+	}
+	if err = db.Collection(spec.Name).Drop(ctx); err != nil {
+		return err
+	}
+	if err = createCollection(ctx, db, spec.Name, collOpts); err != nil {
+		return err
+	}
+	return createIndexes(ctx, db, spec.Name, indexes)
+}
@@ -0,0 +1,622 @@
+package mongotest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/tophergopher/mongotest/internal/bsonvalue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
+)
+
+// cappedSizeGranularity is the multiple the server rounds capped collection sizes up to
+const cappedSizeGranularity = 256
+
+// Schema declares the collections, indexes and validators a test expects to exist, so tests
+// run against the same schema as production. Apply it with ApplySchema, or compare it with a
+// live database using CheckSchema. Schemas are usually loaded from a spec file (see ParseSchema).
+type Schema struct {
+	Databases []DatabaseSchema
+}
+
+// DatabaseSchema declares the collections in a database
+type DatabaseSchema struct {
+	Name        string
+	Collections []CollectionSchema
+}
+
+// CollectionSchema declares a collection along with its options and indexes
+type CollectionSchema struct {
+	Name string
+	// Validator is the collection's validator (e.g. {$jsonSchema: {...}})
+	Validator bson.D
+	// ValidationLevel is "off", "strict" or "moderate"
+	ValidationLevel string
+	// ValidationAction is "error" or "warn"
+	ValidationAction string
+	// Collation is the collection's default collation (e.g. {locale: en, strength: 2})
+	Collation bson.D
+	// Capped creates a capped collection of Size bytes, holding at most Max documents (if set)
+	Capped bool
+	Size   int64
+	Max    int64
+	// Timeseries creates a time series collection
+	Timeseries *TimeseriesSchema
+	// ExpireAfterSeconds removes time series documents once they're this old
+	ExpireAfterSeconds *int64
+	Indexes            []IndexSchema
+}
+
+// TimeseriesSchema declares the options of a time series collection
+type TimeseriesSchema struct {
+	TimeField   string `yaml:"timeField"`
+	MetaField   string `yaml:"metaField"`
+	Granularity string `yaml:"granularity"`
+}
+
+// IndexSchema declares an index
+type IndexSchema struct {
+	// Name defaults to the name generated by the server (e.g. "email_1")
+	Name string
+	// Keys are the indexed fields, in order (e.g. {lastName: 1, firstName: 1})
+	Keys   bson.D
+	Unique bool
+	Sparse bool
+	// ExpireAfterSeconds makes this a TTL index
+	ExpireAfterSeconds *int64
+	// PartialFilterExpression makes this a partial index
+	PartialFilterExpression bson.D
+	Collation               bson.D
+}
+
+// name returns the name of the index
+func (is IndexSchema) name() string {
+	if len(is.Name) != 0 {
+		return is.Name
+	}
+	return indexName(is.Keys)
+}
+
+// spec returns the index specification passed to createIndexes
+func (is IndexSchema) spec() bson.D {
+	spec := bson.D{{Key: "key", Value: is.Keys}, {Key: "name", Value: is.name()}}
+	if is.Unique {
+		spec = append(spec, bson.E{Key: "unique", Value: true})
+	}
+	if is.Sparse {
+		spec = append(spec, bson.E{Key: "sparse", Value: true})
+	}
+	if is.ExpireAfterSeconds != nil {
+		spec = append(spec, bson.E{Key: "expireAfterSeconds", Value: *is.ExpireAfterSeconds})
+	}
+	if len(is.PartialFilterExpression) != 0 {
+		spec = append(spec, bson.E{Key: "partialFilterExpression", Value: is.PartialFilterExpression})
+	}
+	if len(is.Collation) != 0 {
+		spec = append(spec, bson.E{Key: "collation", Value: is.Collation})
+	}
+	return spec
+}
+
+// createOptions returns the options passed to the create command
+func (cs CollectionSchema) createOptions() bson.D {
+	collOpts := cs.modifiableOptions()
+	if len(cs.Collation) != 0 {
+		collOpts = append(collOpts, bson.E{Key: "collation", Value: cs.Collation})
+	}
+	if cs.Capped {
+		collOpts = append(collOpts, bson.E{Key: "capped", Value: true}, bson.E{Key: "size", Value: cs.Size})
+		if cs.Max != 0 {
+			collOpts = append(collOpts, bson.E{Key: "max", Value: cs.Max})
+		}
+	}
+	if cs.Timeseries != nil {
+		timeseries := bson.D{{Key: "timeField", Value: cs.Timeseries.TimeField}}
+		if len(cs.Timeseries.MetaField) != 0 {
+			timeseries = append(timeseries, bson.E{Key: "metaField", Value: cs.Timeseries.MetaField})
+		}
+		if len(cs.Timeseries.Granularity) != 0 {
+			timeseries = append(timeseries, bson.E{Key: "granularity", Value: cs.Timeseries.Granularity})
+		}
+		collOpts = append(collOpts, bson.E{Key: "timeseries", Value: timeseries})
+	}
+	return collOpts
+}
+
+// modifiableOptions returns the options which can be changed using collMod
+func (cs CollectionSchema) modifiableOptions() bson.D {
+	collOpts := bson.D{}
+	if len(cs.Validator) != 0 {
+		collOpts = append(collOpts, bson.E{Key: "validator", Value: cs.Validator})
+	}
+	if len(cs.ValidationLevel) != 0 {
+		collOpts = append(collOpts, bson.E{Key: "validationLevel", Value: cs.ValidationLevel})
+	}
+	if len(cs.ValidationAction) != 0 {
+		collOpts = append(collOpts, bson.E{Key: "validationAction", Value: cs.ValidationAction})
+	}
+	if cs.ExpireAfterSeconds != nil {
+		collOpts = append(collOpts, bson.E{Key: "expireAfterSeconds", Value: *cs.ExpireAfterSeconds})
+	}
+	return collOpts
+}
+
+// Validate checks that the schema is complete
+func (s *Schema) Validate() error {
+	for _, db := range s.Databases {
+		if len(db.Name) == 0 {
+			return fmt.Errorf("a database name is required")
+		}
+		for _, coll := range db.Collections {
+			ns := db.Name + "." + coll.Name
+			if len(coll.Name) == 0 {
+				return fmt.Errorf("database '%s': a collection name is required", db.Name)
+			}
+			if coll.Capped && coll.Size <= 0 {
+				return fmt.Errorf("%s: capped collections require a size", ns)
+			}
+			if coll.Capped && coll.Timeseries != nil {
+				return fmt.Errorf("%s: time series collections can't be capped", ns)
+			}
+			if coll.Timeseries != nil && len(coll.Timeseries.TimeField) == 0 {
+				return fmt.Errorf("%s: time series collections require a timeField", ns)
+			}
+			if coll.ExpireAfterSeconds != nil && coll.Timeseries == nil {
+				return fmt.Errorf("%s: expireAfterSeconds only applies to time series collections - use a TTL index instead", ns)
+			}
+			for i, index := range coll.Indexes {
+				if len(index.Keys) == 0 {
+					return fmt.Errorf("%s: index %d has no keys", ns, i+1)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// schemaFile is the YAML layout read by ParseSchema
+type schemaFile struct {
+	Databases map[string]map[string]struct {
+		Validator          yaml.Node         `yaml:"validator"`
+		ValidationLevel    string            `yaml:"validationLevel"`
+		ValidationAction   string            `yaml:"validationAction"`
+		Collation          yaml.Node         `yaml:"collation"`
+		Capped             bool              `yaml:"capped"`
+		Size               int64             `yaml:"size"`
+		Max                int64             `yaml:"max"`
+		Timeseries         *TimeseriesSchema `yaml:"timeseries"`
+		ExpireAfterSeconds *int64            `yaml:"expireAfterSeconds"`
+		Indexes            []struct {
+			Name                    string    `yaml:"name"`
+			Keys                    yaml.Node `yaml:"keys"`
+			Unique                  bool      `yaml:"unique"`
+			Sparse                  bool      `yaml:"sparse"`
+			ExpireAfterSeconds      *int64    `yaml:"expireAfterSeconds"`
+			PartialFilterExpression yaml.Node `yaml:"partialFilterExpression"`
+			Collation               yaml.Node `yaml:"collation"`
+		} `yaml:"indexes"`
+	} `yaml:"databases"`
+}
+
+// LoadSchemaFile reads a Schema from a YAML or JSON spec file (see ParseSchema)
+func LoadSchemaFile(fpath string) (*Schema, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse schema spec in '%s': %w", fpath, err)
+	}
+	return schema, nil
+}
+
+// ParseSchema parses a Schema from YAML (or JSON), keyed by database then collection name:
+//
+//	databases:
+//	  shop:
+//	    orders:
+//	      validator:
+//	        $jsonSchema:
+//	          required: [status]
+//	      validationLevel: strict
+//	      collation: {locale: en, strength: 2}
+//	      indexes:
+//	        - keys: {email: 1}
+//	          unique: true
+//	        - keys: {createdAt: 1}
+//	          expireAfterSeconds: 3600
+//	        - keys: {status: 1, placedAt: -1}
+//	          partialFilterExpression: {status: {$exists: true}}
+//	    events:
+//	      capped: true
+//	      size: 1048576
+//	    metrics:
+//	      timeseries: {timeField: ts, metaField: sensor, granularity: minutes}
+//	      expireAfterSeconds: 86400
+//
+// Databases and collections are applied in name order. Documents can use the same !oid,
+// !date and !decimal tags as YAML fixtures.
+func ParseSchema(data []byte) (*Schema, error) {
+	var file schemaFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	schema := &Schema{}
+	dbNames := make([]string, 0, len(file.Databases))
+	for dbName := range file.Databases {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+	for _, dbName := range dbNames {
+		db := DatabaseSchema{Name: dbName}
+		colls := file.Databases[dbName]
+		collNames := make([]string, 0, len(colls))
+		for collName := range colls {
+			collNames = append(collNames, collName)
+		}
+		sort.Strings(collNames)
+		for _, collName := range collNames {
+			fileColl := colls[collName]
+			ns := dbName + "." + collName
+			coll := CollectionSchema{
+				Name:               collName,
+				ValidationLevel:    fileColl.ValidationLevel,
+				ValidationAction:   fileColl.ValidationAction,
+				Capped:             fileColl.Capped,
+				Size:               fileColl.Size,
+				Max:                fileColl.Max,
+				Timeseries:         fileColl.Timeseries,
+				ExpireAfterSeconds: fileColl.ExpireAfterSeconds,
+			}
+			var err error
+			if coll.Validator, err = yamlNodeToDocument(&fileColl.Validator); err != nil {
+				return nil, fmt.Errorf("%s validator: %w", ns, err)
+			}
+			if coll.Collation, err = yamlNodeToDocument(&fileColl.Collation); err != nil {
+				return nil, fmt.Errorf("%s collation: %w", ns, err)
+			}
+			for i, fileIndex := range fileColl.Indexes {
+				index := IndexSchema{
+					Name:               fileIndex.Name,
+					Unique:             fileIndex.Unique,
+					Sparse:             fileIndex.Sparse,
+					ExpireAfterSeconds: fileIndex.ExpireAfterSeconds,
+				}
+				if index.Keys, err = yamlNodeToDocument(&fileIndex.Keys); err != nil {
+					return nil, fmt.Errorf("%s index %d keys: %w", ns, i+1, err)
+				}
+				if index.PartialFilterExpression, err = yamlNodeToDocument(&fileIndex.PartialFilterExpression); err != nil {
+					return nil, fmt.Errorf("%s index %d partialFilterExpression: %w", ns, i+1, err)
+				}
+				if index.Collation, err = yamlNodeToDocument(&fileIndex.Collation); err != nil {
+					return nil, fmt.Errorf("%s index %d collation: %w", ns, i+1, err)
+				}
+				coll.Indexes = append(coll.Indexes, index)
+			}
+			db.Collections = append(db.Collections, coll)
+		}
+		schema.Databases = append(schema.Databases, db)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// yamlNodeToDocument converts an optional YAML mapping into a document
+func yamlNodeToDocument(node *yaml.Node) (bson.D, error) {
+	if node.IsZero() {
+		return nil, nil
+	}
+	value, err := yamlNodeToBSON(node)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping on line %d", node.Line)
+	}
+	return doc, nil
+}
+
+// driftKind categorizes a SchemaDrift, which determines how ApplySchema resolves it
+type driftKind int
+
+const (
+	driftMissingCollection driftKind = iota
+	// driftModifiable can be fixed in place using collMod
+	driftModifiable
+	// driftImmutableOption can only be fixed by dropping the collection
+	driftImmutableOption
+	driftMissingIndex
+	driftChangedIndex
+	driftUnexpectedIndex
+)
+
+// SchemaDrift is a difference between a Schema and a live database
+type SchemaDrift struct {
+	Database   string
+	Collection string
+	// Index is the name of the index which differs, if any
+	Index string
+	// Problem describes the difference
+	Problem string
+	kind    driftKind
+	index   IndexSchema
+}
+
+func (sd SchemaDrift) String() string {
+	if len(sd.Index) != 0 {
+		return fmt.Sprintf("%s.%s index %s: %s", sd.Database, sd.Collection, sd.Index, sd.Problem)
+	}
+	return fmt.Sprintf("%s.%s: %s", sd.Database, sd.Collection, sd.Problem)
+}
+
+// CheckSchema compares schema with the live databases, returning every difference. Indexes
+// which exist but aren't in the schema are reported too, while collections which aren't in the
+// schema are ignored. An empty result means the databases match the schema.
+func (tc *TestConnection) CheckSchema(schema *Schema) ([]SchemaDrift, error) {
+	if err := schema.Validate(); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	var drifts []SchemaDrift
+	for _, dbSchema := range schema.Databases {
+		db := tc.MongoDriverClient().Database(dbSchema.Name)
+		live, err := liveCollections(ctx, db)
+		if err != nil {
+			return nil, fmt.Errorf("could not list collections in '%s': %w", dbSchema.Name, err)
+		}
+		for _, collSchema := range dbSchema.Collections {
+			collDrifts, err := checkCollectionSchema(ctx, db, collSchema, live[collSchema.Name])
+			if err != nil {
+				return nil, err
+			}
+			drifts = append(drifts, collDrifts...)
+		}
+	}
+	return drifts, nil
+}
+
+// ApplySchema creates the collections and indexes in schema, and updates any which have drifted
+// (see CheckSchema). Validators and changed indexes are updated in place. Options which can't be
+// changed on an existing collection (capped, time series and collation) are reported as an
+// error - drop the collection to recreate it. Indexes which aren't in the schema are left alone.
+//
+//	schema, err := mongotest.LoadSchemaFile("testdata/schema.yaml")
+//	...
+//	err = conn.ApplySchema(schema)
+func (tc *TestConnection) ApplySchema(schema *Schema) error {
+	drifts, err := tc.CheckSchema(schema)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client := tc.MongoDriverClient()
+	var unfixable []string
+	for _, dbSchema := range schema.Databases {
+		db := client.Database(dbSchema.Name)
+		for _, collSchema := range dbSchema.Collections {
+			modified := false
+			for _, drift := range drifts {
+				if drift.Database != dbSchema.Name || drift.Collection != collSchema.Name {
+					continue
+				}
+				switch drift.kind {
+				case driftMissingCollection:
+					err = createCollection(ctx, db, collSchema.Name, collSchema.createOptions())
+				case driftModifiable:
+					if !modified {
+						cmd := append(bson.D{{Key: "collMod", Value: collSchema.Name}}, collSchema.modifiableOptions()...)
+						err = db.RunCommand(ctx, cmd).Err()
+						modified = true
+					}
+				case driftImmutableOption:
+					unfixable = append(unfixable, drift.String())
+				case driftChangedIndex:
+					if _, err = db.Collection(collSchema.Name).Indexes().DropOne(ctx, drift.Index); err == nil {
+						err = createIndexes(ctx, db, collSchema.Name, []bson.D{drift.index.spec()})
+					}
+				case driftMissingIndex:
+					err = createIndexes(ctx, db, collSchema.Name, []bson.D{drift.index.spec()})
+				}
+				if err != nil {
+					return fmt.Errorf("could not apply schema (%s): %w", drift, err)
+				}
+			}
+		}
+	}
+	if len(unfixable) != 0 {
+		return fmt.Errorf("the schema can't be applied without dropping collections:\n  %s", strings.Join(unfixable, "\n  "))
+	}
+	tc.logger.Debug("Applied schema", Fields{"changes": len(drifts)})
+	return nil
+}
+
+// liveCollections returns the options of every collection in db, keyed by name
+func liveCollections(ctx context.Context, db *mongo.Database) (map[string]*collectionSpec, error) {
+	cursor, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var specs []collectionSpec
+	if err = cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	live := make(map[string]*collectionSpec, len(specs))
+	for i := range specs {
+		live[specs[i].Name] = &specs[i]
+	}
+	return live, nil
+}
+
+// checkCollectionSchema compares a single collection with its schema. live is nil when the
+// collection doesn't exist.
+func checkCollectionSchema(ctx context.Context, db *mongo.Database, cs CollectionSchema, live *collectionSpec) ([]SchemaDrift, error) {
+	newDrift := func(kind driftKind, problem string, args ...interface{}) SchemaDrift {
+		return SchemaDrift{Database: db.Name(), Collection: cs.Name, Problem: fmt.Sprintf(problem, args...), kind: kind}
+	}
+	if live == nil {
+		drifts := []SchemaDrift{newDrift(driftMissingCollection, "collection does not exist")}
+		for _, index := range cs.Indexes {
+			drift := newDrift(driftMissingIndex, "index does not exist")
+			drift.Index, drift.index = index.name(), index
+			drifts = append(drifts, drift)
+		}
+		return drifts, nil
+	}
+
+	var drifts []SchemaDrift
+	liveOpts := live.Options
+	checkOption := func(kind driftKind, key string, want interface{}, subset bool) {
+		got := liveOpts.Lookup(key)
+		if !schemaValuesMatch(want, got, subset) {
+			drifts = append(drifts, newDrift(kind, "expected %s %s, found %s", key, schemaValueString(want), schemaRawString(got)))
+		}
+	}
+	if len(cs.Validator) != 0 {
+		checkOption(driftModifiable, "validator", cs.Validator, false)
+	}
+	if len(cs.ValidationLevel) != 0 {
+		checkOption(driftModifiable, "validationLevel", cs.ValidationLevel, false)
+	}
+	if len(cs.ValidationAction) != 0 {
+		checkOption(driftModifiable, "validationAction", cs.ValidationAction, false)
+	}
+	if len(cs.Collation) != 0 {
+		// The server fills in the collation defaults, so only the declared fields are compared
+		checkOption(driftImmutableOption, "collation", cs.Collation, true)
+	}
+	isCapped, _ := liveOpts.Lookup("capped").BooleanOK()
+	if cs.Capped != isCapped {
+		drifts = append(drifts, newDrift(driftImmutableOption, "expected capped %t, found %t", cs.Capped, isCapped))
+	} else if cs.Capped {
+		// The server rounds the size up
+		liveSize, _ := bsonvalue.Number(liveOpts.Lookup("size"))
+		size := int64(liveSize)
+		if size < cs.Size || size >= cs.Size+cappedSizeGranularity {
+			drifts = append(drifts, newDrift(driftImmutableOption, "expected size %d, found %d", cs.Size, size))
+		}
+		if cs.Max != 0 {
+			checkOption(driftImmutableOption, "max", cs.Max, false)
+		}
+	}
+	if cs.Timeseries != nil {
+		if live.Type != "timeseries" {
+			drifts = append(drifts, newDrift(driftImmutableOption, "expected a time series collection, found a %s", live.Type))
+		} else {
+			checkOption(driftImmutableOption, "timeseries", CollectionSchema{Timeseries: cs.Timeseries}.createOptions().Map()["timeseries"], true)
+		}
+	}
+	if cs.ExpireAfterSeconds != nil {
+		checkOption(driftModifiable, "expireAfterSeconds", *cs.ExpireAfterSeconds, false)
+	}
+
+	indexDrifts, err := checkIndexSchemas(ctx, db, cs, live)
+	if err != nil {
+		return nil, err
+	}
+	for _, drift := range indexDrifts {
+		drift.Database, drift.Collection = db.Name(), cs.Name
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
+
+// checkIndexSchemas compares the indexes on a collection with its schema. Indexes the server
+// creates by itself are never reported as unexpected.
+func checkIndexSchemas(ctx context.Context, db *mongo.Database, cs CollectionSchema, spec *collectionSpec) ([]SchemaDrift, error) {
+	cursor, err := db.Collection(cs.Name).Indexes().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list indexes on %s.%s: %w", db.Name(), cs.Name, err)
+	}
+	var live []bson.Raw
+	if err = cursor.All(ctx, &live); err != nil {
+		return nil, fmt.Errorf("could not list indexes on %s.%s: %w", db.Name(), cs.Name, err)
+	}
+	var drifts []SchemaDrift
+	matched := map[string]bool{"_id_": true}
+	if spec.Type == "timeseries" && cs.Timeseries != nil && len(cs.Timeseries.MetaField) != 0 {
+		// MongoDB 6.3+ indexes the metaField and timeField of new time series collections
+		matched[cs.Timeseries.MetaField+"_1_"+cs.Timeseries.TimeField+"_1"] = true
+	}
+	for _, index := range cs.Indexes {
+		name := index.name()
+		var found bson.Raw
+		for _, liveIndex := range live {
+			liveName, _ := liveIndex.Lookup("name").StringValueOK()
+			if liveName == name || (len(index.Name) == 0 && schemaValuesMatch(index.Keys, liveIndex.Lookup("key"), false)) {
+				found = liveIndex
+				name = liveName
+				break
+			}
+		}
+		if found == nil {
+			drifts = append(drifts, SchemaDrift{Index: name, Problem: "index does not exist", kind: driftMissingIndex, index: index})
+			continue
+		}
+		matched[name] = true
+		// Recreate under the live name, so it can be dropped and replaced
+		index.Name = name
+		var problems []string
+		want := index.spec()
+		for _, key := range []string{"key", "unique", "sparse", "expireAfterSeconds", "partialFilterExpression", "collation"} {
+			wantValue, declared := want.Map()[key]
+			got := found.Lookup(key)
+			if !declared {
+				if set, _ := got.BooleanOK(); (key == "unique" || key == "sparse") && set {
+					problems = append(problems, fmt.Sprintf("expected %s false, found true", key))
+				} else if key != "unique" && key != "sparse" && key != "collation" && got.Type != 0 {
+					problems = append(problems, fmt.Sprintf("unexpected %s %s", key, schemaRawString(got)))
+				}
+				continue
+			}
+			if !schemaValuesMatch(wantValue, got, key == "collation") {
+				problems = append(problems, fmt.Sprintf("expected %s %s, found %s", key, schemaValueString(wantValue), schemaRawString(got)))
+			}
+		}
+		if len(problems) != 0 {
+			drifts = append(drifts, SchemaDrift{Index: name, Problem: strings.Join(problems, "; "), kind: driftChangedIndex, index: index})
+		}
+	}
+	for _, liveIndex := range live {
+		liveName, _ := liveIndex.Lookup("name").StringValueOK()
+		if !matched[liveName] {
+			drifts = append(drifts, SchemaDrift{Index: liveName, Problem: "index is not in the schema", kind: driftUnexpectedIndex})
+		}
+	}
+	return drifts, nil
+}
+
+// schemaValuesMatch compares a declared value with a live one. Numbers are compared by value,
+// since the server may store them with a different type. When subset is set, documents only
+// need to contain the declared fields.
+func schemaValuesMatch(want interface{}, got bson.RawValue, subset bool) bool {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: want}})
+	if err != nil {
+		return false
+	}
+	return bsonvalue.Equal(bson.Raw(raw).Lookup("v"), got, subset)
+}
+
+// schemaValueString writes a declared value as Relaxed Extended JSON for drift reports
+func schemaValueString(value interface{}) string {
+	out, err := bsonvalue.ExtJSON(value, false)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return out
+}
+
+// schemaRawString writes a live value for drift reports
+func schemaRawString(value bson.RawValue) string {
+	if value.Type == 0 {
+		return "nothing"
+	}
+	return schemaValueString(value)
+}
@@ -1,7 +1,6 @@
 package mongotest
 
 import (
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -26,13 +25,15 @@ func spawnSignalListener() {
 	ReapRunningContainers()
 }
 
+// ReapRunningContainers kills every container spawned by this process which is still running.
+// Logging goes to the logger set using SetDefaultLogger.
 func ReapRunningContainers() {
 	cachedConnections := getAllCachedConnections()
-	for _, testConn := range cachedConnections {
+	for containerID, testConn := range cachedConnections {
 		if testConn == nil {
 			continue
 		}
-		fmt.Println("Killing container from ReapRunningContainers")
+		defaultLogger().Info("Killing container from ReapRunningContainers", Fields{"containerID": containerID})
 		_ = testConn.KillMongoContainer()
 	}
 }
@@ -0,0 +1,251 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/progress"
+	"github.com/mongodb/mongo-tools/mongodump"
+	"github.com/mongodb/mongo-tools/mongorestore"
+)
+
+// gzipMagic are the first bytes of any gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// DumpOptions configures what Dump captures
+type DumpOptions struct {
+	// Database limits the dump to a single database. By default, every database is dumped.
+	Database string
+	// Collection limits the dump to a single collection. Requires Database to be set.
+	Collection string
+	// Gzip compresses the snapshot
+	Gzip bool
+	// Transform redacts or rewrites the documents in the snapshot. Requires Database to be set.
+	// The documents are transformed into a temporary database which is dumped and then dropped;
+	// Restore (or mongorestore with --nsFrom='mongotest_transformed_$token$_$db$.$coll$'
+	// --nsTo='$db$.$coll$') maps it back to Database. Unique indexes on fields which are masked,
+	// faked or dropped are restored without the unique option, as the values may collide.
+	Transform *Transform
+}
+
+// transformedDBPrefix names the temporary databases transformed snapshots are dumped from. Each
+// dump adds its own token (see tempDBPrefix), so concurrent dumps of a database don't collide.
+const transformedDBPrefix = "mongotest_transformed_"
+
+// transformedNamespaces matches the namespaces of transformed snapshots in mongorestore --nsFrom
+const transformedNamespaces = transformedDBPrefix + "$token$_$db$.$coll$"
+
+// tempDBPrefix returns prefix followed by a random token and an underscore, naming a temporary
+// database which is private to the caller. The token never contains an underscore, so the
+// original database name can be recovered from everything after it.
+func tempDBPrefix(prefix string) (string, error) {
+	token := make([]byte, 6)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(token) + "_", nil
+}
+
+// Snapshot is a point-in-time copy of one or more databases, taken by Dump and applied by Restore.
+// It is a mongodump archive, so BSON types, indexes and collection options are all preserved.
+// Snapshots are held in memory, but can be written to and read from disk.
+type Snapshot struct {
+	archive []byte
+	gzip    bool
+}
+
+// Bytes returns the raw mongodump archive
+func (s *Snapshot) Bytes() []byte {
+	return s.archive
+}
+
+// Gzip reports whether the archive is gzip compressed
+func (s *Snapshot) Gzip() bool {
+	return s.gzip
+}
+
+// WriteTo writes the raw mongodump archive to w. The output can be used with
+// mongorestore --archive (and --gzip if the snapshot is compressed).
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(s.archive)
+	return int64(n), err
+}
+
+// SaveToFile writes the snapshot to the file found at fpath, creating or truncating it
+func (s *Snapshot) SaveToFile(fpath string) error {
+	return ioutil.WriteFile(fpath, s.archive, 0644)
+}
+
+// ReadSnapshot reads a snapshot previously written using WriteTo (or by mongodump --archive).
+// Gzip compression is detected automatically.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	archive, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot: %w", err)
+	}
+	return &Snapshot{
+		archive: archive,
+		gzip:    bytes.HasPrefix(archive, gzipMagic),
+	}, nil
+}
+
+// LoadSnapshotFile reads a snapshot previously saved using SaveToFile
+func LoadSnapshotFile(fpath string) (*Snapshot, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(f)
+}
+
+// Dump takes a snapshot of the databases in the container using mongodump in archive mode.
+// The dump tools can't be interrupted, so ctx is only checked before the dump starts.
+func (tc *TestConnection) Dump(ctx context.Context, opts DumpOptions) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	archiveFile, err := tempArchiveFile("mongodump-*.archive")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archiveFile)
+
+	dumpDB := opts.Database
+	if opts.Transform != nil {
+		if len(opts.Database) == 0 {
+			return nil, tc.newError(PhaseDump, errors.New("a database is required to transform a snapshot"))
+		}
+		if err = opts.Transform.Validate(); err != nil {
+			return nil, tc.newError(PhaseDump, err)
+		}
+		prefix, err := tempDBPrefix(transformedDBPrefix)
+		if err != nil {
+			return nil, tc.newError(PhaseDump, err)
+		}
+		dumpDB = prefix + opts.Database
+		tmpDB := tc.MongoDriverClient().Database(dumpDB)
+		defer tmpDB.Drop(context.Background())
+		if err = tc.copyTransformed(ctx, opts.Database, dumpDB, opts.Collection, opts.Transform); err != nil {
+			return nil, tc.newError(PhaseDump, fmt.Errorf("could not transform the snapshot: %w", err))
+		}
+	}
+
+	rawArgs := []string{"--archive=" + archiveFile}
+	if len(dumpDB) != 0 {
+		rawArgs = append(rawArgs, "-d", dumpDB)
+	}
+	if len(opts.Collection) != 0 {
+		rawArgs = append(rawArgs, "-c", opts.Collection)
+	}
+	if opts.Gzip {
+		rawArgs = append(rawArgs, "--gzip")
+	}
+	rawArgs = append(rawArgs, tc.mongoURI)
+	dumpOpts, err := mongodump.ParseOptions(rawArgs, "mongotest", "master")
+	if err != nil {
+		return nil, tc.newError(PhaseDump, fmt.Errorf("could not parse mongodump options: %w", err))
+	}
+	dump := mongodump.MongoDump{
+		ToolOptions:   dumpOpts.ToolOptions,
+		InputOptions:  dumpOpts.InputOptions,
+		OutputOptions: dumpOpts.OutputOptions,
+		// Progress bars aren't useful in tests - discard them
+		ProgressManager: progress.NewBarWriter(ioutil.Discard, time.Second, 24, false),
+	}
+	if err = dump.Init(); err != nil {
+		tc.logger.Error("Could not initialize mongodump", Fields{"err": err})
+		return nil, tc.newError(PhaseDump, err)
+	}
+	if err = dump.Dump(); err != nil {
+		tc.logger.Error("Could not dump the database", Fields{"err": err})
+		return nil, tc.newError(PhaseDump, err)
+	}
+	archive, err := ioutil.ReadFile(archiveFile)
+	if err != nil {
+		return nil, tc.newError(PhaseDump, fmt.Errorf("could not read mongodump archive: %w", err))
+	}
+	tc.logger.Debug("Dumped database snapshot", Fields{
+		"database":   opts.Database,
+		"collection": opts.Collection,
+		"bytes":      len(archive),
+	})
+	return &Snapshot{
+		archive: archive,
+		gzip:    opts.Gzip,
+	}, nil
+}
+
+// Restore applies the snapshot to the container using mongorestore. Every collection in the
+// snapshot is dropped before it is restored, so the restored collections match the snapshot
+// exactly. Collections which aren't in the snapshot are left alone.
+// The restore tools can't be interrupted, so ctx is only checked before the restore starts.
+func (tc *TestConnection) Restore(ctx context.Context, snapshot *Snapshot) error {
+	// Transformed snapshots are dumped from a temporary database - restore them to the original
+	return tc.restore(ctx, snapshot, transformedNamespaces, "$db$.$coll$")
+}
+
+// restore runs mongorestore against the snapshot, renaming namespaces matching the nsFrom
+// pattern to nsTo (see mongorestore --nsFrom and --nsTo)
+func (tc *TestConnection) restore(ctx context.Context, snapshot *Snapshot, nsFrom, nsTo string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return tc.newError(PhaseRestore, fmt.Errorf("no snapshot was provided"))
+	}
+	archiveFile, err := tempArchiveFile("mongorestore-*.archive")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archiveFile)
+	if err = snapshot.SaveToFile(archiveFile); err != nil {
+		return fmt.Errorf("could not write snapshot for mongorestore: %w", err)
+	}
+
+	rawArgs := []string{"--archive=" + archiveFile, "--drop", "--nsFrom=" + nsFrom, "--nsTo=" + nsTo}
+	if snapshot.gzip {
+		rawArgs = append(rawArgs, "--gzip")
+	}
+	rawArgs = append(rawArgs, tc.mongoURI)
+	restoreOpts, err := mongorestore.ParseOptions(rawArgs, "mongotest", "master")
+	if err != nil {
+		return tc.newError(PhaseRestore, fmt.Errorf("could not parse mongorestore options: %w", err))
+	}
+	restore, err := mongorestore.New(restoreOpts)
+	if err != nil {
+		tc.logger.Error("Could not initialize mongorestore", Fields{"err": err})
+		return tc.newError(PhaseRestore, err)
+	}
+	defer restore.Close()
+	result := restore.Restore()
+	if result.Err != nil {
+		tc.logger.Error("Could not restore the snapshot", Fields{"err": result.Err})
+		return tc.newError(PhaseRestore, result.Err)
+	}
+	tc.logger.Debug("Restored database snapshot", Fields{
+		"restored": result.Successes,
+		"failed":   result.Failures,
+	})
+	return nil
+}
+
+// tempArchiveFile reserves a temporary file for the dump tools to read from or write to
+func tempArchiveFile(pattern string) (string, error) {
+	f, err := ioutil.TempFile(os.TempDir(), pattern)
+	if err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
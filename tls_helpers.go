@@ -6,15 +6,28 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"net"
 	"time"
 )
 
-// GenerateCARoot generates a new CA root PEM file and private key
+// GenerateCARoot generates a new CA root PEM file and private key.
+// It panics if the certificate can't be generated.
+//
+// Deprecated: Use CreateCARoot, which returns an error instead of panicking.
+func GenerateCARoot() (rootCert *x509.Certificate, rootPEM []byte, privKey *rsa.PrivateKey) {
+	rootCert, rootPEM, privKey, err := CreateCARoot()
+	if err != nil {
+		panic(err)
+	}
+	return rootCert, rootPEM, privKey
+}
+
+// CreateCARoot generates a new CA root PEM file and private key
 // Huge thanks to Mattemagikern for publishing this code in a random gist
 // https://gist.github.com/Mattemagikern/328cdd650be33bc33105e26db88e487d
-func GenerateCARoot() (rootCert *x509.Certificate, rootPEM []byte, privKey *rsa.PrivateKey) {
+func CreateCARoot() (rootCert *x509.Certificate, rootPEM []byte, privKey *rsa.PrivateKey, err error) {
 	var rootTemplate = x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		Subject: pkix.Name{
@@ -33,25 +46,28 @@ func GenerateCARoot() (rootCert *x509.Certificate, rootPEM []byte, privKey *rsa.
 	}
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, fmt.Errorf("could not generate CA private key: %w", err)
+	}
+	rootCert, rootPEM, err = genCert(&rootTemplate, &rootTemplate, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	rootCert, rootPEM = genCert(&rootTemplate, &rootTemplate, &priv.PublicKey, priv)
-	return rootCert, rootPEM, priv
+	return rootCert, rootPEM, priv, nil
 }
 
-func genCert(template, parent *x509.Certificate, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (*x509.Certificate, []byte) {
+func genCert(template, parent *x509.Certificate, publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (*x509.Certificate, []byte, error) {
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, privateKey)
 	if err != nil {
-		panic("Failed to create certificate:" + err.Error())
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 
 	cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
-		panic("Failed to parse certificate:" + err.Error())
+		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
 	b := pem.Block{Type: "CERTIFICATE", Bytes: certBytes}
 	certPEM := pem.EncodeToMemory(&b)
 
-	return cert, certPEM
+	return cert, certPEM, nil
 }
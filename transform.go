@@ -0,0 +1,504 @@
+package mongotest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
+)
+
+// TransformAction is what a TransformRule does to the documents it applies to
+type TransformAction string
+
+const (
+	// TransformDrop removes the field
+	TransformDrop TransformAction = "drop"
+	// TransformHash replaces the value with a hex encoded SHA-256 of the value (and the salt).
+	// Equal values hash to the same string, so they can still be correlated.
+	TransformHash TransformAction = "hash"
+	// TransformMask replaces every character of a string value with '*', except the last
+	// KeepLast characters. Other values are replaced with "****".
+	TransformMask TransformAction = "mask"
+	// TransformFake replaces the value with a fake value of kind Fake (e.g. FakeEmail). The fake
+	// value is derived from the original value (and the salt), so equal values stay equal.
+	TransformFake TransformAction = "fake"
+	// TransformKeep keeps only the documents matching Filter
+	TransformKeep TransformAction = "keep"
+)
+
+// maskedValue replaces non-string values which are masked
+const maskedValue = "****"
+
+// TransformRule is a single step of a Transform
+type TransformRule struct {
+	// Collection limits the rule to a single collection. By default, the rule applies to every collection.
+	Collection string
+	// Action is what the rule does
+	Action TransformAction
+	// Field is the dotted path the rule applies to (e.g. "address.street"). Arrays are traversed,
+	// so the rule applies to every element unless an index is given (e.g. "phones.0").
+	// Required for every action except TransformKeep.
+	Field string
+	// Fake is the kind of fake value used by TransformFake (e.g. FakeEmail - see FakeKinds)
+	Fake string
+	// KeepLast is the number of trailing characters left visible by TransformMask
+	KeepLast int
+	// Filter is the query documents must match to be kept by TransformKeep
+	Filter bson.D
+}
+
+// Transform redacts and rewrites documents as they are exported, e.g. so that test data can
+// be shared without leaking PII. Rules apply in order. Transforms can be built in Go:
+//
+//	transform := &mongotest.Transform{
+//		Salt: "bug-1234",
+//		Rules: []mongotest.TransformRule{
+//			{Collection: "users", Field: "email", Action: mongotest.TransformFake, Fake: mongotest.FakeEmail},
+//			{Field: "ssn", Action: mongotest.TransformMask, KeepLast: 4},
+//			{Collection: "users", Action: mongotest.TransformKeep, Filter: bson.D{{Key: "active", Value: true}}},
+//		},
+//	}
+//
+// or loaded from a YAML rules file using LoadTransformFile.
+type Transform struct {
+	// Salt is mixed into hashed and fake values, so they can't be reversed by hashing guesses
+	Salt string
+	// Rules are applied in order
+	Rules []TransformRule
+}
+
+// transformFile is the YAML layout read by ParseTransform
+type transformFile struct {
+	Salt  string `yaml:"salt"`
+	Rules []struct {
+		Collection string    `yaml:"collection"`
+		Action     string    `yaml:"action"`
+		Field      string    `yaml:"field"`
+		Fake       string    `yaml:"fake"`
+		KeepLast   int       `yaml:"keepLast"`
+		Filter     yaml.Node `yaml:"filter"`
+	} `yaml:"rules"`
+}
+
+// LoadTransformFile reads a Transform from a YAML rules file (see ParseTransform)
+func LoadTransformFile(fpath string) (*Transform, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := ParseTransform(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse transform rules in '%s': %w", fpath, err)
+	}
+	return transform, nil
+}
+
+// ParseTransform parses a Transform from YAML:
+//
+//	salt: bug-1234
+//	rules:
+//	  - collection: users
+//	    field: email
+//	    action: fake
+//	    fake: email
+//	  - field: ssn
+//	    action: mask
+//	    keepLast: 4
+//	  - field: password
+//	    action: drop
+//	  - collection: users
+//	    action: keep
+//	    filter: {active: true}
+//
+// Filters can use the same !oid, !date and !decimal tags as YAML fixtures.
+func ParseTransform(data []byte) (*Transform, error) {
+	var file transformFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	transform := &Transform{Salt: file.Salt}
+	for i, fileRule := range file.Rules {
+		rule := TransformRule{
+			Collection: fileRule.Collection,
+			Action:     TransformAction(fileRule.Action),
+			Field:      fileRule.Field,
+			Fake:       fileRule.Fake,
+			KeepLast:   fileRule.KeepLast,
+		}
+		if !fileRule.Filter.IsZero() {
+			filter, err := yamlNodeToBSON(&fileRule.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			var ok bool
+			if rule.Filter, ok = filter.(bson.D); !ok {
+				return nil, fmt.Errorf("rule %d: the filter must be a mapping", i+1)
+			}
+		}
+		transform.Rules = append(transform.Rules, rule)
+	}
+	if err := transform.Validate(); err != nil {
+		return nil, err
+	}
+	return transform, nil
+}
+
+// Validate checks that every rule is complete
+func (t *Transform) Validate() error {
+	for i, rule := range t.Rules {
+		var err error
+		switch rule.Action {
+		case TransformKeep:
+			if rule.Filter == nil {
+				err = errors.New("keep rules require a filter")
+			}
+		case TransformDrop, TransformHash:
+			if len(rule.Field) == 0 {
+				err = fmt.Errorf("%s rules require a field", rule.Action)
+			}
+		case TransformMask:
+			if len(rule.Field) == 0 {
+				err = errors.New("mask rules require a field")
+			} else if rule.KeepLast < 0 {
+				err = fmt.Errorf("keepLast must not be negative, found %d", rule.KeepLast)
+			}
+		case TransformFake:
+			if len(rule.Field) == 0 {
+				err = errors.New("fake rules require a field")
+			} else if _, ok := fakeGenerators[rule.Fake]; !ok {
+				err = fmt.Errorf("unknown fake value kind '%s' (expected one of %s)", rule.Fake, strings.Join(FakeKinds(), ", "))
+			}
+		default:
+			err = fmt.Errorf("unknown action '%s'", rule.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("transform rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// keepFilter returns the query documents in collName must match to be kept, or nil if every
+// document is kept
+func (t *Transform) keepFilter(collName string) bson.D {
+	filters := bson.A{}
+	for _, rule := range t.rulesFor(collName) {
+		if rule.Action == TransformKeep {
+			filters = append(filters, rule.Filter)
+		}
+	}
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0].(bson.D)
+	default:
+		return bson.D{{Key: "$and", Value: filters}}
+	}
+}
+
+// withKeepFilter combines filter with the keep rules for collName
+func (t *Transform) withKeepFilter(collName string, filter bson.D) bson.D {
+	keep := t.keepFilter(collName)
+	if keep == nil {
+		return filter
+	}
+	if len(filter) == 0 {
+		return keep
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, keep}}}
+}
+
+// rulesFor returns the rules which apply to collName
+func (t *Transform) rulesFor(collName string) []TransformRule {
+	rules := []TransformRule{}
+	for _, rule := range t.Rules {
+		if len(rule.Collection) == 0 || rule.Collection == collName {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// apply rewrites doc from collName using the field rules. Keep rules are applied by the query
+// used to read the documents instead (see withKeepFilter).
+func (t *Transform) apply(collName string, doc bson.D) (bson.D, error) {
+	for _, rule := range t.rulesFor(collName) {
+		if rule.Action == TransformKeep {
+			continue
+		}
+		var err error
+		doc, err = transformPath(doc, strings.Split(rule.Field, "."), func(value interface{}) (interface{}, bool, error) {
+			return t.transformValue(rule, value)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not apply %s rule to '%s': %w", rule.Action, rule.Field, err)
+		}
+	}
+	return doc, nil
+}
+
+// transformValue applies rule to a single value, returning the new value and whether to keep it
+func (t *Transform) transformValue(rule TransformRule, value interface{}) (interface{}, bool, error) {
+	switch rule.Action {
+	case TransformDrop:
+		return nil, false, nil
+	case TransformHash:
+		seed, err := t.valueSeed(value)
+		if err != nil {
+			return nil, false, err
+		}
+		sum := sha256.Sum256(seed)
+		return hex.EncodeToString(sum[:]), true, nil
+	case TransformMask:
+		s, ok := value.(string)
+		if !ok {
+			return maskedValue, true, nil
+		}
+		runes := []rune(s)
+		masked := len(runes) - rule.KeepLast
+		if masked > len(runes) {
+			masked = len(runes)
+		} else if masked < 0 {
+			masked = 0
+		}
+		for i := 0; i < masked; i++ {
+			runes[i] = '*'
+		}
+		return string(runes), true, nil
+	case TransformFake:
+		seed, err := t.valueSeed(value)
+		if err != nil {
+			return nil, false, err
+		}
+		fake, err := fakeValue(rule.Fake, seed)
+		return fake, true, err
+	}
+	return value, true, nil
+}
+
+// valueSeed returns the salted bytes hashed to produce a value's replacement. The value is
+// encoded as Canonical Extended JSON so that values of different types don't collide.
+func (t *Transform) valueSeed(value interface{}) ([]byte, error) {
+	encoded, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(t.Salt+"\x00"), encoded...), nil
+}
+
+// transformPath calls fn for every value found at path in doc, replacing each value with the
+// one returned (or removing it if fn returns false). Arrays are traversed, unless the next part
+// of the path is an index.
+func transformPath(doc bson.D, path []string, fn func(value interface{}) (interface{}, bool, error)) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		if elem.Key != path[0] {
+			out = append(out, elem)
+			continue
+		}
+		if len(path) == 1 {
+			value, keep, err := fn(elem.Value)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				out = append(out, bson.E{Key: elem.Key, Value: value})
+			}
+			continue
+		}
+		value, err := transformNested(elem.Value, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bson.E{Key: elem.Key, Value: value})
+	}
+	return out, nil
+}
+
+// transformNested applies transformPath below an embedded document or array
+func transformNested(value interface{}, path []string, fn func(value interface{}) (interface{}, bool, error)) (interface{}, error) {
+	switch typed := value.(type) {
+	case bson.D:
+		return transformPath(typed, path, fn)
+	case bson.A:
+		out := make(bson.A, 0, len(typed))
+		index, err := strconv.Atoi(path[0])
+		isIndex := err == nil
+		for i, item := range typed {
+			switch {
+			case isIndex && i != index:
+				out = append(out, item)
+			case isIndex && len(path) == 1:
+				newItem, keep, err := fn(item)
+				if err != nil {
+					return nil, err
+				}
+				if keep {
+					out = append(out, newItem)
+				}
+			case isIndex:
+				newItem, err := transformNested(item, path[1:], fn)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, newItem)
+			default:
+				// Not an index - apply the path to every element
+				newItem, err := transformNested(item, path, fn)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, newItem)
+			}
+		}
+		return out, nil
+	default:
+		// The path doesn't exist in this document
+		return value, nil
+	}
+}
+
+// copyTransformed copies the collections in srcDB (or just collName, if set) into dstDB, applying
+// t to every document
+func (tc *TestConnection) copyTransformed(ctx context.Context, srcDB, dstDB, collName string, t *Transform) error {
+	return tc.copyCollections(ctx, srcDB, dstDB, collName, func(collName string) bson.D {
+		return t.withKeepFilter(collName, bson.D{})
+	}, t.apply, t.collidingFields)
+}
+
+// collidingFields returns the fields of collName whose rules may map distinct values to the
+// same value (or remove them), so unique indexes on them can't be kept. Hashes stay distinct.
+func (t *Transform) collidingFields(collName string) []string {
+	var fields []string
+	for _, rule := range t.rulesFor(collName) {
+		switch rule.Action {
+		case TransformDrop, TransformMask, TransformFake:
+			fields = append(fields, rule.Field)
+		}
+	}
+	return fields
+}
+
+// withoutUnique removes the unique option from index if any of its keys overlap with fields
+func withoutUnique(index bson.D, fields []string) (bson.D, bool) {
+	keys, _ := index.Map()["key"].(bson.D)
+	overlaps := false
+	for _, key := range keys {
+		for _, field := range fields {
+			if key.Key == field || strings.HasPrefix(key.Key, field+".") || strings.HasPrefix(field, key.Key+".") {
+				overlaps = true
+			}
+		}
+	}
+	if !overlaps {
+		return index, false
+	}
+	out := make(bson.D, 0, len(index))
+	for _, elem := range index {
+		if elem.Key != "unique" {
+			out = append(out, elem)
+		}
+	}
+	return out, len(out) != len(index)
+}
+
+// copyCollections replaces the collections in dstDB with those in srcDB (or just collName, if
+// set), passing every document matching filter through rewrite. Collection options and indexes
+// are copied too, except that indexes on the fields returned by colliding (if set) lose their
+// unique option, as rewrite may no longer keep those values distinct.
+func (tc *TestConnection) copyCollections(ctx context.Context, srcDB, dstDB, collName string,
+	filter func(collName string) bson.D, rewrite func(collName string, doc bson.D) (bson.D, error),
+	colliding func(collName string) []string) error {
+	client := tc.MongoDriverClient()
+	src, dst := client.Database(srcDB), client.Database(dstDB)
+	specs, err := listExportableCollections(ctx, src)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if len(collName) != 0 && spec.Name != collName {
+			continue
+		}
+		if err = dst.Collection(spec.Name).Drop(ctx); err != nil {
+			return err
+		}
+		var collOpts bson.D
+		if len(spec.Options) != 0 {
+			if err = bson.Unmarshal(spec.Options, &collOpts); err != nil {
+				return err
+			}
+		}
+		if err = createCollection(ctx, dst, spec.Name, collOpts); err != nil {
+			return fmt.Errorf("could not create %s.%s: %w", dstDB, spec.Name, err)
+		}
+		err = copyDocuments(ctx, src.Collection(spec.Name), dst.Collection(spec.Name), filter(spec.Name), rewrite)
+		if err != nil {
+			return fmt.Errorf("could not copy %s.%s: %w", srcDB, spec.Name, err)
+		}
+		cursor, err := src.Collection(spec.Name).Indexes().List(ctx)
+		if err != nil {
+			return err
+		}
+		var indexes []bson.D
+		if err = cursor.All(ctx, &indexes); err != nil {
+			return err
+		}
+		if colliding != nil {
+			fields := colliding(spec.Name)
+			for i := range indexes {
+				var relaxed bool
+				if indexes[i], relaxed = withoutUnique(indexes[i], fields); relaxed {
+					tc.logger.Debug("Dropped the unique option from a rewritten index", Fields{
+						"database":   dstDB,
+						"collection": spec.Name,
+						"index":      indexes[i].Map()["name"],
+					})
+				}
+			}
+		}
+		if err = createIndexes(ctx, dst, spec.Name, indexes); err != nil {
+			return fmt.Errorf("could not create indexes on %s.%s: %w", dstDB, spec.Name, err)
+		}
+	}
+	return nil
+}
+
+// copyDocuments inserts every document in src matching filter into dst, after rewriting it
+func copyDocuments(ctx context.Context, src, dst *mongo.Collection, filter bson.D,
+	rewrite func(collName string, doc bson.D) (bson.D, error)) error {
+	cursor, err := src.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	batch := make([]interface{}, 0, fixtureInsertBatchSize)
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err = cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if doc, err = rewrite(src.Name(), doc); err != nil {
+			return err
+		}
+		batch = append(batch, doc)
+		if len(batch) == fixtureInsertBatchSize {
+			if err = insertInBatches(ctx, dst, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	return insertInBatches(ctx, dst, batch)
+}
@@ -0,0 +1,438 @@
+package mongotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/yaml.v3"
+)
+
+// yamlAnchorKey is the document key naming a document so that others can reference its _id
+const yamlAnchorKey = "_anchor"
+
+// Custom YAML tags emitted by the fixture template functions
+const (
+	yamlTagObjectID = "!oid"
+	yamlTagDate     = "!date"
+	yamlTagDecimal  = "!decimal"
+)
+
+// LoadYAMLFixtures loads every YAML fixture found below root in fsys. Files are laid out the same
+// way as for LoadFixtures - <root>/<db>/<collection>.yaml (or .yml) - and each contains a YAML
+// sequence of documents. Before being parsed, each file is run through text/template with
+// the following functions available:
+//
+//	{{ oid }}                - a new ObjectID
+//	{{ ref "alice" }}        - the ObjectID of the document anchored as "alice"
+//	{{ now }}                - the time the fixtures started loading
+//	{{ ago "36h" }}          - a date relative to now (any time.ParseDuration string)
+//	{{ fromNow "15m" }}      - a date relative to now
+//	{{ daysAgo 3 }}          - a date 3 days before now
+//	{{ daysFromNow 3 }}      - a date 3 days after now
+//	{{ seq "orders" }}       - 1, 2, 3... - one counter per name
+//
+// A document can be anchored using the special _anchor key, which is removed before insertion.
+// If the anchored document doesn't have an _id, it is given the ObjectID returned by ref for
+// that anchor. Anchors work across files and collections, e.g.:
+//
+//	# fixtures/shop/users.yaml
+//	- _anchor: alice
+//	  name: Alice
+//	  signedUp: {{ daysAgo 30 }}
+//	# fixtures/shop/orders.yaml
+//	- _id: {{ oid }}
+//	  user: {{ ref "alice" }}
+//	  number: {{ seq "orders" }}
+//
+// Every anchor passed to ref must be defined by some document's _anchor key; otherwise nothing
+// is inserted and an error listing the undefined anchors is returned. YAML merge keys are
+// supported, including lists of maps (<<: [*a, *b]) - as in YAML, keys set on the document win
+// over merged keys, and earlier maps in the list win over later ones.
+//
+// Template expressions producing ObjectIDs or dates must not be quoted. The !oid, !date and
+// !decimal tags they produce can also be written by hand (e.g. `price: !decimal 9.99`).
+// The returned map contains the ObjectID of every anchor, for use in assertions.
+func (tc *TestConnection) LoadYAMLFixtures(fsys fs.FS, root string) (map[string]primitive.ObjectID, error) {
+	state := newYAMLFixtureState(time.Now())
+	dbEntries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return nil, fmt.Errorf("could not read fixture directory '%s': %w", root, err)
+	}
+	// Decode every file before inserting anything, so references can be checked across files
+	type yamlFixture struct {
+		fpath, dbName, collName string
+		docs                    []interface{}
+	}
+	var fixtures []yamlFixture
+	for _, dbEntry := range dbEntries {
+		if !dbEntry.IsDir() {
+			continue
+		}
+		dbName := dbEntry.Name()
+		dbDir := path.Join(root, dbName)
+		entries, err := fs.ReadDir(fsys, dbDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read fixture directory '%s': %w", dbDir, err)
+		}
+		for _, entry := range entries {
+			ext := path.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			fpath := path.Join(dbDir, entry.Name())
+			data, err := fs.ReadFile(fsys, fpath)
+			if err != nil {
+				return nil, err
+			}
+			docs, err := state.decode(fpath, data)
+			if err != nil {
+				return nil, err
+			}
+			fixtures = append(fixtures, yamlFixture{
+				fpath:    fpath,
+				dbName:   dbName,
+				collName: strings.TrimSuffix(entry.Name(), ext),
+				docs:     docs,
+			})
+		}
+	}
+	if err = state.checkReferences(); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	for _, fixture := range fixtures {
+		coll := tc.MongoDriverClient().Database(fixture.dbName).Collection(fixture.collName)
+		if err = insertInBatches(ctx, coll, fixture.docs); err != nil {
+			return nil, fmt.Errorf("could not load fixture '%s': %w", fixture.fpath, err)
+		}
+	}
+	return state.anchors, nil
+}
+
+// yamlFixtureState is shared across every file loaded by a single LoadYAMLFixtures call
+type yamlFixtureState struct {
+	now       time.Time
+	anchors   map[string]primitive.ObjectID
+	defined   map[string]bool
+	sequences map[string]int
+}
+
+func newYAMLFixtureState(now time.Time) *yamlFixtureState {
+	return &yamlFixtureState{
+		now:       now,
+		anchors:   map[string]primitive.ObjectID{},
+		defined:   map[string]bool{},
+		sequences: map[string]int{},
+	}
+}
+
+// funcs returns the functions available to fixture templates
+func (yfs *yamlFixtureState) funcs() template.FuncMap {
+	date := func(t time.Time) string {
+		return yamlTagDate + " " + t.UTC().Format(time.RFC3339Nano)
+	}
+	return template.FuncMap{
+		"oid": func() string {
+			return yamlTagObjectID + " " + primitive.NewObjectID().Hex()
+		},
+		"ref": func(name string) string {
+			return yamlTagObjectID + " " + yfs.ref(name).Hex()
+		},
+		"now": func() string {
+			return date(yfs.now)
+		},
+		"ago": func(d string) (string, error) {
+			dur, err := time.ParseDuration(d)
+			return date(yfs.now.Add(-dur)), err
+		},
+		"fromNow": func(d string) (string, error) {
+			dur, err := time.ParseDuration(d)
+			return date(yfs.now.Add(dur)), err
+		},
+		"daysAgo": func(days int) string {
+			return date(yfs.now.AddDate(0, 0, -days))
+		},
+		"daysFromNow": func(days int) string {
+			return date(yfs.now.AddDate(0, 0, days))
+		},
+		"seq": func(name string) int {
+			yfs.sequences[name]++
+			return yfs.sequences[name]
+		},
+	}
+}
+
+// ref returns the ObjectID for the named anchor, allocating one the first time it's seen
+func (yfs *yamlFixtureState) ref(name string) primitive.ObjectID {
+	if id, ok := yfs.anchors[name]; ok {
+		return id
+	}
+	id := primitive.NewObjectID()
+	yfs.anchors[name] = id
+	return id
+}
+
+// checkReferences returns an error if any anchor passed to ref was never defined by an _anchor key
+func (yfs *yamlFixtureState) checkReferences() error {
+	var undefined []string
+	for name := range yfs.anchors {
+		if !yfs.defined[name] {
+			undefined = append(undefined, name)
+		}
+	}
+	if len(undefined) == 0 {
+		return nil
+	}
+	sort.Strings(undefined)
+	return fmt.Errorf("fixtures reference anchors which no document defines: %s", strings.Join(undefined, ", "))
+}
+
+// decode renders the template in data and converts the resulting YAML sequence into documents
+func (yfs *yamlFixtureState) decode(fpath string, data []byte) ([]interface{}, error) {
+	tmpl, err := template.New(fpath).Funcs(yfs.funcs()).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse fixture template '%s': %w", fpath, err)
+	}
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, nil); err != nil {
+		return nil, fmt.Errorf("could not render fixture template '%s': %w", fpath, err)
+	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(rendered.Bytes(), &root); err != nil {
+		return nil, fmt.Errorf("could not parse YAML fixture '%s': %w", fpath, err)
+	}
+	value, err := yamlNodeToBSON(&root)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert YAML fixture '%s': %w", fpath, err)
+	}
+	if value == nil {
+		// Empty file
+		return nil, nil
+	}
+	items, ok := value.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("YAML fixture '%s' must contain a sequence of documents", fpath)
+	}
+	docs := make([]interface{}, 0, len(items))
+	for i, item := range items {
+		doc, ok := item.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("item %d in YAML fixture '%s' is not a document", i, fpath)
+		}
+		if doc, err = yfs.resolveAnchor(doc); err != nil {
+			return nil, fmt.Errorf("item %d in YAML fixture '%s': %w", i, fpath, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// resolveAnchor strips the _anchor key from doc, linking the anchor to the document's _id
+func (yfs *yamlFixtureState) resolveAnchor(doc bson.D) (bson.D, error) {
+	anchorIdx, idIdx := -1, -1
+	for i, elem := range doc {
+		switch elem.Key {
+		case yamlAnchorKey:
+			anchorIdx = i
+		case "_id":
+			idIdx = i
+		}
+	}
+	if anchorIdx < 0 {
+		return doc, nil
+	}
+	name, ok := doc[anchorIdx].Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", yamlAnchorKey)
+	}
+	if yfs.defined[name] {
+		return nil, fmt.Errorf("anchor '%s' is defined more than once", name)
+	}
+	yfs.defined[name] = true
+	resolved := append(bson.D{}, doc[:anchorIdx]...)
+	resolved = append(resolved, doc[anchorIdx+1:]...)
+	if idIdx < 0 {
+		// Put the _id first, as the server would
+		return append(bson.D{{Key: "_id", Value: yfs.ref(name)}}, resolved...), nil
+	}
+	id, ok := doc[idIdx].Value.(primitive.ObjectID)
+	if !ok {
+		return nil, fmt.Errorf("anchored document '%s' must have an ObjectID _id", name)
+	}
+	if existing, seen := yfs.anchors[name]; seen && existing != id {
+		return nil, fmt.Errorf("anchor '%s' was already referenced as %s, but the document's _id is %s",
+			name, existing.Hex(), id.Hex())
+	}
+	yfs.anchors[name] = id
+	return resolved, nil
+}
+
+// yamlNodeToBSON converts a parsed YAML node into its BSON equivalent, preserving the order of
+// mapping keys. Mappings become bson.D and sequences bson.A. The custom !oid, !date and
+// !decimal tags produce ObjectIDs, dates and Decimal128s respectively.
+func yamlNodeToBSON(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeToBSON(node.Content[0])
+	case yaml.AliasNode:
+		return yamlNodeToBSON(node.Alias)
+	case yaml.MappingNode:
+		doc := yamlMapping{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			if keyNode.Tag == "!!merge" {
+				// Support YAML merge keys (<<: *base and <<: [*a, *b])
+				merged, err := yamlMergeDocuments(valueNode)
+				if err != nil {
+					return nil, err
+				}
+				for _, mergedDoc := range merged {
+					for _, elem := range mergedDoc {
+						if !doc.has(elem.Key) {
+							doc = append(doc, elem)
+						}
+					}
+				}
+				continue
+			}
+			value, err := yamlNodeToBSON(valueNode)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", keyNode.Value, err)
+			}
+			// Keys on the document itself win over merged keys
+			doc.set(bson.E{Key: keyNode.Value, Value: value})
+		}
+		return bson.D(doc), nil
+	case yaml.SequenceNode:
+		arr := bson.A{}
+		for _, item := range node.Content {
+			value, err := yamlNodeToBSON(item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		return arr, nil
+	case yaml.ScalarNode:
+		return yamlScalarToBSON(node)
+	}
+	return nil, fmt.Errorf("unsupported YAML node on line %d", node.Line)
+}
+
+// yamlMapping is a document being built from a YAML mapping
+type yamlMapping bson.D
+
+// has reports whether the mapping contains key
+func (m yamlMapping) has(key string) bool {
+	for _, elem := range m {
+		if elem.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// set replaces the value of elem.Key in place, or appends elem if the key is new
+func (m *yamlMapping) set(elem bson.E) {
+	for i := range *m {
+		if (*m)[i].Key == elem.Key {
+			(*m)[i].Value = elem.Value
+			return
+		}
+	}
+	*m = append(*m, elem)
+}
+
+// yamlMergeDocuments returns the maps merged in by a merge key, which must be a map or a list of
+// maps. Earlier maps in a list take precedence.
+func yamlMergeDocuments(node *yaml.Node) ([]bson.D, error) {
+	value, err := yamlNodeToBSON(node)
+	if err != nil {
+		return nil, err
+	}
+	switch typed := value.(type) {
+	case bson.D:
+		return []bson.D{typed}, nil
+	case bson.A:
+		docs := make([]bson.D, 0, len(typed))
+		for _, item := range typed {
+			doc, ok := item.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("merge key on line %d must only list maps", node.Line)
+			}
+			docs = append(docs, doc)
+		}
+		return docs, nil
+	}
+	return nil, fmt.Errorf("merge key on line %d must be a map or a list of maps", node.Line)
+}
+
+// yamlScalarToBSON converts a YAML scalar based on its (possibly custom) tag
+func yamlScalarToBSON(node *yaml.Node) (interface{}, error) {
+	switch node.Tag {
+	case yamlTagObjectID:
+		id, err := primitive.ObjectIDFromHex(node.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ObjectID '%s' on line %d: %w", node.Value, node.Line, err)
+		}
+		return id, nil
+	case yamlTagDate:
+		t, err := time.Parse(time.RFC3339Nano, node.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date '%s' on line %d: %w", node.Value, node.Line, err)
+		}
+		return primitive.NewDateTimeFromTime(t), nil
+	case yamlTagDecimal:
+		d, err := primitive.ParseDecimal128(node.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decimal '%s' on line %d: %w", node.Value, node.Line, err)
+		}
+		return d, nil
+	case "!!int":
+		i, err := strconv.ParseInt(node.Value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer '%s' on line %d: %w", node.Value, node.Line, err)
+		}
+		// Mirror relaxed Extended JSON - use int32 whenever the value fits
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return int32(i), nil
+		}
+		return i, nil
+	case "!!timestamp":
+		var t time.Time
+		if err := node.Decode(&t); err != nil {
+			return nil, fmt.Errorf("invalid timestamp '%s' on line %d: %w", node.Value, node.Line, err)
+		}
+		return primitive.NewDateTimeFromTime(t), nil
+	case "!!null":
+		return nil, nil
+	case "!!binary":
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(node.Value), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary on line %d: %w", node.Line, err)
+		}
+		return primitive.Binary{Data: data}, nil
+	case "!!str", "":
+		return node.Value, nil
+	}
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return nil, fmt.Errorf("could not decode '%s' on line %d: %w", node.Value, node.Line, err)
+	}
+	return value, nil
+}